@@ -4,12 +4,22 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
 )
 
+// deliveryLogSize is the number of webhook deliveries shown in the admin
+// interface.
+const deliveryLogSize = 50
+
 type userData struct {
 	indexData
-	Users *[]string
+	Users      *[]string
+	Webhooks   []scan.Webhook
+	Deliveries []scan.Delivery
 }
 
 func (u *userData) AddError(err string) {
@@ -75,6 +85,12 @@ func (app *App) adminHandler(w http.ResponseWriter, r *http.Request) {
 		case err == errSelfDeletion:
 			data.AddError(selfDeletion)
 			w.WriteHeader(http.StatusBadRequest)
+		case err == errInvalidWebhook:
+			data.AddError(invalidWebhook)
+			w.WriteHeader(http.StatusBadRequest)
+		case err == errInvalidWebhookFilter:
+			data.AddError(invalidWebhookFilter)
+			w.WriteHeader(http.StatusBadRequest)
 		case err != nil:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -88,14 +104,29 @@ func (app *App) adminHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	data.Webhooks, err = app.db.LoadWebhooks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Deliveries, err = app.db.LoadDeliveries(deliveryLogSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	tmpl.ExecuteTemplate(w, "admin", data)
 }
 
 var (
-	userExists      = "User already exists"
-	selfDeletion    = "You can't delete yourself"
-	errUserExists   = errors.New(strings.ToLower(userExists))
-	errSelfDeletion = errors.New(strings.ToLower(selfDeletion))
+	userExists              = "User already exists"
+	selfDeletion            = "You can't delete yourself"
+	invalidWebhook          = "Webhook URL must be an http or https URL, with a valid format"
+	invalidWebhookFilter    = "Webhook CIDR and ports must be valid, e.g. 192.0.2.0/24 and 22,80"
+	errUserExists           = errors.New(strings.ToLower(userExists))
+	errSelfDeletion         = errors.New(strings.ToLower(selfDeletion))
+	errInvalidWebhook       = errors.New(strings.ToLower(invalidWebhook))
+	errInvalidWebhookFilter = errors.New(strings.ToLower(invalidWebhookFilter))
 )
 
 func (app *App) adminFormProcess(f url.Values, user User, users []string) error {
@@ -123,5 +154,45 @@ func (app *App) adminFormProcess(f url.Values, user User, users []string) error
 		app.audit(user.Email, "delete_user", delete)
 	}
 
+	if add := strings.TrimSpace(f.Get("add_webhook")); add != "" {
+		if !validWebhookURL(add) {
+			return errInvalidWebhook
+		}
+		h := scan.Webhook{
+			URL:            add,
+			Secret:         f.Get("webhook_secret"),
+			Format:         f.Get("webhook_format"),
+			CIDR:           strings.TrimSpace(f.Get("webhook_cidr")),
+			Ports:          strings.TrimSpace(f.Get("webhook_ports")),
+			UnexpectedOnly: f.Get("webhook_unexpected") != "",
+			Created:        scan.Time{Time: time.Now().UTC().Truncate(time.Second)},
+			CreatedBy:      user.Email,
+		}
+		if h.Format == "" {
+			h.Format = scan.WebhookJSON
+		}
+		if !validWebhookFormat(h.Format) {
+			return errInvalidWebhook
+		}
+		if _, err := h.Scope(); err != nil {
+			return errInvalidWebhookFilter
+		}
+		if _, err := app.db.SaveWebhook(h); err != nil {
+			return err
+		}
+		app.audit(user.Email, "add_webhook", add)
+	}
+
+	if delete := f.Get("delete_webhook"); delete != "" {
+		id, err := strconv.ParseInt(delete, 10, 64)
+		if err != nil {
+			return err
+		}
+		if err := app.db.DeleteWebhook(id); err != nil {
+			return err
+		}
+		app.audit(user.Email, "delete_webhook", delete)
+	}
+
 	return nil
 }
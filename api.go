@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// Page sizes for API results
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// apiError is the body of an API error response.
+type apiError struct {
+	Error string `json:"error"`
+	// Fields are the problems with each field of an invalid request
+	Fields scan.FieldErrors `json:"fields,omitempty"`
+}
+
+func renderError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	resp := apiError{Error: err.Error()}
+	errors.As(err, &resp.Fields)
+	w.WriteHeader(status)
+	render.JSON(w, r, resp)
+}
+
+// requireAuth is a middleware rejecting requests from users who aren't
+// logged in.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok, err := sessionUser(r)
+		if err != nil {
+			renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			renderError(w, r, http.StatusUnauthorized, errors.New("login required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiRouter returns the routes for the versioned JSON API.
+func (app *App) apiRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Use(requireAuth)
+	r.Get("/diff", app.apiDiff)
+	r.Get("/jobs", app.apiJobs)
+	r.Post("/jobs", app.apiNewJob)
+	r.Get("/results", app.apiResults)
+	r.Get("/submissions", app.apiSubmissions)
+	r.Get("/submissions/{id}/diff", app.apiSubmissionDiff)
+	r.Put("/triage", app.apiTriage)
+	r.Get("/policies", app.apiPolicies)
+	r.Post("/policies", app.apiNewPolicy)
+	r.Delete("/policies/{id}", app.apiDeletePolicy)
+	return r
+}
+
+// resultFilter builds a filter from the API query parameters.
+func resultFilter(q url.Values) (sqlite.SQLFilter, error) {
+	var filter sqlite.SQLFilter
+	add := func(where string, values ...interface{}) {
+		filter.Where = append(filter.Where, where)
+		filter.Values = append(filter.Values, values...)
+	}
+
+	if ip := q.Get("ip"); ip != "" {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return filter, fmt.Errorf("invalid IP address %q", ip)
+		}
+		add(`ipbin=?`, []byte(addr.To16()))
+	}
+	scope, err := scan.ParseScope(q.Get("cidr"), q.Get("port"), q.Get("proto"))
+	if err != nil {
+		return filter, err
+	}
+	filter = filter.And(sqlite.ScopeFilter(scope))
+	query, err := sqlite.ParseQuery(q.Get("q"))
+	if err != nil {
+		return filter, fmt.Errorf("q: %w", err)
+	}
+	filter = filter.And(query)
+
+	times := []struct {
+		param, where string
+	}{
+		{"firstseen_after", `firstseen >= ?`},
+		{"firstseen_before", `firstseen < ?`},
+		{"lastseen_after", `lastseen >= ?`},
+		{"lastseen_before", `lastseen < ?`},
+	}
+	for _, t := range times {
+		if v := q.Get(t.param); v != "" {
+			ts, err := scan.ParseTime(v)
+			if err != nil {
+				return filter, fmt.Errorf("%s: %w", t.param, err)
+			}
+			add(t.where, ts)
+		}
+	}
+
+	if v := q.Get("asof"); v != "" {
+		asof, err := scan.ParseTime(v)
+		if err != nil {
+			return filter, fmt.Errorf("asof: %w", err)
+		}
+		filter = filter.And(sqlite.AsOfFilter(asof))
+	}
+
+	if v := q.Get("triage"); v != "" {
+		states := strings.Split(v, ",")
+		for _, s := range states {
+			if !scan.ValidTriageState(s) {
+				return filter, fmt.Errorf("invalid triage state %q", s)
+			}
+		}
+		filter = filter.And(sqlite.TriageFilter(states...))
+	}
+
+	switch state := q.Get("state"); state {
+	case "":
+	case "new":
+		add(sqlite.WhereNew)
+	case "gone":
+		add(sqlite.WhereGone)
+	case "open":
+		add(sqlite.WhereOpen)
+	default:
+		return filter, fmt.Errorf("invalid state %q", state)
+	}
+
+	switch policy := q.Get("policy"); policy {
+	case "":
+	case "expected":
+		add(sqlite.WhereExpected)
+	case "unexpected":
+		add(sqlite.WhereUnexpected)
+	default:
+		return filter, fmt.Errorf("invalid policy %q", policy)
+	}
+
+	return filter, nil
+}
+
+type resultsResponse struct {
+	Results []scan.IPInfo `json:"results"`
+	Next    string        `json:"next,omitempty"`
+}
+
+// Handler for GET /api/v1/results
+func (app *App) apiResults(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	filter, err := resultFilter(q)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	page := sqlite.Page{Sort: "port", Limit: defaultPageSize, Cursor: q.Get("cursor")}
+	if sort := q.Get("sort"); sort != "" {
+		page.Sort = strings.TrimPrefix(sort, "-")
+		page.Desc = strings.HasPrefix(sort, "-")
+	}
+	if limit := q.Get("limit"); limit != "" {
+		page.Limit, err = strconv.Atoi(limit)
+		if err != nil || page.Limit < 1 || page.Limit > maxPageSize {
+			renderError(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+	}
+
+	results, next, err := app.db.LoadDataPage(filter, page)
+	switch {
+	case errors.Is(err, sqlite.ErrInvalidCursor), errors.Is(err, sqlite.ErrInvalidSort):
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if results == nil {
+		results = []scan.IPInfo{}
+	}
+
+	render.JSON(w, r, resultsResponse{Results: results, Next: next})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestAPIResults(t *testing.T) {
+	db := createDB("TestAPIResults")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	submissions := [][]scan.Result{
+		{
+			{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+			{IP: "192.0.2.10", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+			{IP: "198.51.100.1", Ports: []scan.Port{{Port: 443, Proto: "tcp", Status: "open"}}},
+		},
+		{
+			{IP: "192.0.2.2", Ports: []scan.Port{{Port: 53, Proto: "udp", Status: "open"}}},
+			{IP: "2001:db8::1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		},
+	}
+	for i, results := range submissions {
+		if _, err := db.SaveData(results, first.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(query url.Values) (int, resultsResponse) {
+		r := httptest.NewRequest("GET", "/api/v1/results?"+query.Encode(), nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		var resp resultsResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		q := url.Values{"sort": {"-lastseen"}, "limit": {"2"}}
+		seen := make(map[int64]bool)
+		var pages int
+		for {
+			code, resp := get(q)
+			if code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", code)
+			}
+			pages++
+			for _, r := range resp.Results {
+				if seen[r.ID] {
+					t.Errorf("result %d returned twice", r.ID)
+				}
+				seen[r.ID] = true
+			}
+			if resp.Next == "" {
+				break
+			}
+			q.Set("cursor", resp.Next)
+		}
+		if pages != 3 || len(seen) != 5 {
+			t.Errorf("expected 5 results over 3 pages, got %d over %d", len(seen), pages)
+		}
+	})
+
+	t.Run("SortByIP", func(t *testing.T) {
+		_, resp := get(url.Values{"sort": {"ip"}})
+		want := []string{"192.0.2.1", "192.0.2.2", "192.0.2.10", "198.51.100.1", "2001:db8::1"}
+		if len(resp.Results) != len(want) {
+			t.Fatalf("expected %d results, got %d", len(want), len(resp.Results))
+		}
+		for i, r := range resp.Results {
+			if r.IP != want[i] {
+				t.Errorf("result %d: expected %s, got %s", i, want[i], r.IP)
+			}
+		}
+	})
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  int
+	}{
+		{"CIDR", url.Values{"cidr": {"192.0.2.0/24"}}, 3},
+		{"CIDRv6", url.Values{"cidr": {"2001:db8::/32"}}, 1},
+		{"Port", url.Values{"port": {"22"}}, 2},
+		{"PortRange", url.Values{"port": {"1-100"}, "proto": {"tcp"}}, 3},
+		{"FirstSeenAfter", url.Values{"firstseen_after": {first.Add(time.Minute).Format(time.RFC3339)}}, 2},
+		{"LastSeenBefore", url.Values{"lastseen_before": {first.Add(time.Minute).Format(time.RFC3339)}}, 3},
+		{"IP", url.Values{"ip": {"2001:db8:0::1"}}, 1},
+		{"Search", url.Values{"q": {"192.0.2.0/24 22"}}, 1},
+		{"New", url.Values{"state": {"new"}}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp := get(tt.query)
+			if code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", code)
+			}
+			if len(resp.Results) != tt.want {
+				t.Errorf("expected %d results, got %d", tt.want, len(resp.Results))
+			}
+		})
+	}
+
+	invalid := []url.Values{
+		{"cidr": {"192.0.2.0/33"}},
+		{"state": {"closed"}},
+		{"q": {"port:ssh"}},
+		{"sort": {"banner"}},
+		{"cursor": {"garbage"}},
+		{"limit": {"0"}},
+	}
+	for _, q := range invalid {
+		if code, _ := get(q); code != http.StatusBadRequest {
+			t.Errorf("%v: expected status 400, got %d", q, code)
+		}
+	}
+}
@@ -74,6 +74,30 @@ func oauthConfig() {
 	}
 }
 
+// sessionUser returns the logged in user from the session. ok is false if
+// nobody is logged in. When authentication is disabled ok is always true.
+func sessionUser(r *http.Request) (user User, ok bool, err error) {
+	if authDisabled {
+		return user, true, nil
+	}
+
+	session, err := store.Get(r, "user")
+	if err != nil {
+		return user, false, err
+	}
+	v, ok := session.Values["user"]
+	if !ok {
+		return user, false, nil
+	}
+	switch v := v.(type) {
+	case string:
+		user.Email = v
+	case User:
+		user = v
+	}
+	return user, true, nil
+}
+
 func getLoginURL(state string) string {
 	return conf.AuthCodeURL(state)
 }
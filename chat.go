@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// chatLimit is the most ports listed in each section of a chat message.
+const chatLimit = 20
+
+// filterNotification returns the notification with only the ports the
+// webhook wants to be told about.
+func filterNotification(h scan.Webhook, n scan.Notification) (scan.Notification, error) {
+	scope, err := h.Scope()
+	if err != nil {
+		return n, err
+	}
+	match := func(results []scan.IPInfo) []scan.IPInfo {
+		matched := []scan.IPInfo{}
+		for _, r := range results {
+			if h.UnexpectedOnly && r.Expected {
+				continue
+			}
+			if scope.Contains(r.IP, r.Port, r.Proto) {
+				matched = append(matched, r)
+			}
+		}
+		return matched
+	}
+	n.Opened = match(n.Opened)
+	n.Closed = match(n.Closed)
+	return n, nil
+}
+
+// webhookBody encodes the notification in the webhook's format. ok is false
+// if there's nothing to send, as chat messages aren't sent if no ports the
+// webhook is interested in changed.
+func webhookBody(h scan.Webhook, n scan.Notification) (body []byte, ok bool, err error) {
+	n, err = filterNotification(h, n)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var msg interface{} = n
+	if h.Format != scan.WebhookJSON && h.Format != "" {
+		if len(n.Opened) == 0 && len(n.Closed) == 0 {
+			return nil, false, nil
+		}
+		switch h.Format {
+		case scan.WebhookSlack:
+			msg = slackMessage(n)
+		case scan.WebhookMattermost:
+			msg = mattermostMessage(n)
+		case scan.WebhookTeams:
+			msg = teamsMessage(n)
+		default:
+			return nil, false, fmt.Errorf("unknown webhook format %q", h.Format)
+		}
+	}
+
+	body, err = json.Marshal(msg)
+	return body, err == nil, err
+}
+
+// chatSummary is the first line of a chat message.
+func chatSummary(n scan.Notification) string {
+	s := fmt.Sprintf("Submission %d from %s", n.Submission.ID, n.Submission.Host)
+	if n.Submission.Job != 0 {
+		s += fmt.Sprintf(" for job %d", n.Submission.Job)
+	}
+	if n.Rule != "" {
+		return fmt.Sprintf("Rule %s fired: %s opened %d matching ports", n.Rule, s, len(n.Opened))
+	}
+	return fmt.Sprintf("%s opened %d ports and closed %d", s, len(n.Opened), len(n.Closed))
+}
+
+// chatPort describes a port, linking the IP to its host page with link if the
+// base URL is known.
+func chatPort(r scan.IPInfo, link func(text, url string) string) string {
+	ip := r.IP
+	if baseURL != "" {
+		ip = link(r.IP, baseURL+"/ip/"+r.IP)
+	}
+	s := fmt.Sprintf("%s %d/%s", ip, r.Port, r.Proto)
+	if r.Service != "" {
+		s += " " + r.Service
+	}
+	return s
+}
+
+// chatLines describes up to chatLimit ports, one per line.
+func chatLines(results []scan.IPInfo, prefix string, link func(text, url string) string) string {
+	var lines []string
+	for i, r := range results {
+		if i == chatLimit {
+			lines = append(lines, fmt.Sprintf("%sand %d more", prefix, len(results)-chatLimit))
+			break
+		}
+		lines = append(lines, prefix+chatPort(r, link))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type slackAttachment struct {
+	Color string `json:"color"`
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+// slackPayload is a Slack incoming webhook message.
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+func slackLink(text, url string) string {
+	return "<" + url + "|" + text + ">"
+}
+
+func slackMessage(n scan.Notification) slackPayload {
+	msg := slackPayload{Text: chatSummary(n)}
+	if len(n.Opened) > 0 {
+		msg.Attachments = append(msg.Attachments, slackAttachment{Color: "danger", Title: "Opened", Text: chatLines(n.Opened, "", slackLink)})
+	}
+	if len(n.Closed) > 0 {
+		msg.Attachments = append(msg.Attachments, slackAttachment{Color: "good", Title: "Closed", Text: chatLines(n.Closed, "", slackLink)})
+	}
+	return msg
+}
+
+// mattermostPayload is a Mattermost incoming webhook message. Text is
+// Markdown.
+type mattermostPayload struct {
+	Username string `json:"username"`
+	Text     string `json:"text"`
+}
+
+func markdownLink(text, url string) string {
+	return "[" + text + "](" + url + ")"
+}
+
+func mattermostMessage(n scan.Notification) mattermostPayload {
+	text := chatSummary(n)
+	if len(n.Opened) > 0 {
+		text += "\n#### Opened\n" + chatLines(n.Opened, "- ", markdownLink)
+	}
+	if len(n.Closed) > 0 {
+		text += "\n#### Closed\n" + chatLines(n.Closed, "- ", markdownLink)
+	}
+	return mattermostPayload{Username: "Scan", Text: text}
+}
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type teamsSection struct {
+	ActivityTitle string      `json:"activityTitle"`
+	Facts         []teamsFact `json:"facts"`
+}
+
+// teamsPayload is a Microsoft Teams message card.
+type teamsPayload struct {
+	Type       string         `json:"@type"`
+	Context    string         `json:"@context"`
+	Summary    string         `json:"summary"`
+	ThemeColor string         `json:"themeColor"`
+	Title      string         `json:"title"`
+	Sections   []teamsSection `json:"sections"`
+}
+
+// teamsFacts lists up to chatLimit ports as facts, named by IP.
+func teamsFacts(results []scan.IPInfo) []teamsFact {
+	var facts []teamsFact
+	for i, r := range results {
+		if i == chatLimit {
+			facts = append(facts, teamsFact{Name: "…", Value: fmt.Sprintf("and %d more", len(results)-chatLimit)})
+			break
+		}
+		name := r.IP
+		if baseURL != "" {
+			name = markdownLink(r.IP, baseURL+"/ip/"+r.IP)
+		}
+		value := fmt.Sprintf("%d/%s", r.Port, r.Proto)
+		if r.Service != "" {
+			value += " " + r.Service
+		}
+		facts = append(facts, teamsFact{Name: name, Value: value})
+	}
+	return facts
+}
+
+func teamsMessage(n scan.Notification) teamsPayload {
+	summary := chatSummary(n)
+	msg := teamsPayload{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		Summary:    summary,
+		ThemeColor: "5cb85c",
+		Title:      summary,
+	}
+	if len(n.Opened) > 0 {
+		msg.ThemeColor = "d9534f"
+		msg.Sections = append(msg.Sections, teamsSection{ActivityTitle: "Opened", Facts: teamsFacts(n.Opened)})
+	}
+	if len(n.Closed) > 0 {
+		msg.Sections = append(msg.Sections, teamsSection{ActivityTitle: "Closed", Facts: teamsFacts(n.Closed)})
+	}
+	return msg
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestWebhookBody(t *testing.T) {
+	n := scan.Notification{
+		Submission: scan.Submission{ID: 3, Host: "192.0.2.250"},
+		Opened: []scan.IPInfo{
+			{IP: "192.0.2.1", Port: 443, Proto: "tcp", Service: "https", Expected: true},
+			{IP: "192.0.2.1", Port: 3389, Proto: "tcp"},
+			{IP: "198.51.100.1", Port: 22, Proto: "tcp", Service: "ssh"},
+		},
+		Closed: []scan.IPInfo{{IP: "192.0.2.2", Port: 80, Proto: "tcp"}},
+	}
+
+	t.Run("Filter", func(t *testing.T) {
+		tests := []struct {
+			name           string
+			hook           scan.Webhook
+			opened, closed int
+		}{
+			{"All", scan.Webhook{}, 3, 1},
+			{"CIDR", scan.Webhook{CIDR: "192.0.2.0/24"}, 2, 1},
+			{"Ports", scan.Webhook{Ports: "22,3389"}, 2, 0},
+			{"UnexpectedOnly", scan.Webhook{CIDR: "192.0.2.0/24", UnexpectedOnly: true}, 1, 1},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := filterNotification(tt.hook, n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got.Opened) != tt.opened || len(got.Closed) != tt.closed {
+					t.Errorf("expected %d opened and %d closed, got %d and %d", tt.opened, tt.closed, len(got.Opened), len(got.Closed))
+				}
+			})
+		}
+	})
+
+	baseURL = "https://scan.example.com"
+	defer func() { baseURL = "" }()
+
+	t.Run("Slack", func(t *testing.T) {
+		body, ok, err := webhookBody(scan.Webhook{Format: scan.WebhookSlack, Ports: "22"}, n)
+		if err != nil || !ok {
+			t.Fatalf("expected a message, got %v", err)
+		}
+		var msg slackPayload
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Text != "Submission 3 from 192.0.2.250 opened 1 ports and closed 0" {
+			t.Errorf("unexpected text %q", msg.Text)
+		}
+		if len(msg.Attachments) != 1 || msg.Attachments[0].Text != "<https://scan.example.com/ip/198.51.100.1|198.51.100.1> 22/tcp ssh" {
+			t.Errorf("unexpected attachments %+v", msg.Attachments)
+		}
+	})
+
+	t.Run("Mattermost", func(t *testing.T) {
+		body, ok, err := webhookBody(scan.Webhook{Format: scan.WebhookMattermost, CIDR: "192.0.2.2"}, n)
+		if err != nil || !ok {
+			t.Fatalf("expected a message, got %v", err)
+		}
+		var msg mattermostPayload
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(msg.Text, "#### Closed\n- [192.0.2.2](https://scan.example.com/ip/192.0.2.2) 80/tcp") {
+			t.Errorf("unexpected text %q", msg.Text)
+		}
+		if strings.Contains(msg.Text, "Opened") {
+			t.Errorf("expected no opened ports in %q", msg.Text)
+		}
+	})
+
+	t.Run("Teams", func(t *testing.T) {
+		body, ok, err := webhookBody(scan.Webhook{Format: scan.WebhookTeams}, n)
+		if err != nil || !ok {
+			t.Fatalf("expected a message, got %v", err)
+		}
+		var msg teamsPayload
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != "MessageCard" || len(msg.Sections) != 2 || len(msg.Sections[0].Facts) != 3 {
+			t.Errorf("unexpected card %+v", msg)
+		}
+	})
+
+	t.Run("NothingToSend", func(t *testing.T) {
+		for _, format := range []string{scan.WebhookSlack, scan.WebhookMattermost, scan.WebhookTeams} {
+			_, ok, err := webhookBody(scan.Webhook{Format: format, CIDR: "203.0.113.0/24"}, n)
+			if err != nil || ok {
+				t.Errorf("%s: expected nothing to send, got ok=%v err=%v", format, ok, err)
+			}
+		}
+		// JSON webhooks are told about every submission
+		if _, ok, _ := webhookBody(scan.Webhook{Format: scan.WebhookJSON, CIDR: "203.0.113.0/24"}, n); !ok {
+			t.Error("expected JSON webhooks to always be sent")
+		}
+	})
+}
+
+func TestChatWebhooks(t *testing.T) {
+	db := createDB("TestChatWebhooks")
+	defer db.Close()
+	app := &App{db: db}
+	mux := app.setupRouter()
+
+	var mu sync.Mutex
+	received := make(map[string][]byte)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+
+	admin := User{Email: "admin@example.com"}
+	for _, f := range []url.Values{
+		{"add_webhook": {receiver.URL + "/network"}, "webhook_format": {"slack"}, "webhook_unexpected": {"1"}},
+		{"add_webhook": {receiver.URL + "/web"}, "webhook_format": {"teams"}, "webhook_ports": {"80,443"}},
+	} {
+		if err := app.adminFormProcess(f, admin, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invalid := []url.Values{
+		{"add_webhook": {receiver.URL}, "webhook_format": {"irc"}},
+		{"add_webhook": {receiver.URL}, "webhook_cidr": {"192.0.2.0/33"}},
+	}
+	for _, f := range invalid {
+		if err := app.adminFormProcess(f, admin, nil); err == nil {
+			t.Errorf("%v: expected an error", f)
+		}
+	}
+
+	data := `[{"ip":"192.0.2.1","ports":[{"port":22,"proto":"tcp","status":"open"}]}]`
+	r := httptest.NewRequest("POST", "/results", strings.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	app.pending.Wait()
+
+	if _, ok := received["/network"]; !ok {
+		t.Error("expected the network channel to be told about port 22")
+	}
+	if _, ok := received["/web"]; ok {
+		t.Error("expected the web channel not to be told about port 22")
+	}
+}
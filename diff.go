@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+type diffData struct {
+	indexData
+	scan.Diff
+}
+
+// parseDiff parses the query parameters of a diff. from is required and to
+// defaults to now. Results can be narrowed with a query in q.
+func parseDiff(q url.Values) (filter sqlite.SQLFilter, from, to time.Time, err error) {
+	filter, err = sqlite.ParseQuery(q.Get("q"))
+	if err != nil {
+		return
+	}
+	if q.Get("from") == "" {
+		err = errors.New("from is required")
+		return
+	}
+	from, err = scan.ParseTime(q.Get("from"))
+	if err != nil {
+		err = fmt.Errorf("from: %w", err)
+		return
+	}
+	to = time.Now().UTC()
+	if v := q.Get("to"); v != "" {
+		to, err = scan.ParseTime(v)
+		if err != nil {
+			err = fmt.Errorf("to: %w", err)
+			return
+		}
+	}
+	if to.Before(from) {
+		err = errors.New("to is before from")
+	}
+	return
+}
+
+// Handler for GET /diff
+// Lists the ports which opened and closed between the from and to times.
+func (app *App) diff(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tmpl.ExecuteTemplate(w, "diff", diffData{indexData: indexData{URI: r.RequestURI}})
+		return
+	}
+
+	q := r.URL.Query()
+	// Fetch result numbers for display in the navbar
+	results, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
+	data := diffData{
+		indexData: indexData{
+			Authenticated: true,
+			User:          user,
+			URI:           r.URL.Path,
+			Search:        q.Get("q"),
+			Data:          results,
+		},
+	}
+
+	// Show the form without errors until it's been submitted
+	if len(q) == 0 {
+		tmpl.ExecuteTemplate(w, "diff", data)
+		return
+	}
+
+	filter, from, to, err := parseDiff(q)
+	if err != nil {
+		data.Errors = append(data.Errors, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		tmpl.ExecuteTemplate(w, "diff", data)
+		return
+	}
+
+	data.Diff, err = app.db.DiffData(filter, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.ExecuteTemplate(w, "diff", data)
+}
+
+// Handler for GET /api/v1/diff
+func (app *App) apiDiff(w http.ResponseWriter, r *http.Request) {
+	filter, from, to, err := parseDiff(r.URL.Query())
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	diff, err := app.db.DiffData(filter, from, to)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, diff)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// seedSnapshots saves three scans a day apart. 192.0.2.1:22 is open
+// throughout, 192.0.2.2:80 closes on the third day and 192.0.2.3:443 opens on
+// the second day.
+func seedSnapshots(t *testing.T, db *sqlite.DB) time.Time {
+	t.Helper()
+	day1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ssh := scan.Result{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}}
+	web := scan.Result{IP: "192.0.2.2", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}}
+	https := scan.Result{IP: "192.0.2.3", Ports: []scan.Port{{Port: 443, Proto: "tcp", Status: "open"}}}
+	scans := [][]scan.Result{
+		{ssh, web},
+		{ssh, web, https},
+		{ssh, https},
+	}
+	for i, results := range scans {
+		now := day1.AddDate(0, 0, i)
+		if _, err := db.SaveData(results, now); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.CloseMissing(scan.Scope{}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return day1
+}
+
+func TestAsOf(t *testing.T) {
+	db := createDB("TestAsOf")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+	day1 := seedSnapshots(t, db)
+
+	tests := []struct {
+		asof time.Time
+		want []string
+	}{
+		{day1.Add(-time.Hour), nil},
+		{day1, []string{"192.0.2.1", "192.0.2.2"}},
+		{day1.Add(36 * time.Hour), []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		{day1.AddDate(0, 0, 2), []string{"192.0.2.1", "192.0.2.3"}},
+	}
+	for _, tt := range tests {
+		q := url.Values{"asof": {tt.asof.Format(time.RFC3339)}, "sort": {"ip"}}
+		r := httptest.NewRequest("GET", "/api/v1/results?"+q.Encode(), nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		var resp resultsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range resp.Results {
+			got = append(got, r.IP)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("asof %s: expected %v, got %v", tt.asof, tt.want, got)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/?asof="+day1.Format(time.RFC3339), nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, body)
+	}
+	// 192.0.2.2 has closed since, but should still be shown
+	if !strings.Contains(body, ">192.0.2.2<") || strings.Contains(body, ">192.0.2.3<") {
+		t.Errorf("expected snapshot of the first day")
+	}
+
+	r = httptest.NewRequest("GET", "/?asof=yesterday", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "asof: invalid time") {
+		t.Errorf("expected asof error, got %d", w.Code)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	db := createDB("TestDiff")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+	day1 := seedSnapshots(t, db)
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", uri, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	q := url.Values{"from": {day1.Format(time.RFC3339)}, "to": {day1.AddDate(0, 0, 2).Format(time.RFC3339)}}
+	w := get("/api/v1/diff?" + q.Encode())
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var diff scan.Diff
+	if err := json.NewDecoder(w.Body).Decode(&diff); err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Opened) != 1 || diff.Opened[0].IP != "192.0.2.3" {
+		t.Errorf("expected 192.0.2.3 to have opened, got %+v", diff.Opened)
+	}
+	if len(diff.Closed) != 1 || diff.Closed[0].IP != "192.0.2.2" {
+		t.Errorf("expected 192.0.2.2 to have closed, got %+v", diff.Closed)
+	}
+
+	// Nothing closed by the second day
+	q.Set("to", day1.AddDate(0, 0, 1).Format(time.RFC3339))
+	w = get("/api/v1/diff?" + q.Encode())
+	diff = scan.Diff{}
+	json.NewDecoder(w.Body).Decode(&diff)
+	if len(diff.Opened) != 1 || len(diff.Closed) != 0 {
+		t.Errorf("expected 1 opened and 0 closed, got %d and %d", len(diff.Opened), len(diff.Closed))
+	}
+
+	q.Set("q", "port:80")
+	q.Set("to", day1.AddDate(0, 0, 2).Format(time.RFC3339))
+	w = get("/diff?" + q.Encode())
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, body)
+	}
+	if strings.Contains(body, ">192.0.2.3<") || !strings.Contains(body, ">192.0.2.2<") {
+		t.Errorf("expected only 192.0.2.2 in the diff page")
+	}
+
+	for _, q := range []string{"", "from=yesterday", "from=2020-01-02&to=2020-01-01"} {
+		if w := get("/api/v1/diff?" + q); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status 400, got %d", q, w.Code)
+		}
+	}
+	if w := get("/diff?to=2020-01-01"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "from is required") {
+		t.Errorf("expected error to be shown, got %d", w.Code)
+	}
+}
+
+func TestAsOfReopened(t *testing.T) {
+	db := createDB("TestAsOfReopened")
+	defer db.Close()
+
+	// 192.0.2.2:80 closes on the second day and reopens on the fourth
+	day1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ssh := scan.Result{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}}
+	web := scan.Result{IP: "192.0.2.2", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}}
+	scans := [][]scan.Result{
+		{ssh, web},
+		{ssh},
+		{ssh},
+		{ssh, web},
+	}
+	for i, results := range scans {
+		now := day1.AddDate(0, 0, i)
+		if _, err := db.SaveData(results, now); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.CloseMissing(scan.Scope{}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	open := func(asof time.Time) []string {
+		t.Helper()
+		data, err := db.LoadData(sqlite.AsOfFilter(asof))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ips []string
+		for _, d := range data {
+			ips = append(ips, d.IP)
+		}
+		return ips
+	}
+	for i, want := range []string{"192.0.2.1 192.0.2.2", "192.0.2.1", "192.0.2.1", "192.0.2.1 192.0.2.2"} {
+		asof := day1.AddDate(0, 0, i)
+		if got := strings.Join(open(asof), " "); got != want {
+			t.Errorf("asof %s: expected %s, got %s", asof, want, got)
+		}
+	}
+
+	// Closed during the window and not yet reopened at the end of it
+	diff, err := db.DiffData(sqlite.SQLFilter{}, day1, day1.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Opened) != 0 || len(diff.Closed) != 1 || diff.Closed[0].IP != "192.0.2.2" {
+		t.Errorf("expected 192.0.2.2 to have closed, got %+v", diff)
+	}
+
+	diff, err = db.DiffData(sqlite.SQLFilter{}, day1.AddDate(0, 0, 1), day1.AddDate(0, 0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Closed) != 0 || len(diff.Opened) != 1 || diff.Opened[0].IP != "192.0.2.2" {
+		t.Errorf("expected 192.0.2.2 to have reopened, got %+v", diff)
+	}
+
+	// Closed and reopened within the window
+	diff, err = db.DiffData(sqlite.SQLFilter{}, day1, day1.AddDate(0, 0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Opened) != 0 || len(diff.Closed) != 0 {
+		t.Errorf("expected no changes, got %+v", diff)
+	}
+}
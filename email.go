@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// mailer sends email through an SMTP server.
+type mailer struct {
+	Addr     string // host:port
+	From     string
+	To       []string
+	Username string
+	Password string
+	// TLS is "starttls" to upgrade the connection with STARTTLS, "tls" to
+	// connect with TLS or "none" to send in the clear.
+	TLS string
+	// Alerts enables an email after each submission which changed anything.
+	Alerts bool
+}
+
+// send sends an HTML email to all recipients.
+func (m *mailer) send(subject string, body []byte) error {
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	var c *smtp.Client
+	switch m.TLS {
+	case "tls":
+		conn, err := tls.Dial("tcp", m.Addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		c, err = smtp.NewClient(conn, host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	case "starttls", "none":
+		c, err = smtp.Dial(m.Addr)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid TLS mode %q", m.TLS)
+	}
+	defer c.Close()
+
+	if m.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("server doesn't support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\n", m.From)
+	fmt.Fprintf(w, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(w, "Content-Type: text/html; charset=UTF-8\r\n")
+	fmt.Fprintf(w, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write(body); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+type alertEmailData struct {
+	BaseURL    string
+	Rule       string
+	Submission scan.Submission
+	Opened     []scan.IPInfo
+	Closed     []scan.IPInfo
+}
+
+// mailAlert emails the changes made by a submission. Only ports not covered
+// by a policy are included in those opened, unless a rule fired, when the
+// ports which matched it are. Nothing is sent if there's nothing to report.
+func (app *App) mailAlert(n scan.Notification) error {
+	data := alertEmailData{BaseURL: baseURL, Rule: n.Rule, Submission: n.Submission, Closed: n.Closed}
+	for _, r := range n.Opened {
+		if n.Rule != "" || !r.Expected {
+			data.Opened = append(data.Opened, r)
+		}
+	}
+	if len(data.Opened) == 0 && len(data.Closed) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "alertEmail", data); err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("Scan: %d unexpected ports opened, %d closed", len(data.Opened), len(data.Closed))
+	if n.Rule != "" {
+		subject = fmt.Sprintf("Scan: rule %s matched %d opened ports", n.Rule, len(data.Opened))
+	}
+	return app.mailer.send(subject, buf.Bytes())
+}
+
+type digestEmailData struct {
+	BaseURL string
+	Period  string
+	Since   scan.Time
+	Until   scan.Time
+	// Ports which opened or closed during the period
+	Opened []scan.IPInfo
+	Closed []scan.IPInfo
+	// Open ports not covered by a policy which haven't been triaged
+	Unacknowledged []scan.IPInfo
+}
+
+// digestPeriods are the valid digest periods and how far back they cover.
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// digest summarises the changes in the period up to until.
+func (app *App) digest(period string, until time.Time) (digestEmailData, error) {
+	since := until.Add(-digestPeriods[period])
+	data := digestEmailData{
+		BaseURL: baseURL,
+		Period:  period,
+		Since:   scan.Time{Time: since},
+		Until:   scan.Time{Time: until},
+	}
+
+	var err error
+	data.Opened, err = app.db.LoadData(sqlite.SQLFilter{
+		Where:  []string{sqlite.WhereOpen, `opened >= ?`, `opened < ?`},
+		Values: []interface{}{since, until},
+	})
+	if err != nil {
+		return data, err
+	}
+	data.Closed, err = app.db.LoadData(sqlite.ClosedFilter(since, until))
+	if err != nil {
+		return data, err
+	}
+	unack := sqlite.SQLFilter{Where: []string{sqlite.WhereOpen, sqlite.WhereUnexpected}}
+	data.Unacknowledged, err = app.db.LoadData(unack.And(sqlite.TriageFilter(scan.TriageNew)))
+	return data, err
+}
+
+// mailDigest emails the digest for the period up to until.
+func (app *App) mailDigest(period string, until time.Time) error {
+	data, err := app.digest(period, until)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "digestEmail", data); err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("Scan %s digest: %d opened, %d closed, %d unacknowledged",
+		period, len(data.Opened), len(data.Closed), len(data.Unacknowledged))
+	return app.mailer.send(subject, buf.Bytes())
+}
+
+// nextDigest returns when the next digest after now is due. Digests are sent
+// at the start of hour, and weekly digests are sent on Mondays.
+func nextDigest(now time.Time, period string, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	days := 1
+	if period == "weekly" {
+		next = next.AddDate(0, 0, (int(time.Monday)-int(next.Weekday())+7)%7)
+		days = 7
+	}
+	if !next.After(now) {
+		next = next.AddDate(0, 0, days)
+	}
+	return next
+}
+
+// runDigests emails a digest every period, forever.
+func (app *App) runDigests(period string, hour int) {
+	for {
+		next := nextDigest(time.Now(), period, hour)
+		time.Sleep(time.Until(next))
+		if err := app.mailDigest(period, next); err != nil {
+			log.Println("runDigests: couldn't send digest:", err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// smtpStandIn accepts mail on a local port, speaking just enough SMTP for
+// net/smtp. Each message received is sent on the returned channel.
+func smtpStandIn(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	msgs := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				tp.PrintfLine("220 localhost ESMTP")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+					case "EHLO", "HELO":
+						tp.PrintfLine("250 localhost")
+					case "DATA":
+						tp.PrintfLine("354 go ahead")
+						data, err := tp.ReadDotBytes()
+						if err != nil {
+							return
+						}
+						msgs <- string(data)
+						tp.PrintfLine("250 ok")
+					case "QUIT":
+						tp.PrintfLine("221 bye")
+						return
+					default:
+						tp.PrintfLine("250 ok")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return l.Addr().String(), msgs
+}
+
+// readMessage returns the subject and decoded body of a message.
+func readMessage(t *testing.T, msg string) (string, string) {
+	t.Helper()
+	tp := textproto.NewReader(bufio.NewReader(strings.NewReader(msg)))
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(tp.R))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr.Get("Subject"), string(body)
+}
+
+func TestEmailAlert(t *testing.T) {
+	db := createDB("TestEmailAlert")
+	defer db.Close()
+	addr, msgs := smtpStandIn(t)
+	app := &App{db: db, mailer: &mailer{
+		Addr:   addr,
+		From:   "scan@example.com",
+		To:     []string{"ops@example.com", "web@example.com"},
+		TLS:    "none",
+		Alerts: true,
+	}}
+	mux := app.setupRouter()
+
+	if _, err := db.SavePolicy(scan.Policy{CIDR: "192.0.2.0/24", Ports: "443"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+	}, time.Now().UTC().Add(-time.Hour).Truncate(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	data := `[{"ip":"192.0.2.1","ports":[{"port":443,"proto":"tcp","status":"open"},{"port":3389,"proto":"tcp","status":"open"}]}]`
+	r := httptest.NewRequest("POST", "/results", strings.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	app.pending.Wait()
+
+	select {
+	case msg := <-msgs:
+		subject, body := readMessage(t, msg)
+		if want := "Scan: 1 unexpected ports opened, 1 closed"; subject != want {
+			t.Errorf("expected subject %q, got %q", want, subject)
+		}
+		if !strings.Contains(body, "<td>3389/tcp</td>") || !strings.Contains(body, "<td>80/tcp</td>") {
+			t.Errorf("expected ports 3389 and 80 in the alert:\n%s", body)
+		}
+		if strings.Contains(body, "443/tcp") {
+			t.Errorf("port 443 is expected so shouldn't be in the alert:\n%s", body)
+		}
+	default:
+		t.Fatal("no alert was sent")
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	db := createDB("TestEmailDigest")
+	defer db.Close()
+	addr, msgs := smtpStandIn(t)
+	app := &App{db: db, mailer: &mailer{Addr: addr, From: "scan@example.com", To: []string{"ops@example.com"}, TLS: "none"}}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.2", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+	}, now.Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.3", Ports: []scan.Port{{Port: 3389, Proto: "tcp", Status: "open"}}},
+	}, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CloseMissing(scan.Scope{}, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveTriage(scan.Triage{IP: "192.0.2.1", Port: 22, Proto: "tcp", State: scan.TriageAcknowledged, Updated: scan.Time{Time: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.mailDigest("daily", now); err != nil {
+		t.Fatal(err)
+	}
+	subject, body := readMessage(t, <-msgs)
+	if want := "Scan daily digest: 1 opened, 1 closed, 1 unacknowledged"; subject != want {
+		t.Errorf("expected subject %q, got %q", want, subject)
+	}
+	for _, want := range []string{"192.0.2.3", "192.0.2.2"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s in the digest", want)
+		}
+	}
+
+	// Nothing happened in the last day of a week ago
+	data, err := app.digest("daily", now.Add(-7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Opened)+len(data.Closed) != 0 {
+		t.Errorf("expected no changes, got %d opened and %d closed", len(data.Opened), len(data.Closed))
+	}
+
+	// A port which closed and reopened during the period was still closed
+	https := []scan.Result{{IP: "192.0.2.4", Ports: []scan.Port{{Port: 443, Proto: "tcp", Status: "open"}}}}
+	if _, err := db.SaveData(https, now.Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	scope, _ := scan.ParseScope("192.0.2.4", "", "")
+	if _, err := db.CloseMissing(scope, now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveData(https, now.Add(-30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	data, err = app.digest("daily", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var closed []string
+	for _, r := range data.Closed {
+		closed = append(closed, r.IP)
+	}
+	if strings.Join(closed, " ") != "192.0.2.2 192.0.2.4" {
+		t.Errorf("expected 192.0.2.2 and 192.0.2.4 to have closed, got %v", closed)
+	}
+}
+
+func TestNextDigest(t *testing.T) {
+	// 2020-01-01 was a Wednesday
+	wed := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now    time.Time
+		period string
+		want   time.Time
+	}{
+		{wed, "daily", time.Date(2020, 1, 2, 8, 0, 0, 0, time.UTC)},
+		{wed.Add(-5 * time.Hour), "daily", time.Date(2020, 1, 1, 8, 0, 0, 0, time.UTC)},
+		{wed, "weekly", time.Date(2020, 1, 6, 8, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 1, 6, 8, 0, 0, 0, time.UTC), "weekly", time.Date(2020, 1, 13, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s", tt.period, tt.now.Format(time.RFC3339)), func(t *testing.T) {
+			if got := nextDigest(tt.now, tt.period, 8); !got.Equal(tt.want) {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// exportColumns is the header row of CSV exports.
+var exportColumns = []string{"ip", "port", "proto", "service", "product", "version", "firstseen", "lastseen", "closed", "state"}
+
+// exportTime formats a time for export. The zero time is empty.
+func exportTime(t scan.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// state returns the state of the result for export.
+func state(r scan.IPInfo) string {
+	switch {
+	case r.Gone:
+		return "gone"
+	case r.New:
+		return "new"
+	}
+	return "open"
+}
+
+// exporter writes results in an export format.
+type exporter interface {
+	Write(scan.IPInfo) error
+	Flush() error
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e csvExporter) Write(r scan.IPInfo) error {
+	return e.w.Write([]string{
+		r.IP,
+		strconv.Itoa(r.Port),
+		r.Proto,
+		r.Service,
+		r.Product,
+		r.Version,
+		exportTime(r.FirstSeen),
+		exportTime(r.LastSeen),
+		exportTime(r.Closed),
+		state(r),
+	})
+}
+
+func (e csvExporter) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExporter struct {
+	enc *json.Encoder
+}
+
+func (e ndjsonExporter) Write(r scan.IPInfo) error {
+	return e.enc.Encode(r)
+}
+
+func (e ndjsonExporter) Flush() error { return nil }
+
+// exportContentTypes maps each export format to its Content-Type.
+var exportContentTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+}
+
+// clearWriteDeadline removes the server's write deadline for the response
+// being written by w, looking through any middleware wrapping it. Response
+// writers can only do this when built with Go 1.20 or newer; otherwise the
+// deadline is left as it is.
+func clearWriteDeadline(w http.ResponseWriter) error {
+	for {
+		switch rw := w.(type) {
+		case interface{ SetWriteDeadline(time.Time) error }:
+			return rw.SetWriteDeadline(time.Time{})
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// Handler for GET /export.{format}
+// Exports the results shown on the index page, using the same query
+// parameters. Gone ports are only included if the all or asof parameter is
+// set.
+// Results are written as they're read from the database.
+func (app *App) export(w http.ResponseWriter, r *http.Request) {
+	_, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	format := chi.URLParam(r, "format")
+	ct, ok := exportContentTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported export format %q", format), http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	filter, asof, err := indexFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter = filter.And(sqlite.SeenFilter(q.Get("firstseen"), q.Get("lastseen")))
+	if _, all := q["all"]; !all && asof.IsZero() {
+		filter.Where = append(filter.Where, sqlite.WhereOpen)
+	}
+
+	// The server's WriteTimeout is far too short for a full export, so lift
+	// it for this response
+	if err := clearWriteDeadline(w); err != nil {
+		log.Printf("export: couldn't clear write deadline: %v", err)
+	}
+
+	filename := fmt.Sprintf("scan-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	var e exporter
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		e = csvExporter{cw}
+	case "ndjson":
+		e = ndjsonExporter{json.NewEncoder(w)}
+	}
+
+	err = app.db.EachData(filter, e.Write)
+	if err == nil {
+		err = e.Flush()
+	}
+	if err != nil {
+		// The response has probably started, so the best we can do is log
+		// it and cut the export short
+		log.Printf("export: error exporting results: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestExportHandler(t *testing.T) {
+	db := createDB("TestExportHandler")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.2", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+	}, now); err != nil {
+		t.Fatal(err)
+	}
+	scope, _ := scan.ParseScope("192.0.2.2", "", "")
+	if _, err := db.CloseMissing(scope, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", uri, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("CSV", func(t *testing.T) {
+		w := get("/export.csv?all")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+			t.Errorf("expected CSV Content-Type, got %s", ct)
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [][]string{
+			exportColumns,
+			{"192.0.2.1", "22", "tcp", "", "", "", "2020-01-01T00:00:00Z", "2020-01-01T00:00:00Z", "", "new"},
+			{"192.0.2.2", "80", "tcp", "", "", "", "2020-01-01T00:00:00Z", "2020-01-01T00:00:00Z", "2020-01-01T01:00:00Z", "gone"},
+		}
+		if len(records) != len(want) {
+			t.Fatalf("expected %d records, got %d", len(want), len(records))
+		}
+		for i := range want {
+			for j := range want[i] {
+				if records[i][j] != want[i][j] {
+					t.Errorf("record %d field %d: expected %q, got %q", i, j, want[i][j], records[i][j])
+				}
+			}
+		}
+	})
+
+	t.Run("NDJSON", func(t *testing.T) {
+		w := get("/export.ndjson?q=port:22")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+		var results []scan.IPInfo
+		s := bufio.NewScanner(w.Body)
+		for s.Scan() {
+			var r scan.IPInfo
+			if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, r)
+		}
+		if len(results) != 1 || results[0].IP != "192.0.2.1" {
+			t.Errorf("expected 192.0.2.1 only, got %+v", results)
+		}
+	})
+
+	t.Run("OpenOnly", func(t *testing.T) {
+		w := get("/export.ndjson")
+		s := bufio.NewScanner(w.Body)
+		var n int
+		for s.Scan() {
+			n++
+		}
+		if n != 1 {
+			t.Errorf("expected 1 open result, got %d", n)
+		}
+	})
+
+	t.Run("WriteTimeout", func(t *testing.T) {
+		ts := httptest.NewUnstartedServer(mux)
+		ts.Config.WriteTimeout = time.Nanosecond
+		ts.Start()
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL + "/export.csv?all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		records, err := csv.NewReader(resp.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 3 {
+			t.Errorf("expected the whole export despite the write timeout, got %d records", len(records))
+		}
+	})
+
+	if w := get("/export.csv?q=port:"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid query, got %d", w.Code)
+	}
+	if w := get("/export.xlsx"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for unknown format, got %d", w.Code)
+	}
+}
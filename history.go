@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// portHistory is every observation of a single port.
+type portHistory struct {
+	Port         int
+	Proto        string
+	Observations []scan.Observation
+}
+
+// First returns when the port was first seen.
+func (p portHistory) First() scan.Time {
+	return p.Observations[0].Time
+}
+
+// Last returns when the port was last seen.
+func (p portHistory) Last() scan.Time {
+	return p.Observations[len(p.Observations)-1].Time
+}
+
+// groupObservations groups observations, which are ordered by port, into the
+// history of each port.
+func groupObservations(obs []scan.Observation) []portHistory {
+	var ports []portHistory
+	for _, o := range obs {
+		if n := len(ports); n == 0 || ports[n-1].Port != o.Port || ports[n-1].Proto != o.Proto {
+			ports = append(ports, portHistory{Port: o.Port, Proto: o.Proto})
+		}
+		p := &ports[len(ports)-1]
+		p.Observations = append(p.Observations, o)
+	}
+	return ports
+}
+
+type historyData struct {
+	indexData
+	IP    string
+	Ports []portHistory
+}
+
+// Handler for GET /history/{ip}
+// The history is returned as JSON if the client accepts it, otherwise a
+// timeline is rendered. It can be narrowed to a single port with the port and
+// proto query parameters.
+func (app *App) history(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wantJSON := render.GetAcceptedContentType(r) == render.ContentTypeJSON
+	if !ok {
+		if wantJSON {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		tmpl.ExecuteTemplate(w, "history", historyData{indexData: indexData{URI: r.RequestURI}})
+		return
+	}
+
+	addr := net.ParseIP(chi.URLParam(r, "ip"))
+	if addr == nil {
+		http.Error(w, "Invalid IP address", http.StatusNotFound)
+		return
+	}
+	ip := addr.String()
+	filter := sqlite.AddrFilter(addr)
+	q := r.URL.Query()
+	if port := q.Get("port"); port != "" {
+		filter.Where = append(filter.Where, "port=?")
+		filter.Values = append(filter.Values, port)
+	}
+	if proto := q.Get("proto"); proto != "" {
+		filter.Where = append(filter.Where, "proto=?")
+		filter.Values = append(filter.Values, proto)
+	}
+
+	obs, err := app.db.LoadObservations(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if wantJSON {
+		if obs == nil {
+			obs = []scan.Observation{}
+		}
+		render.JSON(w, r, obs)
+		return
+	}
+
+	// Fetch result numbers for display in the navbar
+	results, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
+
+	data := historyData{
+		indexData: indexData{
+			Authenticated: true,
+			User:          user,
+			URI:           r.URL.Path,
+			Data:          results,
+		},
+		IP:    ip,
+		Ports: groupObservations(obs),
+	}
+	tmpl.ExecuteTemplate(w, "history", data)
+}
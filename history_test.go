@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestHistoryHandler(t *testing.T) {
+	db := createDB("TestHistoryHandler")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	data := `[{"ip":"192.0.2.1","ports":[{"port":80,"proto":"tcp","status":"open"}]},{"ip":"192.0.2.1","ports":[{"port":443,"proto":"tcp","status":"open"}]}]`
+
+	// Submit the same results twice
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("POST", "/results", strings.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %v: %s", w.Code, w.Body)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/history/192.0.2.1?port=80&proto=tcp", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %v: %s", resp.StatusCode, body)
+	}
+	var obs []scan.Observation
+	if err := json.Unmarshal(body, &obs); err != nil {
+		t.Fatal(err)
+	}
+	if len(obs) != 2 {
+		t.Fatalf("expected 2 observations, got %d", len(obs))
+	}
+	if obs[0].Submission == obs[1].Submission {
+		t.Errorf("expected observations from different submissions, got %d and %d", obs[0].Submission, obs[1].Submission)
+	}
+
+	r = httptest.NewRequest("GET", "/history/192.0.2.1", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	resp = w.Result()
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %v: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), "443/tcp") {
+		t.Errorf("expected timeline for 443/tcp in response")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// lookupAddr performs reverse DNS lookups. It's a variable so tests can avoid
+// the network.
+var (
+	defaultLookupAddr = net.DefaultResolver.LookupAddr
+	lookupAddr        = defaultLookupAddr
+)
+
+// rdnsTimeout limits how long the host page waits for reverse DNS.
+const rdnsTimeout = 2 * time.Second
+
+type hostData struct {
+	indexData
+	IP         string
+	Names      []string
+	Results    []scan.IPInfo
+	Ports      []portHistory
+	Banners    []scan.Banner
+	Traceroute string
+	Jobs       []scan.Job
+	Notes      []scan.Note
+	Tags       []string
+
+	TriageStates []string
+}
+
+// coveringJobs returns the jobs whose CIDR covered ip.
+func coveringJobs(jobs []scan.Job, ip net.IP) []scan.Job {
+	var covering []scan.Job
+	for _, job := range jobs {
+		targets, err := scan.ParseTargets(job.CIDR)
+		if err != nil {
+			continue
+		}
+		for _, t := range targets {
+			if t.Contains(ip) {
+				covering = append(covering, job)
+				break
+			}
+		}
+	}
+	return covering
+}
+
+// Handler for GET /ip/{ip}
+// Shows everything known about a host.
+func (app *App) host(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tmpl.ExecuteTemplate(w, "host", hostData{indexData: indexData{URI: r.RequestURI}})
+		return
+	}
+
+	addr := net.ParseIP(chi.URLParam(r, "ip"))
+	if addr == nil {
+		http.Error(w, "Invalid IP address", http.StatusNotFound)
+		return
+	}
+	ip := addr.String()
+
+	ctx, cancel := context.WithTimeout(r.Context(), rdnsTimeout)
+	defer cancel()
+	names, err := lookupAddr(ctx, ip)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			log.Printf("host: reverse DNS lookup for %s failed: %v", ip, err)
+		}
+	}
+
+	// Fetch result numbers for display in the navbar
+	navbar, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
+
+	data := hostData{
+		indexData: indexData{
+			Authenticated: true,
+			User:          user,
+			URI:           r.URL.Path,
+			Data:          navbar,
+		},
+		IP:           ip,
+		Names:        names,
+		TriageStates: scan.TriageStates,
+	}
+
+	data.Results, err = app.db.LoadData(sqlite.IPFilter(addr))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	byAddr := sqlite.AddrFilter(addr)
+	obs, err := app.db.LoadObservations(byAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Ports = groupObservations(obs)
+	data.Banners, err = app.db.LoadBanners(byAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Traceroute, err = app.db.LoadTraceroute(ip)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jobs, err := app.db.LoadJobs(sqlite.SQLFilter{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Jobs = coveringJobs(jobs, addr)
+	data.Notes, err = app.db.LoadNotes(ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Tags, err = app.db.LoadTags(ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl.ExecuteTemplate(w, "host", data)
+}
+
+// Handler for POST /ip/{ip}
+// Adds a note or tag to the host, or removes a tag.
+func (app *App) updateHost(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	addr := net.ParseIP(chi.URLParam(r, "ip"))
+	if addr == nil {
+		http.Error(w, "Invalid IP address", http.StatusNotFound)
+		return
+	}
+	ip := addr.String()
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := r.PostForm
+
+	switch {
+	case strings.TrimSpace(f.Get("note")) != "":
+		note := scan.Note{
+			IP:      ip,
+			Author:  user.Email,
+			Note:    strings.TrimSpace(f.Get("note")),
+			Created: scan.Time{Time: time.Now().UTC().Truncate(time.Second)},
+		}
+		err = app.db.SaveNote(note)
+		if err == nil {
+			app.audit(user.Email, "add_note", ip)
+		}
+	case strings.TrimSpace(f.Get("tag")) != "":
+		tag := strings.ToLower(strings.TrimSpace(f.Get("tag")))
+		err = app.db.SaveTag(ip, tag)
+		if err == nil {
+			app.audit(user.Email, "add_tag", ip+" "+tag)
+		}
+	case f.Get("untag") != "":
+		tag := f.Get("untag")
+		err = app.db.DeleteTag(ip, tag)
+		if err == nil {
+			app.audit(user.Email, "delete_tag", ip+" "+tag)
+		}
+	default:
+		http.Error(w, "Nothing to do", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/ip/"+ip, http.StatusSeeOther)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestHostHandler(t *testing.T) {
+	db := createDB("TestHostHandler")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		return []string{"host.example.com."}, nil
+	}
+	defer func() { lookupAddr = defaultLookupAddr }()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.2", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+	}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveTraceroute("192.0.2.1", "1 192.0.2.254"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveJob("192.0.2.0/24", "22", "tcp", "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveJob("198.51.100.0/24", "22", "tcp", "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(form url.Values) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/ip/192.0.2.1", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("expected status 303, got %d: %s", w.Code, w.Body)
+		}
+	}
+	post(url.Values{"note": {"Owned by the web team"}})
+	post(url.Values{"tag": {"DMZ"}})
+	post(url.Values{"tag": {"legacy"}})
+	post(url.Values{"untag": {"legacy"}})
+
+	r := httptest.NewRequest("GET", "/ip/192.0.2.1", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, body)
+	}
+	for _, want := range []string{
+		"host.example.com.",
+		"1 192.0.2.254",
+		"192.0.2.0/24",
+		"Owned by the web team",
+		">dmz <",
+		"<td>22</td>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in page", want)
+		}
+	}
+	for _, unwanted := range []string{"198.51.100.0/24", "legacy", "<td>80</td>"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("unexpected %q in page", unwanted)
+		}
+	}
+
+	notes, err := db.LoadNotes("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Author != "" {
+		t.Errorf("expected 1 note without an author, got %+v", notes)
+	}
+
+	// Addresses are found however they were written when submitted
+	data := `[{"ip":"2001:0db8:0000:0000:0000:0000:0000:0001","ports":[{"port":443,"proto":"tcp","status":"open"}]}]`
+	r = httptest.NewRequest("POST", "/results", strings.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	r = httptest.NewRequest("GET", "/ip/2001:db8::1", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "<td>443</td>") || !strings.Contains(body, "443/tcp") {
+		t.Errorf("expected the result and history of 2001:db8::1 on its page")
+	}
+	r = httptest.NewRequest("GET", "/history/2001:db8::1", nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var obs []scan.Observation
+	if err := json.NewDecoder(w.Body).Decode(&obs); err != nil || len(obs) != 1 {
+		t.Errorf("expected 1 observation of 2001:db8::1, got %d (%v)", len(obs), err)
+	}
+
+	r = httptest.NewRequest("GET", "/ip/not-an-ip", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
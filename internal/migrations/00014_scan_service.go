@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00014, down00014)
+}
+
+// Add service detection columns
+func up00014(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE scan ADD COLUMN service text`,
+		`ALTER TABLE scan ADD COLUMN product text`,
+		`ALTER TABLE scan ADD COLUMN version text`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00014(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE scan_migrate AS SELECT ip, port, proto, firstseen, lastseen FROM scan`,
+		`DROP TABLE scan`,
+		`ALTER TABLE scan_migrate RENAME TO scan`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00015, down00015)
+}
+
+// Add banner table
+// Each change in banner text for a port is stored as a new row to keep the
+// history
+func up00015(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS banner (ip text NOT NULL, port integer NOT NULL, proto text NOT NULL, service text NOT NULL, banner text NOT NULL, firstseen datetime NOT NULL, lastseen datetime NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS banner_ip_port_proto ON banner (ip, port, proto)`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00015(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP TABLE IF EXISTS banner`)
+	return err
+}
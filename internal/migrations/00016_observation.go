@@ -0,0 +1,38 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00016, down00016)
+}
+
+// Add observation table, recording each submission a port was seen in
+func up00016(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS observation (submission_id integer NOT NULL, ip text NOT NULL, port integer NOT NULL, proto text NOT NULL, UNIQUE (submission_id, ip, port, proto))`,
+		`CREATE INDEX IF NOT EXISTS observation_ip_port_proto ON observation (ip, port, proto)`,
+		// Existing results only record when they were first and last seen.
+		// Both are the same time as the submission they were seen in, so at
+		// least those observations can be recovered.
+		`INSERT OR IGNORE INTO observation (submission_id, ip, port, proto)
+			SELECT submission.rowid, scan.ip, scan.port, scan.proto FROM scan
+			JOIN submission ON submission.submission_time IN (scan.firstseen, scan.lastseen)`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00016(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP TABLE IF EXISTS observation`)
+	return err
+}
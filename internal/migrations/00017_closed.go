@@ -0,0 +1,55 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00017, down00017)
+}
+
+// Add the time a port was found to be closed
+// Add the scope covered by each submission
+func up00017(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE scan ADD COLUMN closed datetime`,
+		`ALTER TABLE submission ADD COLUMN cidr text`,
+		`ALTER TABLE submission ADD COLUMN ports text`,
+		`ALTER TABLE submission ADD COLUMN proto text`,
+		`UPDATE submission SET cidr=(SELECT cidr FROM job WHERE rowid=submission.job_id), ports=(SELECT ports FROM job WHERE rowid=submission.job_id), proto=(SELECT proto FROM job WHERE rowid=submission.job_id) WHERE job_id IS NOT NULL`,
+		// Previously a port was gone if it wasn't seen in the latest non-job
+		// submission. It closed at the first such submission after it was
+		// last seen.
+		`UPDATE scan SET closed=(SELECT MIN(submission_time) FROM submission WHERE job_id IS NULL AND submission_time > scan.lastseen)`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00017(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE scan_migrate AS SELECT ip, port, proto, firstseen, lastseen, service, product, version FROM scan`,
+		`DROP TABLE scan`,
+		`ALTER TABLE scan_migrate RENAME TO scan`,
+		`CREATE TABLE submission_migrate (host text NOT NULL, job_id integer, submission_time datetime DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO submission_migrate SELECT host, job_id, submission_time FROM submission ORDER BY rowid`,
+		`DROP TABLE submission`,
+		`ALTER TABLE submission_migrate RENAME TO submission`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package migrations
+
+import (
+	"database/sql"
+	"net"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00018, down00018)
+}
+
+// Add a binary representation of the IP address
+// Addresses are stored in their 16-byte form so that IPv4 and IPv6 addresses
+// can be compared and searched by range
+func up00018(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE scan ADD COLUMN ipbin blob`,
+		`CREATE INDEX IF NOT EXISTS scan_ipbin ON scan (ipbin)`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT ip FROM scan`)
+	if err != nil {
+		return err
+	}
+	var ips []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			rows.Close()
+			return err
+		}
+		ips = append(ips, ip)
+	}
+	rows.Close()
+
+	for _, ip := range ips {
+		_, err := tx.Exec(`UPDATE scan SET ipbin=? WHERE ip=?`, []byte(net.ParseIP(ip).To16()), ip)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00018(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE scan_migrate AS SELECT ip, port, proto, firstseen, lastseen, service, product, version, closed FROM scan`,
+		`DROP TABLE scan`,
+		`ALTER TABLE scan_migrate RENAME TO scan`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00019, down00019)
+}
+
+// Add a record of each period a port was closed before it reopened
+// Periods which ended before now weren't recorded, so ports which reopened
+// before now are assumed to have been open since they were first seen
+func up00019(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS closure (ip text NOT NULL, port integer NOT NULL, proto text NOT NULL, closed datetime NOT NULL, reopened datetime NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS closure_port ON closure (ip, port, proto)`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00019(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP TABLE IF EXISTS closure`)
+	return err
+}
@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00020, down00020)
+}
+
+// Add note and tag tables for annotating hosts
+func up00020(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS note (ip text NOT NULL, author text NOT NULL, note text NOT NULL, created datetime NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS note_ip ON note (ip)`,
+		`CREATE TABLE IF NOT EXISTS tag (ip text NOT NULL, tag text NOT NULL, UNIQUE (ip, tag))`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00020(tx *sql.Tx) error {
+	stmts := []string{
+		`DROP TABLE IF EXISTS note`,
+		`DROP TABLE IF EXISTS tag`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
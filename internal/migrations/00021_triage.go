@@ -0,0 +1,23 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00021, down00021)
+}
+
+// Add triage table, holding the current triage state of each port
+// Ports without a row haven't been triaged yet
+func up00021(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS triage (ip text NOT NULL, port integer NOT NULL, proto text NOT NULL, state text NOT NULL, assignee text, comment text, updated datetime NOT NULL, updated_by text NOT NULL, UNIQUE (ip, port, proto))`)
+	return err
+}
+
+func down00021(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP TABLE IF EXISTS triage`)
+	return err
+}
@@ -0,0 +1,32 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00022, down00022)
+}
+
+// Add policy table, describing expected exposure
+// policy_range holds each policy expanded into IP and port ranges so results
+// can be matched against it in SQL
+func up00022(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS policy (id integer PRIMARY KEY, cidr text NOT NULL, ports text NOT NULL, proto text NOT NULL, owner text, expires datetime, created datetime NOT NULL, created_by text NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS policy_range (policy_id integer NOT NULL, ip_first blob NOT NULL, ip_last blob NOT NULL, port_first integer NOT NULL, port_last integer NOT NULL, proto text NOT NULL)`)
+	return err
+}
+
+func down00022(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP TABLE IF EXISTS policy_range`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DROP TABLE IF EXISTS policy`)
+	return err
+}
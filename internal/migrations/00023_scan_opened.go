@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00023, down00023)
+}
+
+// Add the time a port opened, either for the first time or after being closed
+// Ports which reopened before now are assumed to have been open since they
+// were first seen
+func up00023(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE scan ADD COLUMN opened datetime`,
+		`UPDATE scan SET opened = firstseen`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00023(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE scan_migrate AS SELECT ip, port, proto, firstseen, lastseen, service, product, version, closed, ipbin FROM scan`,
+		`DROP TABLE scan`,
+		`ALTER TABLE scan_migrate RENAME TO scan`,
+		`CREATE INDEX IF NOT EXISTS scan_ipbin ON scan (ipbin)`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00024, down00024)
+}
+
+// Add webhooks notified after each submission, and a log of each attempt to
+// deliver them
+func up00024(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS webhook (id integer PRIMARY KEY, url text NOT NULL, secret text, created datetime NOT NULL, created_by text NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS webhook_delivery (webhook_id integer NOT NULL, submission_id integer NOT NULL, time datetime NOT NULL, attempt integer NOT NULL, status integer, error text)`,
+		`CREATE INDEX IF NOT EXISTS webhook_delivery_time ON webhook_delivery (time)`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00024(tx *sql.Tx) error {
+	stmts := []string{
+		`DROP TABLE IF EXISTS webhook_delivery`,
+		`DROP TABLE IF EXISTS webhook`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
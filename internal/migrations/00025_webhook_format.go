@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00025, down00025)
+}
+
+// Add the format of webhook requests, so chat services can be sent messages
+// Add filters restricting which ports each webhook is told about
+func up00025(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE webhook ADD COLUMN format text NOT NULL DEFAULT 'json'`,
+		`ALTER TABLE webhook ADD COLUMN cidr text NOT NULL DEFAULT ''`,
+		`ALTER TABLE webhook ADD COLUMN ports text NOT NULL DEFAULT ''`,
+		`ALTER TABLE webhook ADD COLUMN unexpected_only boolean NOT NULL DEFAULT 0`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00025(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE webhook_migrate AS SELECT id, url, secret, created, created_by FROM webhook`,
+		`DROP TABLE webhook`,
+		`CREATE TABLE webhook (id integer PRIMARY KEY, url text NOT NULL, secret text, created datetime NOT NULL, created_by text NOT NULL)`,
+		`INSERT INTO webhook SELECT * FROM webhook_migrate`,
+		`DROP TABLE webhook_migrate`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
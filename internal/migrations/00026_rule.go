@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00026, down00026)
+}
+
+// Add alert rules and silences
+// webhooks is a comma-separated list of webhook IDs the rule alerts
+// A silence with rule_id 0 applies to every rule
+func up00026(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS rule (id integer PRIMARY KEY, name text NOT NULL, cidr text NOT NULL, ports text NOT NULL, proto text NOT NULL, unexpected_only boolean NOT NULL, min_ports integer NOT NULL, webhooks text NOT NULL, email boolean NOT NULL, created datetime NOT NULL, created_by text NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS silence (id integer PRIMARY KEY, rule_id integer NOT NULL, starts datetime NOT NULL, ends datetime NOT NULL, comment text, created_by text NOT NULL)`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00026(tx *sql.Tx) error {
+	stmts := []string{
+		`DROP TABLE IF EXISTS silence`,
+		`DROP TABLE IF EXISTS rule`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00027, down00027)
+}
+
+// Add the node which has claimed a job and when its lease on the job expires
+func up00027(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE job ADD COLUMN node text`,
+		`ALTER TABLE job ADD COLUMN lease_expires datetime`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00027(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE job_migrate (id int, cidr text NOT NULL, ports text, proto text, requested_by text, submitted datetime, received datetime, count int)`,
+		`INSERT INTO job_migrate (rowid, id, cidr, ports, proto, requested_by, submitted, received, count) SELECT rowid, id, cidr, ports, proto, requested_by, submitted, received, count FROM job`,
+		`DROP TABLE job`,
+		`ALTER TABLE job_migrate RENAME TO job`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00028, down00028)
+}
+
+// Add the state of each job, when it started running and finished, and why
+// it failed
+func up00028(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE job ADD COLUMN state text NOT NULL DEFAULT 'queued'`,
+		`ALTER TABLE job ADD COLUMN started datetime`,
+		`ALTER TABLE job ADD COLUMN finished datetime`,
+		`ALTER TABLE job ADD COLUMN error text`,
+		`UPDATE job SET state='done', finished=received WHERE received IS NOT NULL`,
+		`UPDATE job SET state='running' WHERE received IS NULL AND node IS NOT NULL`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00028(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE job_migrate (id int, cidr text NOT NULL, ports text, proto text, requested_by text, submitted datetime, received datetime, count int, node text, lease_expires datetime)`,
+		`INSERT INTO job_migrate (rowid, id, cidr, ports, proto, requested_by, submitted, received, count, node, lease_expires) SELECT rowid, id, cidr, ports, proto, requested_by, submitted, received, count, node, lease_expires FROM job`,
+		`DROP TABLE job`,
+		`ALTER TABLE job_migrate RENAME TO job`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00029, down00029)
+}
+
+// Add schedules which enqueue jobs periodically
+// spec is a cron expression or an interval
+func up00029(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schedule (id integer PRIMARY KEY, cidr text NOT NULL, ports text NOT NULL, proto text NOT NULL, spec text NOT NULL, paused boolean NOT NULL DEFAULT 0, last_run datetime, last_job integer, next_run datetime NOT NULL, created datetime NOT NULL, created_by text NOT NULL)`)
+	return err
+}
+
+func down00029(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP TABLE IF EXISTS schedule`)
+	return err
+}
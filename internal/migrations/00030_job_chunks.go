@@ -0,0 +1,47 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(up00030, down00030)
+}
+
+// Add the parent of each job which is a chunk of a larger job, and how many
+// chunks a split job has and how many are done
+func up00030(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE job ADD COLUMN parent integer`,
+		`ALTER TABLE job ADD COLUMN chunks integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE job ADD COLUMN chunks_done integer NOT NULL DEFAULT 0`,
+		`CREATE INDEX IF NOT EXISTS job_parent ON job (parent)`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func down00030(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE job_migrate (id int, cidr text NOT NULL, ports text, proto text, requested_by text, submitted datetime, received datetime, count int, node text, lease_expires datetime, state text NOT NULL DEFAULT 'queued', started datetime, finished datetime, error text)`,
+		`INSERT INTO job_migrate (rowid, id, cidr, ports, proto, requested_by, submitted, received, count, node, lease_expires, state, started, finished, error) SELECT rowid, id, cidr, ports, proto, requested_by, submitted, received, count, node, lease_expires, state, started, finished, error FROM job`,
+		`DROP TABLE job`,
+		`ALTER TABLE job_migrate RENAME TO job`,
+	}
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
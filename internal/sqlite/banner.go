@@ -0,0 +1,70 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// LoadBanners retrieves the banner history.
+func (db *DB) LoadBanners(filter SQLFilter) ([]scan.Banner, error) {
+	qry := fmt.Sprintf(`SELECT ip, port, proto, service, banner, firstseen, lastseen FROM banner %s ORDER BY ip, port, proto, service, firstseen`, filter)
+	return db.queryBanners(qry, filter.Values...)
+}
+
+// loadCurrentBanners retrieves the most recent banner for each service on a
+// port.
+func (db *DB) loadCurrentBanners(ip string, port int, proto string) ([]scan.Banner, error) {
+	qry := `SELECT ip, port, proto, service, banner, firstseen, lastseen FROM banner b
+		WHERE ip=? AND port=? AND proto=?
+		AND rowid = (SELECT rowid FROM banner WHERE ip=b.ip AND port=b.port AND proto=b.proto AND service=b.service ORDER BY lastseen DESC, rowid DESC LIMIT 1)
+		ORDER BY service`
+	return db.queryBanners(qry, ip, port, proto)
+}
+
+func (db *DB) queryBanners(qry string, args ...interface{}) ([]scan.Banner, error) {
+	rows, err := db.Query(qry, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var banners []scan.Banner
+	for rows.Next() {
+		var b scan.Banner
+		var firstseen, lastseen time.Time
+		err := rows.Scan(&b.IP, &b.Port, &b.Proto, &b.Service, &b.Banner, &firstseen, &lastseen)
+		if err != nil {
+			return nil, err
+		}
+		b.FirstSeen = scan.Time{Time: firstseen}
+		b.LastSeen = scan.Time{Time: lastseen}
+		banners = append(banners, b)
+	}
+
+	return banners, rows.Err()
+}
+
+// saveBanner records a banner as part of txn. If the banner is unchanged
+// since it was last seen only `lastseen` is updated, otherwise a new banner
+// is added to the history.
+func saveBanner(txn *sql.Tx, ip string, port scan.Port, now time.Time) error {
+	var rowid int64
+	var banner string
+	err := txn.QueryRow(`SELECT rowid, banner FROM banner WHERE ip=? AND port=? AND proto=? AND service=? ORDER BY lastseen DESC, rowid DESC LIMIT 1`,
+		ip, port.Port, port.Proto, port.Service.Name).Scan(&rowid, &banner)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case banner == port.Service.Banner:
+		_, err = txn.Exec(`UPDATE banner SET lastseen=? WHERE rowid=?`, now, rowid)
+		return err
+	}
+
+	_, err = txn.Exec(`INSERT INTO banner (ip, port, proto, service, banner, firstseen, lastseen) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		ip, port.Port, port.Proto, port.Service.Name, port.Service.Banner, now, now)
+	return err
+}
@@ -0,0 +1,69 @@
+package sqlite
+
+import (
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// LoadNotes retrieves the notes left on a host, oldest first.
+func (db *DB) LoadNotes(ip string) ([]scan.Note, error) {
+	rows, err := db.Query(`SELECT rowid, ip, author, note, created FROM note WHERE ip = ? ORDER BY created, rowid`, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []scan.Note
+	for rows.Next() {
+		var n scan.Note
+		var created time.Time
+		err := rows.Scan(&n.ID, &n.IP, &n.Author, &n.Note, &created)
+		if err != nil {
+			return nil, err
+		}
+		n.Created = scan.Time{Time: created.UTC()}
+		notes = append(notes, n)
+	}
+
+	return notes, rows.Err()
+}
+
+// SaveNote stores a note on a host.
+func (db *DB) SaveNote(note scan.Note) error {
+	_, err := db.Exec(`INSERT INTO note (ip, author, note, created) VALUES (?, ?, ?, ?)`,
+		note.IP, note.Author, note.Note, note.Created.Time)
+	return err
+}
+
+// LoadTags retrieves the tags on a host in alphabetical order.
+func (db *DB) LoadTags(ip string) ([]string, error) {
+	rows, err := db.Query(`SELECT tag FROM tag WHERE ip = ? ORDER BY tag`, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// SaveTag tags a host. Adding a tag the host already has does nothing.
+func (db *DB) SaveTag(ip, tag string) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO tag (ip, tag) VALUES (?, ?)`, ip, tag)
+	return err
+}
+
+// DeleteTag removes a tag from a host.
+func (db *DB) DeleteTag(ip, tag string) error {
+	_, err := db.Exec(`DELETE FROM tag WHERE ip = ? AND tag = ?`, ip, tag)
+	return err
+}
@@ -2,6 +2,7 @@ package sqlite
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -10,9 +11,29 @@ import (
 	"github.com/jamesog/scan/pkg/scan"
 )
 
+// Errors returned when changing the state of a job.
+var (
+	ErrJobNotFound = errors.New("job does not exist")
+	ErrJobFinished = errors.New("job has finished")
+	ErrJobClaimed  = errors.New("job is claimed by another node")
+	ErrJobSplit    = errors.New("job is split into chunks")
+)
+
+// WhereJobQueued matches jobs waiting for a node to claim them. Jobs which
+// are split aren't run themselves, so only their chunks are matched.
+const WhereJobQueued = `state = '` + scan.JobQueued + `' AND chunks = 0`
+
+// WhereJobNotChunk matches jobs which aren't a chunk of a larger job.
+const WhereJobNotChunk = `parent IS NULL`
+
+// whereJobClaimable matches jobs which a node may claim, submit or fail: those
+// which are queued, already claimed by the node or whose lease has expired.
+// It takes the node and the current time as arguments.
+const whereJobClaimable = `chunks = 0 AND (state = '` + scan.JobQueued + `' OR (state = '` + scan.JobRunning + `' AND (node = ? OR lease_expires <= ?)))`
+
 // LoadJobs retrives the stored jobs.
 func (db *DB) LoadJobs(filter SQLFilter) ([]scan.Job, error) {
-	qry := fmt.Sprintf(`SELECT rowid, cidr, ports, proto, requested_by, submitted, received, count FROM job %s ORDER BY received DESC, submitted, rowid`, filter)
+	qry := fmt.Sprintf(`SELECT rowid, cidr, ports, proto, requested_by, submitted, received, count, node, lease_expires, state, started, finished, error, parent, chunks, chunks_done FROM job %s ORDER BY received DESC, submitted, rowid`, filter)
 	rows, err := db.Query(qry, filter.Values...)
 	if err != nil {
 		log.Printf("loadJobs: error scanning table: %v\n", err)
@@ -24,13 +45,16 @@ func (db *DB) LoadJobs(filter SQLFilter) ([]scan.Job, error) {
 	var id int
 	var cidr, ports, proto, requestedBy string
 	var submitted time.Time
-	var received sql.NullTime
-	var count sql.NullInt64
+	var received, leaseExpires, started, finished sql.NullTime
+	var count, parent sql.NullInt64
+	var chunks, chunksDone int
+	var node, jobErr sql.NullString
+	var state string
 
 	var jobs []scan.Job
 
 	for rows.Next() {
-		err := rows.Scan(&id, &cidr, &ports, &proto, &requestedBy, &submitted, &received, &count)
+		err := rows.Scan(&id, &cidr, &ports, &proto, &requestedBy, &submitted, &received, &count, &node, &leaseExpires, &state, &started, &finished, &jobErr, &parent, &chunks, &chunksDone)
 		if err != nil {
 			return []scan.Job{}, err
 		}
@@ -38,12 +62,37 @@ func (db *DB) LoadJobs(filter SQLFilter) ([]scan.Job, error) {
 		jobs = append(jobs, scan.Job{
 			ID: id, CIDR: cidr, Ports: ports, Proto: proto,
 			RequestedBy: requestedBy, Submitted: scan.Time{Time: submitted},
-			Received: scan.Time{Time: received.Time}, Count: count.Int64})
+			Received: scan.Time{Time: received.Time}, Count: count.Int64,
+			Node: node.String, LeaseExpires: scan.Time{Time: leaseExpires.Time},
+			State: state, Started: scan.Time{Time: started.Time},
+			Finished: scan.Time{Time: finished.Time}, Error: jobErr.String,
+			Parent: int(parent.Int64), Chunks: chunks, ChunksDone: chunksDone})
 	}
 
 	return jobs, nil
 }
 
+// CountJobStates counts the jobs in each state. Split jobs are counted once,
+// in their own state, rather than by their chunks.
+func (db *DB) CountJobStates() (map[string]int, error) {
+	rows, err := db.Query(`SELECT state, COUNT(*) FROM job WHERE parent IS NULL GROUP BY state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]int)
+	for rows.Next() {
+		var state string
+		var n int
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, err
+		}
+		states[state] = n
+	}
+	return states, rows.Err()
+}
+
 // LoadJobSubmission retrieves the stored submissions associated with a job.
 func (db *DB) LoadJobSubmission() (scan.Submission, error) {
 	f := SQLFilter{
@@ -52,15 +101,17 @@ func (db *DB) LoadJobSubmission() (scan.Submission, error) {
 	return db.LoadSubmission(f)
 }
 
-// SaveJob stores a new custom scan job request.
-func (db *DB) SaveJob(cidr, ports, proto, user string) (int64, error) {
+// SaveJob stores a new custom scan job request. If chunks are given, the job
+// is split into a chunk job for each, which nodes run instead of the job.
+func (db *DB) SaveJob(cidr, ports, proto, user string, chunks ...scan.JobChunk) (int64, error) {
 	txn, err := db.DB.Begin()
 	if err != nil {
 		return 0, err
 	}
 
-	qry := `INSERT INTO job (cidr, ports, proto, requested_by, submitted) VALUES (?, ?, ?, ?, ?)`
-	res, err := txn.Exec(qry, cidr, ports, strings.ToLower(proto), user, time.Now())
+	now := time.Now()
+	qry := `INSERT INTO job (cidr, ports, proto, requested_by, submitted, chunks) VALUES (?, ?, ?, ?, ?, ?)`
+	res, err := txn.Exec(qry, cidr, ports, strings.ToLower(proto), user, now, len(chunks))
 	if err != nil {
 		txn.Rollback()
 		return 0, err
@@ -68,9 +119,19 @@ func (db *DB) SaveJob(cidr, ports, proto, user string) (int64, error) {
 
 	id, err := res.LastInsertId()
 	if err != nil {
+		txn.Rollback()
 		return 0, err
 	}
 
+	qry = `INSERT INTO job (cidr, ports, proto, requested_by, submitted, parent) VALUES (?, ?, ?, ?, ?, ?)`
+	for _, c := range chunks {
+		_, err := txn.Exec(qry, c.CIDR, c.Ports, strings.ToLower(proto), user, now, id)
+		if err != nil {
+			txn.Rollback()
+			return 0, err
+		}
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return 0, err
@@ -79,25 +140,175 @@ func (db *DB) SaveJob(cidr, ports, proto, user string) (int64, error) {
 	return id, nil
 }
 
-// UpdateJob updates the given job to mark the number of ports found.
-func (db *DB) UpdateJob(id string, count int64) error {
-	txn, err := db.DB.Begin()
+// errJobNotUpdated is returned by finishJob if node may not submit the job. It
+// is replaced by the reason from jobConflict once the transaction is over.
+var errJobNotUpdated = errors.New("job not updated")
+
+// finishJob marks a job as done by node, with the number of ports found. Like
+// FailJob, it fails if the job has finished or another node holds its lease.
+func finishJob(txn *sql.Tx, id int64, node string, count int64, now time.Time) error {
+	res, err := txn.Exec(`UPDATE job SET received=?, count=?, state='`+scan.JobDone+`', node=?, finished=?, lease_expires=NULL
+		WHERE rowid=? AND `+whereJobClaimable,
+		now.UTC(), count, node, now.UTC(), id, node, now.UTC())
 	if err != nil {
 		return err
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errJobNotUpdated
+	}
+	_, err = txn.Exec(updateParentsSQL)
+	return err
+}
 
-	qry := `UPDATE job SET received=?, count=? WHERE rowid=?`
-	res, err := txn.Exec(qry, time.Now(), count, id)
-	rows, _ := res.RowsAffected()
-	if err != nil || rows <= 0 {
-		txn.Rollback()
+// ClaimJob leases a job to node until expires, and marks it running. A node
+// may renew its own lease, and a job whose lease has expired may be claimed by
+// any node.
+func (db *DB) ClaimJob(id int64, node string, now, expires time.Time) error {
+	res, err := db.Exec(`UPDATE job SET state='`+scan.JobRunning+`', node=?, lease_expires=?,
+		started=CASE WHEN state='`+scan.JobRunning+`' AND node=? THEN started ELSE ? END
+		WHERE rowid=? AND `+whereJobClaimable,
+		node, expires.UTC(), node, now.UTC(), id, node, now.UTC())
+	if err != nil {
 		return err
 	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return db.updateParents()
+	}
+	return db.jobConflict(id)
+}
 
-	err = txn.Commit()
+// FailJob marks a job as failed, as reported by node.
+func (db *DB) FailJob(id int64, node, msg string, now time.Time) error {
+	res, err := db.Exec(`UPDATE job SET state='`+scan.JobFailed+`', node=?, error=?, finished=?, lease_expires=NULL
+		WHERE rowid=? AND `+whereJobClaimable,
+		node, msg, now.UTC(), id, node, now.UTC())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return db.updateParents()
+	}
+	return db.jobConflict(id)
+}
+
+// CancelJob cancels a job which is queued or running. Cancelling a split job
+// cancels its chunks which haven't finished.
+func (db *DB) CancelJob(id int64, now time.Time) error {
+	res, err := db.Exec(`UPDATE job SET state='`+scan.JobCancelled+`', finished=?, lease_expires=NULL
+		WHERE (rowid=? OR parent=?) AND state IN ('`+scan.JobQueued+`', '`+scan.JobRunning+`')`,
+		now.UTC(), id, id)
 	if err != nil {
 		return err
 	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return db.updateParents()
+	}
+	return db.jobConflict(id)
+}
+
+// jobConflict finds out why the state of a job couldn't be changed.
+func (db *DB) jobConflict(id int64) error {
+	var state string
+	var chunks int
+	err := db.QueryRow(`SELECT state, chunks FROM job WHERE rowid=?`, id).Scan(&state, &chunks)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrJobNotFound
+	case err != nil:
+		return err
+	case state != scan.JobQueued && state != scan.JobRunning:
+		return fmt.Errorf("%w: it's %s", ErrJobFinished, state)
+	case chunks > 0:
+		return ErrJobSplit
+	}
+	return ErrJobClaimed
+}
+
+// ExpireLeases returns jobs whose lease expired before now to the queue, and
+// returns their IDs.
+func (db *DB) ExpireLeases(now time.Time) ([]int64, error) {
+	return db.updateJobs(
+		`state='`+scan.JobRunning+`' AND lease_expires <= ?`, []interface{}{now.UTC()},
+		`state='`+scan.JobQueued+`', node=NULL, lease_expires=NULL, started=NULL`)
+}
+
+// ExpireJobs marks jobs which have been queued since before as expired, and
+// returns their IDs.
+func (db *DB) ExpireJobs(before, now time.Time) ([]int64, error) {
+	return db.updateJobs(
+		`state='`+scan.JobQueued+`' AND chunks = 0 AND submitted <= ?`, []interface{}{before},
+		`state='`+scan.JobExpired+`', finished=?`, now.UTC())
+}
+
+// updateJobs applies set to the jobs matching where, and returns their IDs.
+func (db *DB) updateJobs(where string, whereArgs []interface{}, set string, setArgs ...interface{}) ([]int64, error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := txn.Query(`SELECT rowid FROM job WHERE `+where, whereArgs...)
+	if err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			txn.Rollback()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+
+	_, err = txn.Exec(`UPDATE job SET `+set+` WHERE `+where, append(setArgs, whereArgs...)...)
+	if err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+	if len(ids) > 0 {
+		if _, err := txn.Exec(updateParentsSQL); err != nil {
+			txn.Rollback()
+			return nil, err
+		}
+	}
+
+	return ids, txn.Commit()
+}
+
+// chunkOf selects from the chunks of the job being updated.
+const chunkOf = `FROM job c WHERE c.parent = job.rowid`
+
+// updateParentsSQL brings split jobs which haven't finished up to date with
+// their chunks. A split job is queued until a chunk is claimed, and running
+// until every chunk has finished. It's done if every chunk is done, or else
+// failed, expired or cancelled if any chunk was, in that order.
+const updateParentsSQL = `UPDATE job SET
+	count = (SELECT SUM(c.count) ` + chunkOf + `),
+	chunks_done = (SELECT COUNT(*) ` + chunkOf + ` AND c.state = '` + scan.JobDone + `'),
+	received = (SELECT MAX(c.received) ` + chunkOf + `),
+	started = (SELECT MIN(c.started) ` + chunkOf + `),
+	state = CASE
+		WHEN NOT EXISTS (SELECT 1 ` + chunkOf + ` AND c.state != '` + scan.JobQueued + `') THEN '` + scan.JobQueued + `'
+		WHEN EXISTS (SELECT 1 ` + chunkOf + ` AND c.state IN ('` + scan.JobQueued + `', '` + scan.JobRunning + `')) THEN '` + scan.JobRunning + `'
+		WHEN EXISTS (SELECT 1 ` + chunkOf + ` AND c.state = '` + scan.JobFailed + `') THEN '` + scan.JobFailed + `'
+		WHEN EXISTS (SELECT 1 ` + chunkOf + ` AND c.state = '` + scan.JobExpired + `') THEN '` + scan.JobExpired + `'
+		WHEN EXISTS (SELECT 1 ` + chunkOf + ` AND c.state = '` + scan.JobCancelled + `') THEN '` + scan.JobCancelled + `'
+		ELSE '` + scan.JobDone + `' END,
+	finished = CASE
+		WHEN EXISTS (SELECT 1 ` + chunkOf + ` AND c.state IN ('` + scan.JobQueued + `', '` + scan.JobRunning + `')) THEN NULL
+		ELSE (SELECT MAX(c.finished) ` + chunkOf + `) END
+	WHERE chunks > 0 AND state IN ('` + scan.JobQueued + `', '` + scan.JobRunning + `')`
 
-	return nil
+// updateParents brings split jobs up to date after their chunks change.
+func (db *DB) updateParents() error {
+	_, err := db.Exec(updateParentsSQL)
+	return err
 }
@@ -0,0 +1,69 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// LoadObservations retrieves each time a port was seen, along with the
+// submission it was seen in.
+func (db *DB) LoadObservations(filter SQLFilter) ([]scan.Observation, error) {
+	// Use a subquery so the filter doesn't need to know which table each
+	// column is in
+	qry := fmt.Sprintf(`SELECT submission_id, host, job_id, submission_time, ip, port, proto FROM
+		(SELECT o.submission_id, s.host, s.job_id, s.submission_time, o.ip, o.port, o.proto
+			FROM observation o JOIN submission s ON s.rowid = o.submission_id)
+		%s ORDER BY port, proto, ip, submission_time`, filter)
+	rows, err := db.Query(qry, filter.Values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var obs []scan.Observation
+	for rows.Next() {
+		var o scan.Observation
+		var job sql.NullInt64
+		var t time.Time
+		err := rows.Scan(&o.Submission, &o.Host, &job, &t, &o.IP, &o.Port, &o.Proto)
+		if err != nil {
+			return nil, err
+		}
+		o.Job = job.Int64
+		o.Time = scan.Time{Time: t.UTC()}
+		obs = append(obs, o)
+	}
+
+	return obs, rows.Err()
+}
+
+// SaveObservations records the ports seen in a submission.
+func (db *DB) SaveObservations(submission int64, results []scan.Result) error {
+	return db.inTxn(func(txn *sql.Tx) error {
+		return saveObservations(txn, submission, results)
+	})
+}
+
+func saveObservations(txn *sql.Tx, submission int64, results []scan.Result) error {
+	insert, err := txn.Prepare(`INSERT OR IGNORE INTO observation (submission_id, ip, port, proto) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		for _, port := range r.Ports {
+			// Banners aren't observations of the port state
+			if port.Status == "" {
+				continue
+			}
+			_, err := insert.Exec(submission, r.IP, port.Port, port.Proto)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
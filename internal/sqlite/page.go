@@ -0,0 +1,123 @@
+package sqlite
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// sortColumns maps the fields results can be sorted by to their column.
+var sortColumns = map[string]string{
+	"ip":        "ipbin",
+	"port":      "port",
+	"proto":     "proto",
+	"firstseen": "firstseen",
+	"lastseen":  "lastseen",
+}
+
+// Page describes which page of results to load.
+type Page struct {
+	Sort   string // One of ip, port, proto, firstseen or lastseen
+	Desc   bool
+	Limit  int
+	Cursor string // From the previous page, empty for the first page
+}
+
+// Errors returned by LoadDataPage when the page is invalid.
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort field")
+)
+
+// pageCursor identifies the last result of a page. Only the field for the
+// sort column is set.
+type pageCursor struct {
+	ID    int64     `json:"id"`
+	Sort  string    `json:"sort"`
+	Desc  bool      `json:"desc,omitempty"`
+	IP    string    `json:"ip,omitempty"`
+	Port  int       `json:"port,omitempty"`
+	Proto string    `json:"proto,omitempty"`
+	Time  time.Time `json:"time,omitempty"`
+}
+
+// key returns the value of the sort column for the cursor.
+func (c pageCursor) key() interface{} {
+	switch c.Sort {
+	case "ip":
+		return ipBytes(c.IP)
+	case "port":
+		return c.Port
+	case "proto":
+		return c.Proto
+	}
+	return c.Time
+}
+
+func newPageCursor(r scan.IPInfo, page Page) string {
+	c := pageCursor{ID: r.ID, Sort: page.Sort, Desc: page.Desc}
+	switch page.Sort {
+	case "ip":
+		c.IP = r.IP
+	case "port":
+		c.Port = r.Port
+	case "proto":
+		c.Proto = r.Proto
+	case "firstseen":
+		c.Time = r.FirstSeen.Time
+	case "lastseen":
+		c.Time = r.LastSeen.Time
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// LoadDataPage loads a page of results matching filter. The cursor returned
+// loads the following page, and is empty if this is the last page.
+func (db *DB) LoadDataPage(filter SQLFilter, page Page) ([]scan.IPInfo, string, error) {
+	col, ok := sortColumns[page.Sort]
+	if !ok {
+		return nil, "", fmt.Errorf("%w %q", ErrInvalidSort, page.Sort)
+	}
+	dir, op := "ASC", ">"
+	if page.Desc {
+		dir, op = "DESC", "<"
+	}
+
+	if page.Cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		var c pageCursor
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		// The cursor is only valid for the order it was created with
+		if c.Sort != page.Sort || c.Desc != page.Desc {
+			return nil, "", ErrInvalidCursor
+		}
+		filter.Where = append(filter.Where, fmt.Sprintf(`(%[1]s %[2]s ? OR (%[1]s = ? AND rowid %[2]s ?))`, col, op))
+		filter.Values = append(filter.Values, c.key(), c.key(), c.ID)
+	}
+
+	// Fetch one more than needed to find out if there's another page
+	qry := fmt.Sprintf(`SELECT %s FROM scan %s ORDER BY %s %s, rowid %s LIMIT %d`,
+		dataColumns, filter, col, dir, dir, page.Limit+1)
+	data, err := db.queryData(qry, filter.Values...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(data) > page.Limit {
+		data = data[:page.Limit]
+		next = newPageCursor(data[len(data)-1], page)
+	}
+
+	return data, next, nil
+}
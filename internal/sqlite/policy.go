@@ -0,0 +1,158 @@
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// whereActivePolicy matches policies which haven't expired.
+const whereActivePolicy = `(p.expires IS NULL OR p.expires > datetime('now'))`
+
+// Filters matching results which are covered by an active policy, or not.
+const (
+	WhereExpected = `EXISTS (SELECT 1 FROM policy_range r JOIN policy p ON p.id = r.policy_id
+		WHERE scan.ipbin BETWEEN r.ip_first AND r.ip_last AND scan.port BETWEEN r.port_first AND r.port_last
+		AND r.proto IN ('', scan.proto) AND ` + whereActivePolicy + `)`
+	WhereUnexpected = `NOT ` + WhereExpected
+)
+
+// policyRange is part of what a policy covers. Proto is empty if it applies
+// to any protocol.
+type policyRange struct {
+	IPFirst, IPLast     []byte
+	PortFirst, PortLast int
+	Proto               string
+}
+
+// policyRanges expands a policy scope into the ranges it covers.
+func policyRanges(s scan.Scope) []policyRange {
+	ports := s.Ports
+	if len(ports) == 0 {
+		ports = []scan.PortRange{{First: 0, Last: 65535}}
+	}
+	var ranges []policyRange
+	for _, t := range s.Targets {
+		for _, p := range ports {
+			proto := p.Proto
+			if proto == "" {
+				proto = s.Proto
+			} else if s.Proto != "" && s.Proto != proto {
+				// Can never match, e.g. U:53 in a TCP policy
+				continue
+			}
+			ranges = append(ranges, policyRange{
+				IPFirst: t.First, IPLast: t.Last,
+				PortFirst: p.First, PortLast: p.Last,
+				Proto: proto,
+			})
+		}
+	}
+	return ranges
+}
+
+// LoadPolicies retrieves the policies matching filter, including expired
+// ones.
+func (db *DB) LoadPolicies(filter SQLFilter) ([]scan.Policy, error) {
+	qry := `SELECT id, cidr, ports, proto, owner, expires, created, created_by FROM policy`
+	if len(filter.Where) > 0 {
+		qry += ` ` + filter.String()
+	}
+	qry += ` ORDER BY id`
+
+	rows, err := db.Query(qry, filter.Values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []scan.Policy
+	for rows.Next() {
+		var p scan.Policy
+		var owner sql.NullString
+		var expires sql.NullTime
+		var created time.Time
+		err := rows.Scan(&p.ID, &p.CIDR, &p.Ports, &p.Proto, &owner, &expires, &created, &p.CreatedBy)
+		if err != nil {
+			return nil, err
+		}
+		p.Owner = owner.String
+		if expires.Valid {
+			p.Expires = scan.Time{Time: expires.Time.UTC()}
+		}
+		p.Created = scan.Time{Time: created.UTC()}
+		policies = append(policies, p)
+	}
+
+	return policies, rows.Err()
+}
+
+// SavePolicy stores a new policy and returns its ID.
+func (db *DB) SavePolicy(p scan.Policy) (int64, error) {
+	scope, err := p.Scope()
+	if err != nil {
+		return 0, err
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var expires sql.NullTime
+	if !p.Expires.IsZero() {
+		expires = sql.NullTime{Time: p.Expires.UTC(), Valid: true}
+	}
+	res, err := txn.Exec(`INSERT INTO policy (cidr, ports, proto, owner, expires, created, created_by) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		p.CIDR, p.Ports, p.Proto, toNullString(p.Owner), expires, p.Created.Time, p.CreatedBy)
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+
+	insert, err := txn.Prepare(`INSERT INTO policy_range (policy_id, ip_first, ip_last, port_first, port_last, proto) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+	for _, r := range policyRanges(scope) {
+		_, err := insert.Exec(id, r.IPFirst, r.IPLast, r.PortFirst, r.PortLast, r.Proto)
+		if err != nil {
+			txn.Rollback()
+			return 0, err
+		}
+	}
+
+	return id, txn.Commit()
+}
+
+// DeletePolicy deletes a policy. It returns sql.ErrNoRows if there is no such
+// policy.
+func (db *DB) DeletePolicy(id int64) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := txn.Exec(`DELETE FROM policy WHERE id = ?`, id)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		txn.Rollback()
+		return sql.ErrNoRows
+	}
+	if _, err := txn.Exec(`DELETE FROM policy_range WHERE policy_id = ?`, id); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
@@ -0,0 +1,367 @@
+package sqlite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// QueryError is returned by ParseQuery for invalid queries.
+type QueryError struct {
+	Pos int // Position of the offending term in the query, starting at 1
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s (at character %d)", e.Msg, e.Pos)
+}
+
+// queryToken is a word or parenthesis in a query.
+type queryToken struct {
+	text string
+	pos  int
+}
+
+// tokenizeQuery splits a query into words and parentheses.
+func tokenizeQuery(s string) []queryToken {
+	var tokens []queryToken
+	start := -1
+	for i, r := range s {
+		switch {
+		case unicode.IsSpace(r), r == '(', r == ')':
+			if start >= 0 {
+				tokens = append(tokens, queryToken{s[start:i], start + 1})
+				start = -1
+			}
+			if r == '(' || r == ')' {
+				tokens = append(tokens, queryToken{string(r), i + 1})
+			}
+		case start < 0:
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, queryToken{s[start:], start + 1})
+	}
+	return tokens
+}
+
+// queryFields are the fields which can be compared in a query.
+var queryFields = map[string]bool{
+	"ip":        true,
+	"cidr":      true,
+	"port":      true,
+	"proto":     true,
+	"service":   true,
+	"firstseen": true,
+	"lastseen":  true,
+	"closed":    true,
+	"triage":    true,
+}
+
+// queryStates are keywords matching the state of a result.
+var queryStates = map[string]string{
+	"new":  WhereNew,
+	"gone": WhereGone,
+	"open": WhereOpen,
+
+	"expected":   WhereExpected,
+	"unexpected": WhereUnexpected,
+}
+
+// queryOperators are the comparison operators, longest first.
+var queryOperators = []string{">=", "<=", ":", "=", ">", "<"}
+
+// splitTerm splits a term such as port>1024 into its field, operator and
+// value. ok is false if the term doesn't start with a field name.
+func splitTerm(term string) (field, op, value string, ok bool) {
+	i := strings.IndexFunc(term, func(r rune) bool { return !unicode.IsLetter(r) })
+	if i <= 0 {
+		return "", "", "", false
+	}
+	for _, op := range queryOperators {
+		if strings.HasPrefix(term[i:], op) {
+			return strings.ToLower(term[:i]), op, term[i+len(op):], true
+		}
+	}
+	return "", "", "", false
+}
+
+// isSearchTerm reports whether the term is a plain search term, as accepted
+// by scan.ParseSearch.
+func isSearchTerm(term string) bool {
+	field, _, _, ok := splitTerm(term)
+	if !ok {
+		return true
+	}
+	if queryFields[field] {
+		return false
+	}
+	// Terms like U:53 and fe80::1 look like fields but aren't
+	_, err := scan.ParseSearch(term)
+	return err == nil
+}
+
+// isReserved reports whether the token is a keyword or parenthesis.
+func isReserved(token string) bool {
+	switch strings.ToLower(token) {
+	case "(", ")", "and", "or", "not":
+		return true
+	}
+	_, ok := queryStates[strings.ToLower(token)]
+	return ok
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	end    int // Position after the end of the query, for errors
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// keyword reports whether the next token is the keyword kw, consuming it if
+// so.
+func (p *queryParser) keyword(kw string) bool {
+	t, ok := p.peek()
+	if ok && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) errorf(pos int, format string, args ...interface{}) error {
+	return &QueryError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// parseOr parses terms separated by "or".
+func (p *queryParser) parseOr() (SQLFilter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return f, err
+	}
+	for p.keyword("or") {
+		g, err := p.parseAnd()
+		if err != nil {
+			return g, err
+		}
+		values := f.And(g).Values
+		f = SQLFilter{Where: []string{"(" + clause(f) + " OR " + clause(g) + ")"}, Values: values}
+	}
+	return f, nil
+}
+
+// parseAnd parses terms separated by "and". The "and" is optional.
+func (p *queryParser) parseAnd() (SQLFilter, error) {
+	f, err := p.parseNot()
+	if err != nil {
+		return f, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.text == ")" || strings.EqualFold(t.text, "or") {
+			return f, nil
+		}
+		p.keyword("and")
+		g, err := p.parseNot()
+		if err != nil {
+			return g, err
+		}
+		f = f.And(g)
+	}
+}
+
+// parseNot parses a term optionally preceded by "not".
+func (p *queryParser) parseNot() (SQLFilter, error) {
+	if p.keyword("not") {
+		f, err := p.parseNot()
+		if err != nil {
+			return f, err
+		}
+		return SQLFilter{Where: []string{"NOT " + clause(f)}, Values: f.Values}, nil
+	}
+	return p.parseTerm()
+}
+
+// parseTerm parses a parenthesised query, a state, a field comparison or a
+// run of search terms.
+func (p *queryParser) parseTerm() (SQLFilter, error) {
+	t, ok := p.peek()
+	if !ok {
+		return SQLFilter{}, p.errorf(p.end, "unexpected end of query")
+	}
+	switch strings.ToLower(t.text) {
+	case "(":
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return f, err
+		}
+		if !p.keyword(")") {
+			return f, p.errorf(t.pos, "missing closing parenthesis")
+		}
+		return f, nil
+	case ")", "and", "or":
+		return SQLFilter{}, p.errorf(t.pos, "unexpected %q", t.text)
+	}
+
+	if where, ok := queryStates[strings.ToLower(t.text)]; ok {
+		p.pos++
+		return SQLFilter{Where: []string{where}}, nil
+	}
+
+	if !isSearchTerm(t.text) {
+		p.pos++
+		return p.compare(t)
+	}
+
+	// Consecutive search terms are a single search, so 10.0.0.0/8 22 443
+	// matches port 22 or 443 within 10.0.0.0/8
+	var terms []string
+	for {
+		t, ok := p.peek()
+		if !ok || isReserved(t.text) || !isSearchTerm(t.text) {
+			break
+		}
+		terms = append(terms, t.text)
+		p.pos++
+	}
+	scope, err := scan.ParseSearch(strings.Join(terms, " "))
+	if err != nil {
+		return SQLFilter{}, p.errorf(t.pos, "%v", err)
+	}
+	return ScopeFilter(scope), nil
+}
+
+// compare compiles a field comparison such as port:22 or firstseen>2020-01-01.
+func (p *queryParser) compare(t queryToken) (SQLFilter, error) {
+	field, op, value, ok := splitTerm(t.text)
+	if !ok || !queryFields[field] {
+		return SQLFilter{}, p.errorf(t.pos, "unknown field %q", field)
+	}
+	if value == "" {
+		return SQLFilter{}, p.errorf(t.pos, "missing value for %s", field)
+	}
+	if op == ":" {
+		op = "="
+	}
+	equality := op == "="
+
+	switch field {
+	case "ip", "cidr", "proto":
+		if !equality {
+			return SQLFilter{}, p.errorf(t.pos, "%s can't be compared with %s", field, op)
+		}
+		var s scan.Scope
+		var err error
+		if field == "proto" {
+			s, err = scan.ParseSearch("proto:" + value)
+		} else {
+			s.Targets, err = scan.ParseTargets(value)
+		}
+		if err != nil {
+			return SQLFilter{}, p.errorf(t.pos, "%v", err)
+		}
+		return ScopeFilter(s), nil
+
+	case "port":
+		if equality {
+			ports, err := scan.ParsePorts(value)
+			if err != nil {
+				return SQLFilter{}, p.errorf(t.pos, "%v", err)
+			}
+			return ScopeFilter(scan.Scope{Ports: ports}), nil
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			return SQLFilter{}, p.errorf(t.pos, "invalid port %q", value)
+		}
+		return SQLFilter{Where: []string{"port " + op + " ?"}, Values: []interface{}{port}}, nil
+
+	case "triage":
+		if !equality {
+			return SQLFilter{}, p.errorf(t.pos, "%s can't be compared with %s", field, op)
+		}
+		states := strings.Split(strings.ToLower(value), ",")
+		for _, s := range states {
+			if !scan.ValidTriageState(s) {
+				return SQLFilter{}, p.errorf(t.pos, "invalid triage state %q", s)
+			}
+		}
+		return TriageFilter(states...), nil
+
+	case "service":
+		if !equality {
+			return SQLFilter{}, p.errorf(t.pos, "%s can't be compared with %s", field, op)
+		}
+		return SQLFilter{Where: []string{`lower(service) = ?`}, Values: []interface{}{strings.ToLower(value)}}, nil
+	}
+
+	// The remaining fields are times
+	ts, err := scan.ParseTime(value)
+	if err != nil {
+		return SQLFilter{}, p.errorf(t.pos, "%v", err)
+	}
+	if _, err := time.Parse("2006-01-02", value); err == nil {
+		// A date covers the whole day
+		next := ts.AddDate(0, 0, 1)
+		switch op {
+		case "=":
+			return SQLFilter{
+				Where:  []string{fmt.Sprintf("(%[1]s >= ? AND %[1]s < ?)", field)},
+				Values: []interface{}{ts, next},
+			}, nil
+		case ">":
+			op, ts = ">=", next
+		case "<=":
+			op, ts = "<", next
+		}
+	}
+	return SQLFilter{Where: []string{field + " " + op + " ?"}, Values: []interface{}{ts}}, nil
+}
+
+// clause returns the filter as a single parenthesised clause.
+func clause(f SQLFilter) string {
+	if len(f.Where) == 1 {
+		return f.Where[0]
+	}
+	return "(" + strings.Join(f.Where, " AND ") + ")"
+}
+
+// ParseQuery compiles a query into a filter. A query is made of terms, which
+// may be combined with "and", "or", "not" and parentheses. Terms next to each
+// other must all match. A term is one of:
+//
+//   - A field comparison, e.g. port:22, port>1024, cidr:10.0.0.0/8, proto:udp,
+//     service:ssh, triage:new,acknowledged, firstseen>2020-01-01,
+//     lastseen<=2020-01-01T12:00:00Z or closed>2020-01-01
+//   - new, open or gone, matching the state of the result
+//   - expected or unexpected, matching whether a policy covers the result
+//   - Anything accepted by scan.ParseSearch
+//
+// Comparing a time with a date covers the whole day, so firstseen:2020-01-01
+// matches anything first seen that day.
+func ParseQuery(s string) (SQLFilter, error) {
+	p := queryParser{tokens: tokenizeQuery(s), end: len(s) + 1}
+	if len(p.tokens) == 0 {
+		return SQLFilter{}, nil
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return SQLFilter{}, err
+	}
+	if t, ok := p.peek(); ok {
+		return SQLFilter{}, p.errorf(t.pos, "unexpected %q", t.text)
+	}
+	return f, nil
+}
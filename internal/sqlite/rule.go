@@ -0,0 +1,133 @@
+package sqlite
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// LoadRules retrieves all alert rules.
+func (db *DB) LoadRules() ([]scan.Rule, error) {
+	rows, err := db.Query(`SELECT id, name, cidr, ports, proto, unexpected_only, min_ports, webhooks, email, created, created_by FROM rule ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []scan.Rule
+	for rows.Next() {
+		var r scan.Rule
+		var webhooks string
+		var created time.Time
+		err := rows.Scan(&r.ID, &r.Name, &r.CIDR, &r.Ports, &r.Proto, &r.UnexpectedOnly, &r.MinPorts, &webhooks, &r.Email, &created, &r.CreatedBy)
+		if err != nil {
+			return nil, err
+		}
+		r.Webhooks = []int64{}
+		for _, s := range strings.Split(webhooks, ",") {
+			if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+				r.Webhooks = append(r.Webhooks, id)
+			}
+		}
+		r.Created = scan.Time{Time: created.UTC()}
+		rules = append(rules, r)
+	}
+
+	return rules, rows.Err()
+}
+
+// SaveRule stores a new rule and returns its ID.
+func (db *DB) SaveRule(r scan.Rule) (int64, error) {
+	webhooks := make([]string, len(r.Webhooks))
+	for i, id := range r.Webhooks {
+		webhooks[i] = strconv.FormatInt(id, 10)
+	}
+	res, err := db.Exec(`INSERT INTO rule (name, cidr, ports, proto, unexpected_only, min_ports, webhooks, email, created, created_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Name, r.CIDR, r.Ports, r.Proto, r.UnexpectedOnly, r.MinPorts, strings.Join(webhooks, ","), r.Email, r.Created.Time, r.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// DeleteRule deletes a rule and its silences. It returns sql.ErrNoRows if the
+// rule doesn't exist.
+func (db *DB) DeleteRule(id int64) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := txn.Exec(`DELETE FROM rule WHERE id = ?`, id)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		txn.Rollback()
+		return sql.ErrNoRows
+	}
+	if _, err := txn.Exec(`DELETE FROM silence WHERE rule_id = ?`, id); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// LoadSilences retrieves the silences matching filter, latest ending first.
+func (db *DB) LoadSilences(filter SQLFilter) ([]scan.Silence, error) {
+	qry := `SELECT id, rule_id, starts, ends, comment, created_by FROM silence`
+	if len(filter.Where) > 0 {
+		qry += ` ` + filter.String()
+	}
+	qry += ` ORDER BY ends DESC`
+
+	rows, err := db.Query(qry, filter.Values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var silences []scan.Silence
+	for rows.Next() {
+		var s scan.Silence
+		var starts, ends time.Time
+		var comment sql.NullString
+		if err := rows.Scan(&s.ID, &s.Rule, &starts, &ends, &comment, &s.CreatedBy); err != nil {
+			return nil, err
+		}
+		s.Starts = scan.Time{Time: starts.UTC()}
+		s.Ends = scan.Time{Time: ends.UTC()}
+		s.Comment = comment.String
+		silences = append(silences, s)
+	}
+
+	return silences, rows.Err()
+}
+
+// SaveSilence stores a new silence and returns its ID.
+func (db *DB) SaveSilence(s scan.Silence) (int64, error) {
+	res, err := db.Exec(`INSERT INTO silence (rule_id, starts, ends, comment, created_by) VALUES (?, ?, ?, ?, ?)`,
+		s.Rule, s.Starts.UTC(), s.Ends.UTC(), toNullString(s.Comment), s.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// DeleteSilence deletes a silence. It returns sql.ErrNoRows if the silence
+// doesn't exist.
+func (db *DB) DeleteSilence(id int64) error {
+	res, err := db.Exec(`DELETE FROM silence WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
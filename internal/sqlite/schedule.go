@@ -0,0 +1,88 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// LoadSchedules retrieves the schedules matching filter.
+func (db *DB) LoadSchedules(filter SQLFilter) ([]scan.Schedule, error) {
+	qry := fmt.Sprintf(`SELECT id, cidr, ports, proto, spec, paused, last_run, last_job, next_run, created, created_by FROM schedule %s ORDER BY id`, filter)
+	rows, err := db.Query(qry, filter.Values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []scan.Schedule
+	for rows.Next() {
+		var s scan.Schedule
+		var lastRun sql.NullTime
+		var lastJob sql.NullInt64
+		var nextRun, created time.Time
+		err := rows.Scan(&s.ID, &s.CIDR, &s.Ports, &s.Proto, &s.Spec, &s.Paused, &lastRun, &lastJob, &nextRun, &created, &s.CreatedBy)
+		if err != nil {
+			return nil, err
+		}
+		if lastRun.Valid {
+			s.LastRun = scan.Time{Time: lastRun.Time.UTC()}
+		}
+		s.LastJob = lastJob.Int64
+		s.NextRun = scan.Time{Time: nextRun.UTC()}
+		s.Created = scan.Time{Time: created.UTC()}
+		schedules = append(schedules, s)
+	}
+
+	return schedules, rows.Err()
+}
+
+// SaveSchedule stores a new schedule and returns its ID.
+func (db *DB) SaveSchedule(s scan.Schedule) (int64, error) {
+	res, err := db.Exec(`INSERT INTO schedule (cidr, ports, proto, spec, paused, next_run, created, created_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.CIDR, s.Ports, s.Proto, s.Spec, s.Paused, s.NextRun.UTC(), s.Created.UTC(), s.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// PauseSchedule pauses or resumes a schedule, setting when it runs next. It
+// returns sql.ErrNoRows if the schedule doesn't exist.
+func (db *DB) PauseSchedule(id int64, paused bool, next time.Time) error {
+	res, err := db.Exec(`UPDATE schedule SET paused=?, next_run=? WHERE id=?`, paused, next.UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SaveScheduleRun records that a schedule ran at ran, enqueueing job, and
+// when it runs next. If job is 0 the run was skipped, and only the next run
+// is changed.
+func (db *DB) SaveScheduleRun(id int64, ran time.Time, job int64, next time.Time) error {
+	if job == 0 {
+		_, err := db.Exec(`UPDATE schedule SET next_run=? WHERE id=?`, next.UTC(), id)
+		return err
+	}
+	_, err := db.Exec(`UPDATE schedule SET last_run=?, last_job=?, next_run=? WHERE id=?`, ran.UTC(), job, next.UTC(), id)
+	return err
+}
+
+// DeleteSchedule deletes a schedule. The jobs it enqueued are kept. It
+// returns sql.ErrNoRows if the schedule doesn't exist.
+func (db *DB) DeleteSchedule(id int64) error {
+	res, err := db.Exec(`DELETE FROM schedule WHERE id=?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
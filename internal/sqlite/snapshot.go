@@ -0,0 +1,66 @@
+package sqlite
+
+import (
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// asOfWhere is the condition matching results which were open at t, taking
+// into account any periods they were closed before reopening.
+const asOfWhere = `(firstseen <= ? AND (closed IS NULL OR closed > ?) AND NOT EXISTS
+	(SELECT 1 FROM closure c WHERE c.ip = scan.ip AND c.port = scan.port AND c.proto = scan.proto
+		AND c.closed <= ? AND c.reopened > ?))`
+
+// AsOfFilter returns a filter matching results which were open at t.
+func AsOfFilter(t time.Time) SQLFilter {
+	return SQLFilter{
+		Where:  []string{asOfWhere},
+		Values: []interface{}{t, t, t, t},
+	}
+}
+
+// notAsOfFilter returns a filter matching results which weren't open at t.
+func notAsOfFilter(t time.Time) SQLFilter {
+	f := AsOfFilter(t)
+	f.Where[0] = `NOT ` + f.Where[0]
+	return f
+}
+
+// ClosedFilter returns a filter matching results which closed at or after
+// since and before until, including those which have reopened since.
+func ClosedFilter(since, until time.Time) SQLFilter {
+	return SQLFilter{
+		Where: []string{`((closed >= ? AND closed < ?) OR EXISTS
+			(SELECT 1 FROM closure c WHERE c.ip = scan.ip AND c.port = scan.port AND c.proto = scan.proto
+				AND c.closed >= ? AND c.closed < ?))`},
+		Values: []interface{}{since, until, since, until},
+	}
+}
+
+// DiffData returns the results matching filter which were open at to but not
+// at from, or open at from but not at to.
+func (db *DB) DiffData(filter SQLFilter, from, to time.Time) (scan.Diff, error) {
+	diff := scan.Diff{
+		From:   scan.Time{Time: from},
+		To:     scan.Time{Time: to},
+		Opened: []scan.IPInfo{},
+		Closed: []scan.IPInfo{},
+	}
+
+	opened := filter.And(AsOfFilter(to)).And(notAsOfFilter(from))
+	err := db.EachData(opened, func(r scan.IPInfo) error {
+		diff.Opened = append(diff.Opened, r)
+		return nil
+	})
+	if err != nil {
+		return diff, err
+	}
+
+	closed := filter.And(AsOfFilter(from)).And(notAsOfFilter(to))
+	err = db.EachData(closed, func(r scan.IPInfo) error {
+		diff.Closed = append(diff.Closed, r)
+		return nil
+	})
+	return diff, err
+}
@@ -2,9 +2,11 @@ package sqlite
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -33,6 +35,10 @@ func toNullInt64(i *int64) sql.NullInt64 {
 	return ni
 }
 
+func toNullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
 // Open creates a new SQLite database object.
 func Open(dsn string) (*DB, error) {
 	var err error
@@ -86,71 +92,187 @@ func (f SQLFilter) String() string {
 	return ""
 }
 
+// Filters for the state of results, for use in SQLFilter.Where.
+const (
+	// WhereNew matches results which have only been seen once and are
+	// still open. A port is new until the next scan which covers it.
+	WhereNew  = `(firstseen = lastseen AND closed IS NULL)`
+	WhereGone = `closed IS NOT NULL`
+	WhereOpen = `closed IS NULL`
+)
+
+// ScopeFilter returns a filter matching results within s. Addresses are
+// compared using the ipbin column so CIDRs and ranges match exactly.
+func ScopeFilter(s scan.Scope) SQLFilter {
+	var filter SQLFilter
+	if len(s.Targets) > 0 {
+		var where []string
+		for _, t := range s.Targets {
+			where = append(where, `ipbin BETWEEN ? AND ?`)
+			filter.Values = append(filter.Values, []byte(t.First), []byte(t.Last))
+		}
+		filter.Where = append(filter.Where, "("+strings.Join(where, " OR ")+")")
+	}
+	if len(s.Ports) > 0 {
+		var where []string
+		for _, p := range s.Ports {
+			if p.Proto != "" {
+				where = append(where, `(port BETWEEN ? AND ? AND proto=?)`)
+				filter.Values = append(filter.Values, p.First, p.Last, p.Proto)
+				continue
+			}
+			where = append(where, `port BETWEEN ? AND ?`)
+			filter.Values = append(filter.Values, p.First, p.Last)
+		}
+		filter.Where = append(filter.Where, "("+strings.Join(where, " OR ")+")")
+	}
+	if s.Proto != "" {
+		filter.Where = append(filter.Where, `proto=?`)
+		filter.Values = append(filter.Values, s.Proto)
+	}
+	return filter
+}
+
+// IPFilter returns a filter matching results for ip, whichever form the
+// address was written in when it was submitted.
+func IPFilter(ip net.IP) SQLFilter {
+	return SQLFilter{Where: []string{`ipbin = ?`}, Values: []interface{}{[]byte(ip.To16())}}
+}
+
+// AddrFilter is IPFilter for tables without an ipbin column, such as
+// observation and banner. It matches ip in any form it was written in results
+// as well as in its canonical form.
+func AddrFilter(ip net.IP) SQLFilter {
+	return SQLFilter{
+		Where:  []string{`(ip = ? OR ip IN (SELECT s.ip FROM scan s WHERE s.ipbin = ?))`},
+		Values: []interface{}{ip.String(), []byte(ip.To16())},
+	}
+}
+
+// And returns a filter matching both f and g.
+func (f SQLFilter) And(g SQLFilter) SQLFilter {
+	return SQLFilter{
+		Where:  append(f.Where[:len(f.Where):len(f.Where)], g.Where...),
+		Values: append(f.Values[:len(f.Values):len(f.Values)], g.Values...),
+	}
+}
+
+// dataColumns are the columns of the scan table needed by queryData, followed
+// by what's known about each port from other tables. These are looked up for
+// each row so results can be streamed without loading whole tables first.
+const dataColumns = `rowid, ip, port, proto, firstseen, lastseen, closed, service, product, version,
+	EXISTS (SELECT 1 FROM traceroute WHERE dest = scan.ip),
+	EXISTS (SELECT 1 FROM banner b WHERE b.ip = scan.ip AND b.port = scan.port AND b.proto = scan.proto),
+	` + triageColumns + `, ` + WhereExpected
+
+// ipBytes returns the 16-byte form of ip, as stored in the ipbin column.
+func ipBytes(ip string) []byte {
+	return net.ParseIP(ip).To16()
+}
+
 // LoadData loads all data for displaying in the browser.
 func (db *DB) LoadData(filter SQLFilter) ([]scan.IPInfo, error) {
-	qry := fmt.Sprintf(`SELECT ip, port, proto, firstseen, lastseen FROM scan %s ORDER BY port, proto, ip, lastseen`, filter)
-	rows, err := db.Query(qry, filter.Values...)
+	qry := fmt.Sprintf(`SELECT %s FROM scan %s ORDER BY port, proto, ip, lastseen`, dataColumns, filter)
+	return db.queryData(qry, filter.Values...)
+}
+
+// queryData runs a query selecting dataColumns from the scan table.
+func (db *DB) queryData(qry string, args ...interface{}) ([]scan.IPInfo, error) {
+	var data []scan.IPInfo
+	err := db.eachData(qry, args, func(r scan.IPInfo) error {
+		data = append(data, r)
+		return nil
+	})
 	if err != nil {
 		return []scan.IPInfo{}, err
 	}
+	return data, nil
+}
+
+// EachData calls fn for each result matching filter, in the same order as
+// LoadData, without loading all results into memory. It stops at the first
+// error returned by fn.
+func (db *DB) EachData(filter SQLFilter, fn func(scan.IPInfo) error) error {
+	qry := fmt.Sprintf(`SELECT %s FROM scan %s ORDER BY port, proto, ip, lastseen`, dataColumns, filter)
+	return db.eachData(qry, filter.Values, fn)
+}
+
+// eachData runs a query selecting dataColumns from the scan table and calls
+// fn for each row.
+func (db *DB) eachData(qry string, args []interface{}, fn func(scan.IPInfo) error) error {
+	rows, err := db.Query(qry, args...)
+	if err != nil {
+		return err
+	}
 
 	defer rows.Close()
 
-	var data []scan.IPInfo
+	var id int64
 	var ip, proto string
 	var firstseen, lastseen time.Time
+	var closed, triageUpdated sql.NullTime
+	var service, product, version sql.NullString
+	var triageState, triageAssignee, triageComment, triageUpdatedBy sql.NullString
 	var port int
-	var latest time.Time
-
-	tracerouteIPs, err := db.LoadTracerouteIPs()
-	if err != nil {
-		return []scan.IPInfo{}, err
-	}
-
-	submission, err := db.LoadSubmission(SQLFilter{Where: []string{"job_id IS NULL"}})
-	if err == nil {
-		latest = submission.Time.Time
-	}
+	var hasTraceroute, hasBanners, expected bool
 
 	for rows.Next() {
-		err := rows.Scan(&ip, &port, &proto, &firstseen, &lastseen)
+		err := rows.Scan(&id, &ip, &port, &proto, &firstseen, &lastseen, &closed, &service, &product, &version,
+			&hasTraceroute, &hasBanners,
+			&triageState, &triageAssignee, &triageComment, &triageUpdated, &triageUpdatedBy,
+			&expected)
 		if err != nil {
 			log.Println("loadData: error scanning table:", err)
-			return []scan.IPInfo{}, err
+			return err
 		}
-		if lastseen.After(latest) {
-			latest = lastseen
+		var banners []scan.Banner
+		if hasBanners {
+			banners, err = db.loadCurrentBanners(ip, port, proto)
+			if err != nil {
+				return err
+			}
 		}
-		var hasTraceroute bool
-		if _, ok := tracerouteIPs[ip]; ok {
-			hasTraceroute = true
+		t := scan.Triage{IP: ip, Port: port, Proto: proto, State: scan.TriageNew}
+		if triageState.Valid {
+			t.State, t.Assignee, t.Comment = triageState.String, triageAssignee.String, triageComment.String
+			t.Updated = scan.Time{Time: triageUpdated.Time.UTC()}
+			t.UpdatedBy = triageUpdatedBy.String
 		}
-		data = append(data, scan.IPInfo{
+		// A port is new until the next scan which covers it
+		err = fn(scan.IPInfo{
+			ID:            id,
 			IP:            ip,
 			Port:          port,
 			Proto:         proto,
+			Service:       service.String,
+			Product:       product.String,
+			Version:       version.String,
 			FirstSeen:     scan.Time{Time: firstseen},
 			LastSeen:      scan.Time{Time: lastseen},
-			New:           firstseen.Equal(lastseen) && lastseen == latest,
-			Gone:          lastseen.Before(latest),
-			HasTraceroute: hasTraceroute})
+			Closed:        scan.Time{Time: closed.Time},
+			New:           firstseen.Equal(lastseen) && !closed.Valid,
+			Gone:          closed.Valid,
+			HasTraceroute: hasTraceroute,
+			Banners:       banners,
+			Triage:        t,
+			Expected:      expected})
+		if err != nil {
+			return err
+		}
 	}
 
-	return data, nil
+	return rows.Err()
 }
 
-// ResultData retrieves stored results. Each argument is optional and allows
-// searching by IP address, first seen and last seen.
-func (db *DB) ResultData(ip, fs, ls string) (scan.Data, error) {
+// SeenFilter returns a filter for results first seen at fs and last seen at
+// ls, which are seconds since the Unix epoch. Each argument is optional and
+// invalid values are ignored.
+func SeenFilter(fs, ls string) SQLFilter {
 	var filter SQLFilter
-	if ip != "" {
-		filter.Where = append(filter.Where, `ip LIKE ?`)
-		filter.Values = append(filter.Values, fmt.Sprintf("%%%s%%", ip))
-	}
 	if fs != "" {
 		i, err := strconv.ParseInt(fs, 10, 0)
 		if err != nil {
-			log.Printf("couldn't parse firstseen value %q: %v", ls, err)
+			log.Printf("couldn't parse firstseen value %q: %v", fs, err)
 		} else {
 			t := time.Unix(i, 0).UTC()
 			filter.Where = append(filter.Where, `firstseen=?`)
@@ -167,6 +289,13 @@ func (db *DB) ResultData(ip, fs, ls string) (scan.Data, error) {
 			filter.Values = append(filter.Values, t)
 		}
 	}
+	return filter
+}
+
+// ResultData retrieves stored results matching filter. fs and ls are
+// optional and allow searching by first seen and last seen.
+func (db *DB) ResultData(filter SQLFilter, fs, ls string) (scan.Data, error) {
+	filter = filter.And(SeenFilter(fs, ls))
 
 	results, err := db.LoadData(filter)
 	if err != nil {
@@ -195,6 +324,9 @@ func (db *DB) ResultData(ip, fs, ls string) (scan.Data, error) {
 		if r.New {
 			data.New++
 		}
+		if !r.Gone && !r.Expected {
+			data.Unexpected++
+		}
 	}
 	data.LastSeen = latest.Unix()
 
@@ -203,109 +335,243 @@ func (db *DB) ResultData(ip, fs, ls string) (scan.Data, error) {
 
 // SaveData saves the results posted.
 func (db *DB) SaveData(results []scan.Result, now time.Time) (int64, error) {
-	txn, err := db.Begin()
+	var count int64
+	err := db.inTxn(func(txn *sql.Tx) error {
+		var err error
+		count, err = saveData(txn, results, now)
+		return err
+	})
+	return count, err
+}
+
+func saveData(txn *sql.Tx, results []scan.Result, now time.Time) (int64, error) {
+	insert, err := txn.Prepare(`INSERT INTO scan (ip, port, proto, firstseen, lastseen, opened, service, product, version, ipbin) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return 0, err
 	}
-
-	insert, err := txn.Prepare(`INSERT INTO scan (ip, port, proto, firstseen, lastseen) VALUES (?, ?, ?, ?, ?)`)
+	qry, err := txn.Prepare(`SELECT closed FROM scan WHERE ip=? AND port=? AND proto=?`)
 	if err != nil {
-		txn.Rollback()
 		return 0, err
 	}
-	qry, err := txn.Prepare(`SELECT 1 FROM scan WHERE ip=? AND port=? AND proto=?`)
+	// Keep the period a reopened port was closed for, so snapshots of that
+	// period don't show it as open
+	closure, err := txn.Prepare(`INSERT INTO closure (ip, port, proto, closed, reopened) VALUES (?, ?, ?, ?, ?)`)
 	if err != nil {
-		txn.Rollback()
 		return 0, err
 	}
-	update, err := txn.Prepare(`UPDATE scan SET lastseen=? WHERE ip=? AND port=? AND proto=?`)
+	// Service details are only present when service detection was run, so
+	// don't overwrite any previously detected service with nothing
+	// If the port had closed it has now reopened
+	update, err := txn.Prepare(`UPDATE scan SET lastseen=?, opened=CASE WHEN closed IS NULL THEN opened ELSE ? END, closed=NULL, service=COALESCE(?, service), product=COALESCE(?, product), version=COALESCE(?, version) WHERE ip=? AND port=? AND proto=?`)
 	if err != nil {
-		txn.Rollback()
 		return 0, err
 	}
 
 	var count int64
 
 	for _, r := range results {
-		// Although it's an array, only one port is in each
-		port := r.Ports[0]
-
-		// Skip results which are (usually) banner-only
-		// While it would be nice to store banners, we need to restructure a
-		// bit to accommodate this and it just inserts duplicate data for now
-		if port.Status == "" || port.Service.Name != "" {
-			continue
-		}
+		for _, port := range r.Ports {
+			// Banner-only results have no status
+			if port.Status == "" {
+				if port.Service.Name == "" {
+					continue
+				}
+				if err := saveBanner(txn, r.IP, port, now); err != nil {
+					return 0, err
+				}
+				continue
+			}
+
+			service := toNullString(port.Service.Name)
+			product := toNullString(port.Service.Product)
+			version := toNullString(port.Service.Version)
+
+			// Search for the IP/port/proto combo
+			// If it exists, update `lastseen`, else insert a new record
+
+			var closed sql.NullTime
+			err := qry.QueryRow(r.IP, port.Port, port.Proto).Scan(&closed)
+			switch {
+			case err == sql.ErrNoRows:
+				_, err = insert.Exec(r.IP, port.Port, port.Proto, now, now, now, service, product, version, ipBytes(r.IP))
+				if err != nil {
+					return 0, err
+				}
+				count++
+				continue
+			case err != nil:
+				return 0, err
+			}
 
-		// Search for the IP/port/proto combo
-		// If it exists, update `lastseen`, else insert a new record
+			if closed.Valid {
+				_, err = closure.Exec(r.IP, port.Port, port.Proto, closed.Time, now)
+				if err != nil {
+					return 0, err
+				}
+			}
 
-		// Because we have to scan into something
-		var x int
-		err := qry.QueryRow(r.IP, port.Port, port.Proto).Scan(&x)
-		switch {
-		case err == sql.ErrNoRows:
-			_, err = insert.Exec(r.IP, port.Port, port.Proto, now, now)
+			_, err = update.Exec(now, now, service, product, version, r.IP, port.Port, port.Proto)
 			if err != nil {
-				txn.Rollback()
 				return 0, err
 			}
+
 			count++
-			continue
-		case err != nil:
-			txn.Rollback()
-			return 0, err
 		}
+	}
+
+	return count, nil
+}
 
-		_, err = update.Exec(now, r.IP, port.Port, port.Proto)
+// CloseMissing marks results within scope which weren't seen at now as
+// closed, and returns them.
+func (db *DB) CloseMissing(scope scan.Scope, now time.Time) ([]scan.IPInfo, error) {
+	var closed []scan.IPInfo
+	err := db.inTxn(func(txn *sql.Tx) error {
+		var err error
+		closed, err = closeMissing(txn, scope, now)
+		return err
+	})
+	return closed, err
+}
+
+func closeMissing(txn *sql.Tx, scope scan.Scope, now time.Time) ([]scan.IPInfo, error) {
+	filter := SQLFilter{
+		Where:  []string{"closed IS NULL", "lastseen < ?"},
+		Values: []interface{}{now},
+	}.And(ScopeFilter(scope))
+
+	qry := fmt.Sprintf(`SELECT ip, port, proto, firstseen, lastseen FROM scan %s`, filter)
+	rows, err := txn.Query(qry, filter.Values...)
+	if err != nil {
+		return nil, err
+	}
+
+	var closed []scan.IPInfo
+	for rows.Next() {
+		var r scan.IPInfo
+		var firstseen, lastseen time.Time
+		err := rows.Scan(&r.IP, &r.Port, &r.Proto, &firstseen, &lastseen)
 		if err != nil {
-			txn.Rollback()
-			return 0, err
+			rows.Close()
+			return nil, err
 		}
-
-		count++
+		r.FirstSeen = scan.Time{Time: firstseen}
+		r.LastSeen = scan.Time{Time: lastseen}
+		r.Closed = scan.Time{Time: now}
+		r.Gone = true
+		closed = append(closed, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	txn.Commit()
-	return count, nil
+	_, err = txn.Exec(`UPDATE scan SET closed=? `+filter.String(), append([]interface{}{now}, filter.Values...)...)
+	if err != nil {
+		return nil, err
+	}
+	return closed, nil
 }
 
 // LoadSubmission retrieves the stored submissions.
 func (db *DB) LoadSubmission(filter SQLFilter) (scan.Submission, error) {
+	var id int64
 	var host string
 	var job sql.NullInt64
 	var subTime sql.NullTime
+	var cidr, ports, proto sql.NullString
 
-	qry := fmt.Sprintf(`SELECT host, job_id, submission_time FROM submission %s ORDER BY rowid DESC LIMIT 1`, filter)
-	err := db.QueryRow(qry, filter.Values...).Scan(&host, &job, &subTime)
+	qry := fmt.Sprintf(`SELECT rowid, host, job_id, submission_time, cidr, ports, proto FROM submission %s ORDER BY rowid DESC LIMIT 1`, filter)
+	err := db.QueryRow(qry, filter.Values...).Scan(&id, &host, &job, &subTime, &cidr, &ports, &proto)
 	if err != nil && err != sql.ErrNoRows {
 		log.Println("loadSubmission: error scanning table:", err)
 		return scan.Submission{}, err
 	}
 
-	return scan.Submission{Host: host, Job: job.Int64, Time: scan.Time{Time: subTime.Time.UTC()}}, nil
+	return scan.Submission{
+		ID: id, Host: host, Job: job.Int64, Time: scan.Time{Time: subTime.Time.UTC()},
+		CIDR: cidr.String, Ports: ports.String, Proto: proto.String}, nil
 }
 
-// SaveSubmission stores when and which host just submitted data.
-func (db *DB) SaveSubmission(host string, job *int64, now time.Time) error {
-	txn, err := db.Begin()
-	if err != nil {
+// SaveSubmission stores when and which host just submitted data, and what
+// the scan covered. It returns the ID of the submission.
+func (db *DB) SaveSubmission(sub scan.Submission) (int64, error) {
+	var id int64
+	err := db.inTxn(func(txn *sql.Tx) error {
+		var err error
+		id, err = saveSubmission(txn, sub)
 		return err
+	})
+	return id, err
+}
+
+func saveSubmission(txn *sql.Tx, sub scan.Submission) (int64, error) {
+	var job *int64
+	if sub.Job != 0 {
+		job = &sub.Job
 	}
 
-	qry := `INSERT INTO submission (host, job_id, submission_time) VALUES (?, ?, ?)`
-	_, err = txn.Exec(qry, host, toNullInt64(job), now)
+	qry := `INSERT INTO submission (host, job_id, submission_time, cidr, ports, proto) VALUES (?, ?, ?, ?, ?, ?)`
+	res, err := txn.Exec(qry, sub.Host, toNullInt64(job), sub.Time.Time,
+		toNullString(sub.CIDR), toNullString(sub.Ports), toNullString(sub.Proto))
 	if err != nil {
-		txn.Rollback()
-		return err
+		return 0, err
 	}
+	return res.LastInsertId()
+}
 
-	err = txn.Commit()
+// SaveResults stores the results of a submission, closes the ports within
+// closeScope which it didn't see, unless closeScope is nil, and records the
+// submission and what it observed. Remediated ports which were seen again are
+// reset to scan.TriageNew, and if the submission is for a job, the job is
+// marked done by node. It's all done in one transaction so a failure can't
+// leave the results half saved, and results for a job which node may no
+// longer submit aren't saved at all. It returns the number of ports saved,
+// the ID of the submission and the triage which was reset.
+func (db *DB) SaveResults(sub scan.Submission, results []scan.Result, closeScope *scan.Scope, node string) (count, id int64, reset []scan.Triage, err error) {
+	now := sub.Time.Time
+	err = db.inTxn(func(txn *sql.Tx) error {
+		var err error
+		if count, err = saveData(txn, results, now); err != nil {
+			return err
+		}
+		if closeScope != nil {
+			if _, err := closeMissing(txn, *closeScope, now); err != nil {
+				return fmt.Errorf("error closing missing ports: %w", err)
+			}
+		}
+		if id, err = saveSubmission(txn, sub); err != nil {
+			return fmt.Errorf("error saving submission: %w", err)
+		}
+		if err := saveObservations(txn, id, results); err != nil {
+			return fmt.Errorf("error saving observations: %w", err)
+		}
+		if reset, err = resetRemediated(txn, results, now); err != nil {
+			return fmt.Errorf("error resetting triage: %w", err)
+		}
+		if sub.Job != 0 {
+			return finishJob(txn, sub.Job, node, count, now)
+		}
+		return nil
+	})
+	if errors.Is(err, errJobNotUpdated) {
+		return 0, 0, nil, db.jobConflict(sub.Job)
+	}
+	return count, id, reset, err
+}
+
+// inTxn runs fn in a transaction, which is committed if fn succeeds and
+// rolled back if it fails.
+func (db *DB) inTxn(fn func(*sql.Tx) error) error {
+	txn, err := db.Begin()
 	if err != nil {
 		return err
 	}
-
-	return nil
+	if err := fn(txn); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
 }
 
 // LoadTracerouteIPs retrieves the stored traceroutes.
@@ -0,0 +1,139 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// ErrSubmissionNotFound is returned by DiffSubmissions if either submission
+// doesn't exist.
+var ErrSubmissionNotFound = errors.New("submission not found")
+
+// previousSubmission selects the latest submission before the one in the
+// submission table with the same scope. Successive runs of a recurring job,
+// or of the same chunk of a split job, share a scope, as do all submissions
+// which weren't for a job.
+const previousSubmission = `(SELECT MAX(p.rowid) FROM submission p WHERE p.rowid < submission.rowid
+	AND p.cidr IS submission.cidr AND p.ports IS submission.ports AND p.proto IS submission.proto)`
+
+// countAdded counts the ports seen in one submission but not another.
+const countAdded = `(SELECT COUNT(*) FROM observation o WHERE o.submission_id = %s AND NOT EXISTS
+	(SELECT 1 FROM observation p WHERE p.submission_id = %s AND p.ip = o.ip AND p.port = o.port AND p.proto = o.proto))`
+
+// LoadSubmissions retrieves up to limit submissions matching filter, newest
+// first, with a count of the ports seen in each and how they changed from
+// the previous submission with the same scope.
+func (db *DB) LoadSubmissions(filter SQLFilter, limit int) ([]scan.SubmissionSummary, error) {
+	// Only count the ports of the submissions being returned
+	qry := fmt.Sprintf(`WITH page AS (SELECT rowid AS id, host, job_id, submission_time, cidr, ports, proto, %s AS prev
+			FROM submission %s ORDER BY rowid DESC LIMIT %d)
+		SELECT id, host, job_id, submission_time, cidr, ports, proto, prev,
+			(SELECT COUNT(*) FROM observation WHERE submission_id = page.id), %s, %s
+		FROM page ORDER BY id DESC`,
+		previousSubmission, filter, limit,
+		fmt.Sprintf(countAdded, "page.id", "page.prev"), fmt.Sprintf(countAdded, "page.prev", "page.id"))
+	rows, err := db.Query(qry, filter.Values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []scan.SubmissionSummary
+	for rows.Next() {
+		var s scan.SubmissionSummary
+		var job, prev sql.NullInt64
+		var t time.Time
+		var cidr, ports, proto sql.NullString
+		err := rows.Scan(&s.ID, &s.Host, &job, &t, &cidr, &ports, &proto, &prev, &s.Results, &s.Added, &s.Removed)
+		if err != nil {
+			return nil, err
+		}
+		s.Job = job.Int64
+		s.Time = scan.Time{Time: t.UTC()}
+		s.CIDR, s.Ports, s.Proto = cidr.String, ports.String, proto.String
+		s.Previous = prev.Int64
+		subs = append(subs, s)
+	}
+
+	return subs, rows.Err()
+}
+
+// PreviousSubmission returns the ID of the latest submission before id with
+// the same scope, or 0 if there isn't one.
+func (db *DB) PreviousSubmission(id int64) (int64, error) {
+	var prev sql.NullInt64
+	err := db.QueryRow(`SELECT `+previousSubmission+` FROM submission WHERE rowid = ?`, id).Scan(&prev)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return prev.Int64, err
+}
+
+// DiffSubmissions compares the ports seen in two submissions. If from is 0,
+// everything seen in to is added.
+func (db *DB) DiffSubmissions(from, to int64) (scan.SubmissionDiff, error) {
+	diff := scan.SubmissionDiff{
+		Added:     []scan.Observation{},
+		Removed:   []scan.Observation{},
+		Unchanged: []scan.Observation{},
+	}
+
+	var err error
+	if from != 0 {
+		diff.From, err = db.submissionByID(from)
+		if err != nil {
+			return diff, err
+		}
+	}
+	diff.To, err = db.submissionByID(to)
+	if err != nil {
+		return diff, err
+	}
+
+	before, err := db.LoadObservations(SQLFilter{Where: []string{`submission_id=?`}, Values: []interface{}{from}})
+	if err != nil {
+		return diff, err
+	}
+	after, err := db.LoadObservations(SQLFilter{Where: []string{`submission_id=?`}, Values: []interface{}{to}})
+	if err != nil {
+		return diff, err
+	}
+
+	seen := make(map[string]bool)
+	for _, o := range before {
+		seen[tupleKey(o.IP, o.Port, o.Proto)] = true
+	}
+	for _, o := range after {
+		key := tupleKey(o.IP, o.Port, o.Proto)
+		if seen[key] {
+			diff.Unchanged = append(diff.Unchanged, o)
+			delete(seen, key)
+			continue
+		}
+		diff.Added = append(diff.Added, o)
+	}
+	for _, o := range before {
+		if seen[tupleKey(o.IP, o.Port, o.Proto)] {
+			diff.Removed = append(diff.Removed, o)
+		}
+	}
+
+	return diff, nil
+}
+
+func (db *DB) submissionByID(id int64) (scan.Submission, error) {
+	sub, err := db.LoadSubmission(SQLFilter{Where: []string{`rowid=?`}, Values: []interface{}{id}})
+	if err == nil && sub.ID == 0 {
+		err = fmt.Errorf("%w: %d", ErrSubmissionNotFound, id)
+	}
+	return sub, err
+}
+
+// tupleKey is used to index data by IP, port and protocol.
+func tupleKey(ip string, port int, proto string) string {
+	return fmt.Sprintf("%s/%d/%s", ip, port, proto)
+}
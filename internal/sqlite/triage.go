@@ -0,0 +1,110 @@
+package sqlite
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// fromTriage selects the triage of a row in the scan table.
+const fromTriage = `FROM triage t WHERE t.ip = scan.ip AND t.port = scan.port AND t.proto = scan.proto`
+
+// whereTriage is the triage state of a row in the scan table, for use in
+// filters.
+const whereTriage = `COALESCE((SELECT state ` + fromTriage + `), 'new')`
+
+// triageColumns are the state, assignee, comment, updated and updated_by
+// columns of the triage of a row in the scan table, which are NULL if it
+// hasn't been triaged.
+const triageColumns = `(SELECT state ` + fromTriage + `), (SELECT assignee ` + fromTriage + `),
+	(SELECT comment ` + fromTriage + `), (SELECT updated ` + fromTriage + `), (SELECT updated_by ` + fromTriage + `)`
+
+// TriageFilter returns a filter matching results in any of the triage states.
+func TriageFilter(states ...string) SQLFilter {
+	var filter SQLFilter
+	placeholders := make([]string, len(states))
+	for i, s := range states {
+		placeholders[i] = "?"
+		filter.Values = append(filter.Values, s)
+	}
+	filter.Where = []string{whereTriage + ` IN (` + strings.Join(placeholders, ", ") + `)`}
+	return filter
+}
+
+func (db *DB) queryTriage(qry string, args ...interface{}) ([]scan.Triage, error) {
+	rows, err := db.Query(qry, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var triage []scan.Triage
+	for rows.Next() {
+		var t scan.Triage
+		var assignee, comment sql.NullString
+		var updated time.Time
+		err := rows.Scan(&t.IP, &t.Port, &t.Proto, &t.State, &assignee, &comment, &updated, &t.UpdatedBy)
+		if err != nil {
+			return nil, err
+		}
+		t.Assignee, t.Comment = assignee.String, comment.String
+		t.Updated = scan.Time{Time: updated.UTC()}
+		triage = append(triage, t)
+	}
+
+	return triage, rows.Err()
+}
+
+// LoadTriage retrieves the triage of a port. A port which hasn't been triaged
+// has the state scan.TriageNew.
+func (db *DB) LoadTriage(ip string, port int, proto string) (scan.Triage, error) {
+	triage, err := db.queryTriage(`SELECT ip, port, proto, state, assignee, comment, updated, updated_by FROM triage
+		WHERE ip = ? AND port = ? AND proto = ?`, ip, port, proto)
+	if err != nil || len(triage) == 0 {
+		return scan.Triage{IP: ip, Port: port, Proto: proto, State: scan.TriageNew}, err
+	}
+	return triage[0], nil
+}
+
+// SaveTriage stores the triage of a port, replacing any previous triage.
+func (db *DB) SaveTriage(t scan.Triage) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO triage (ip, port, proto, state, assignee, comment, updated, updated_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.IP, t.Port, t.Proto, t.State, toNullString(t.Assignee), toNullString(t.Comment), t.Updated.Time, t.UpdatedBy)
+	return err
+}
+
+// resetRemediated sets ports in results which were remediated before now back
+// to scan.TriageNew, as they have been seen again. It returns the ports which
+// were reset.
+func resetRemediated(txn *sql.Tx, results []scan.Result, now time.Time) ([]scan.Triage, error) {
+	update, err := txn.Prepare(`UPDATE triage SET state = ?, comment = ?, updated = ?, updated_by = ''
+		WHERE ip = ? AND port = ? AND proto = ? AND state = ? AND updated < ?`)
+	if err != nil {
+		return nil, err
+	}
+
+	const comment = "Seen again after being remediated"
+	var reset []scan.Triage
+	for _, r := range results {
+		for _, port := range r.Ports {
+			if port.Status == "" {
+				continue
+			}
+			res, err := update.Exec(scan.TriageNew, comment, now, r.IP, port.Port, port.Proto, scan.TriageRemediated, now)
+			if err != nil {
+				return nil, err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				reset = append(reset, scan.Triage{
+					IP: r.IP, Port: port.Port, Proto: port.Proto,
+					State: scan.TriageNew, Comment: comment, Updated: scan.Time{Time: now},
+				})
+			}
+		}
+	}
+
+	return reset, nil
+}
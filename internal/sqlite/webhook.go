@@ -0,0 +1,81 @@
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// LoadWebhooks retrieves all webhooks.
+func (db *DB) LoadWebhooks() ([]scan.Webhook, error) {
+	rows, err := db.Query(`SELECT id, url, secret, format, cidr, ports, unexpected_only, created, created_by FROM webhook ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []scan.Webhook
+	for rows.Next() {
+		var h scan.Webhook
+		var secret sql.NullString
+		var created time.Time
+		if err := rows.Scan(&h.ID, &h.URL, &secret, &h.Format, &h.CIDR, &h.Ports, &h.UnexpectedOnly, &created, &h.CreatedBy); err != nil {
+			return nil, err
+		}
+		h.Secret = secret.String
+		h.Created = scan.Time{Time: created.UTC()}
+		hooks = append(hooks, h)
+	}
+
+	return hooks, rows.Err()
+}
+
+// SaveWebhook stores a new webhook and returns its ID.
+func (db *DB) SaveWebhook(h scan.Webhook) (int64, error) {
+	res, err := db.Exec(`INSERT INTO webhook (url, secret, format, cidr, ports, unexpected_only, created, created_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		h.URL, toNullString(h.Secret), h.Format, h.CIDR, h.Ports, h.UnexpectedOnly, h.Created.Time, h.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// DeleteWebhook deletes a webhook. Its delivery log is kept.
+func (db *DB) DeleteWebhook(id int64) error {
+	_, err := db.Exec(`DELETE FROM webhook WHERE id = ?`, id)
+	return err
+}
+
+// SaveDelivery records an attempt to deliver a webhook.
+func (db *DB) SaveDelivery(d scan.Delivery) error {
+	_, err := db.Exec(`INSERT INTO webhook_delivery (webhook_id, submission_id, time, attempt, status, error) VALUES (?, ?, ?, ?, ?, ?)`,
+		d.Webhook, d.Submission, d.Time.Time, d.Attempt, d.Status, toNullString(d.Error))
+	return err
+}
+
+// LoadDeliveries retrieves the most recent webhook deliveries, newest first.
+func (db *DB) LoadDeliveries(limit int) ([]scan.Delivery, error) {
+	rows, err := db.Query(`SELECT d.webhook_id, COALESCE(w.url, ''), d.submission_id, d.time, d.attempt, d.status, d.error
+		FROM webhook_delivery d LEFT JOIN webhook w ON w.id = d.webhook_id
+		ORDER BY d.rowid DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []scan.Delivery
+	for rows.Next() {
+		var d scan.Delivery
+		var t time.Time
+		var msg sql.NullString
+		if err := rows.Scan(&d.Webhook, &d.URL, &d.Submission, &t, &d.Attempt, &d.Status, &msg); err != nil {
+			return nil, err
+		}
+		d.Time = scan.Time{Time: t.UTC()}
+		d.Error = msg.String
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
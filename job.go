@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -18,6 +22,31 @@ type jobData struct {
 	indexData
 	JobID []string
 	Jobs  []scan.Job
+	// Parent is the split job whose chunks are listed
+	Parent int64
+}
+
+// jobChunks splits a job as asked by the split_prefix and split_ports form
+// fields, either of which may be empty.
+func jobChunks(cidr, ports, prefix, portsPerChunk string) ([]scan.JobChunk, error) {
+	var p, n int
+	var errs scan.FieldErrors
+	if v := strings.TrimPrefix(strings.TrimSpace(prefix), "/"); v != "" {
+		var err error
+		if p, err = strconv.Atoi(v); err != nil {
+			errs = append(errs, scan.FieldError{Field: "split_prefix", Message: fmt.Sprintf("invalid block size %q", prefix)})
+		}
+	}
+	if v := strings.TrimSpace(portsPerChunk); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil {
+			errs = append(errs, scan.FieldError{Field: "split_ports", Message: fmt.Sprintf("invalid number of ports per chunk %q", portsPerChunk)})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return scan.SplitJob(cidr, ports, p, n)
 }
 
 // Handler for GET and POST /job
@@ -43,8 +72,10 @@ func (app *App) newJob(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	app.expireJobs()
+
 	var jobID []string
-	var errors []string
+	var errs []string
 
 	if r.Method == "POST" {
 		err := r.ParseForm()
@@ -54,35 +85,52 @@ func (app *App) newJob(w http.ResponseWriter, r *http.Request) {
 		}
 
 		f := r.Form
-		cidr := f.Get("cidr")
-		ports := f.Get("ports")
+		if v := f.Get("cancel"); v != "" {
+			app.cancelJob(w, r, user, v)
+			return
+		}
+
+		cidr := strings.TrimSpace(f.Get("cidr"))
+		ports := strings.TrimSpace(f.Get("ports"))
 		proto := f["proto"]
 
-		if cidr == "" {
-			errors = append(errors, "CIDR")
-		}
-		if ports == "" {
-			errors = append(errors, "Ports")
+		var chunks []scan.JobChunk
+		err = scan.ValidateJob(cidr, ports, proto)
+		if err == nil {
+			chunks, err = jobChunks(cidr, ports, f.Get("split_prefix"), f.Get("split_ports"))
 		}
-		if len(proto) == 0 {
-			errors = append(errors, "Protocol")
+		if err != nil {
+			errs = errorMessages(err)
 		}
 
 		// If we have form parameters, save the data as a new job.
 		// Multiple protocols can be submitted. These are saved as separate jobs.
-		if len(errors) == 0 {
+		if len(errs) == 0 {
 			for i := range proto {
-				id, err := app.db.SaveJob(cidr, ports, proto[i], user.Email)
+				id, err := app.db.SaveJob(cidr, ports, proto[i], user.Email, chunks...)
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
 				jobID = append(jobID, strconv.FormatInt(id, 10))
 			}
+			app.updateJobMetrics()
 		}
 	}
 
-	jobs, err := app.db.LoadJobs(sqlite.SQLFilter{})
+	// Chunks of split jobs are only listed when asked for, as there may be
+	// thousands of them
+	var parent int64
+	filter := sqlite.SQLFilter{Where: []string{sqlite.WhereJobNotChunk}}
+	if v := r.URL.Query().Get("parent"); v != "" {
+		var err error
+		if parent, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid job %q", v), http.StatusBadRequest)
+			return
+		}
+		filter = sqlite.SQLFilter{Where: []string{"parent = ?"}, Values: []interface{}{parent}}
+	}
+	jobs, err := app.db.LoadJobs(filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -98,28 +146,118 @@ func (app *App) newJob(w http.ResponseWriter, r *http.Request) {
 	// Fetch result numbers for display in the navbar
 	// Errors aren't fatal here, we can just display 0 results if something
 	// goes wrong
-	results, _ := app.db.ResultData("", "", "")
+	results, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
 
 	data := jobData{
 		indexData: indexData{
-			Errors:        errors,
+			Errors:        errs,
 			Authenticated: true,
 			User:          user,
 			URI:           r.URL.Path,
 			Submission:    sub,
 			Data:          results,
 		},
-		JobID: jobID,
-		Jobs:  jobs,
+		JobID:  jobID,
+		Jobs:   jobs,
+		Parent: parent,
 	}
 
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
 	tmpl.ExecuteTemplate(w, "job", data)
 }
 
+// errorMessages lists the problems in a validation error for display in the
+// Errors panel.
+func errorMessages(err error) []string {
+	var fields scan.FieldErrors
+	if !errors.As(err, &fields) {
+		return []string{err.Error()}
+	}
+	msgs := make([]string, len(fields))
+	for i, f := range fields {
+		msgs[i] = f.Message
+	}
+	return msgs
+}
+
+// jobClaim is the response to a node claiming a job.
+type jobClaim struct {
+	scan.Job
+	Node         string    `json:"node"`
+	LeaseExpires scan.Time `json:"lease_expires"`
+}
+
+// apiJob is a job as returned by the API, including its history.
+type apiJob struct {
+	scan.Job
+	RequestedBy  string    `json:"requested_by"`
+	Submitted    scan.Time `json:"submitted"`
+	Started      scan.Time `json:"started"`
+	Finished     scan.Time `json:"finished"`
+	Node         string    `json:"node,omitempty"`
+	LeaseExpires scan.Time `json:"lease_expires"`
+	Count        int64     `json:"count"`
+	Error        string    `json:"error,omitempty"`
+	Chunks       int       `json:"chunks,omitempty"`
+	ChunksDone   int       `json:"chunks_done,omitempty"`
+}
+
+// jobNode identifies the node making a request, by the node query parameter
+// or else its IP address.
+func jobNode(r *http.Request) string {
+	if node := r.URL.Query().Get("node"); node != "" {
+		return node
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// expireJobs returns jobs whose lease has expired to the queue, and expires
+// jobs which have been queued for longer than jobExpiry.
+func (app *App) expireJobs() {
+	now := time.Now()
+	requeued, err := app.db.ExpireLeases(now)
+	if err != nil {
+		log.Println("expireJobs: couldn't expire leases:", err)
+	}
+	for _, id := range requeued {
+		app.audit("", "requeue_job", strconv.FormatInt(id, 10))
+	}
+
+	var expired []int64
+	if jobExpiry > 0 {
+		expired, err = app.db.ExpireJobs(now.Add(-jobExpiry), now)
+		if err != nil {
+			log.Println("expireJobs: couldn't expire jobs:", err)
+		}
+	}
+	for _, id := range expired {
+		app.audit("", "expire_job", strconv.FormatInt(id, 10))
+	}
+	if len(requeued)+len(expired) > 0 {
+		app.updateJobMetrics()
+	}
+}
+
+// runJobExpiry expires jobs every minute, so they expire even if no node is
+// asking for jobs.
+func (app *App) runJobExpiry() {
+	for range time.Tick(time.Minute) {
+		app.expireJobs()
+	}
+}
+
 // Handler for GET /jobs
+// Lists the jobs which no node has claimed.
 func (app *App) jobs(w http.ResponseWriter, r *http.Request) {
+	app.expireJobs()
 	jobs, err := app.db.LoadJobs(sqlite.SQLFilter{
-		Where: []string{"received IS NULL"},
+		Where: []string{sqlite.WhereJobQueued},
 	})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -129,6 +267,107 @@ func (app *App) jobs(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, jobs)
 }
 
+// Handler for POST /jobs/{id}/claim
+// Leases the job to the node for jobLease. Claiming a job again renews the
+// lease.
+func (app *App) claimJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, sqlite.ErrJobNotFound)
+		return
+	}
+
+	node := jobNode(r)
+	now := time.Now().UTC()
+	err = app.db.ClaimJob(id, node, now, now.Add(jobLease).Truncate(time.Second))
+	switch {
+	case errors.Is(err, sqlite.ErrJobNotFound):
+		renderError(w, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, sqlite.ErrJobFinished), errors.Is(err, sqlite.ErrJobClaimed), errors.Is(err, sqlite.ErrJobSplit):
+		renderError(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	jobs, err := app.db.LoadJobs(sqlite.SQLFilter{
+		Where:  []string{"rowid=?"},
+		Values: []interface{}{id},
+	})
+	if err != nil || len(jobs) == 0 {
+		renderError(w, r, http.StatusInternalServerError, fmt.Errorf("couldn't load claimed job: %v", err))
+		return
+	}
+	app.updateJobMetrics()
+	render.JSON(w, r, jobClaim{Job: jobs[0], Node: node, LeaseExpires: jobs[0].LeaseExpires})
+}
+
+// Handler for POST /jobs/{id}/fail
+// Records that the node couldn't run the job, with the error in the body:
+// {"error": "..."}
+func (app *App) failJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, sqlite.ErrJobNotFound)
+		return
+	}
+
+	var req struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	req.Error = strings.TrimSpace(req.Error)
+	if req.Error == "" {
+		renderError(w, r, http.StatusBadRequest, errors.New("error is required"))
+		return
+	}
+
+	err = app.db.FailJob(id, jobNode(r), req.Error, time.Now())
+	switch {
+	case errors.Is(err, sqlite.ErrJobNotFound):
+		renderError(w, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, sqlite.ErrJobFinished), errors.Is(err, sqlite.ErrJobClaimed), errors.Is(err, sqlite.ErrJobSplit):
+		renderError(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	app.updateJobMetrics()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancelJob cancels a job on behalf of user from the /job page, and records
+// it in the audit log.
+func (app *App) cancelJob(w http.ResponseWriter, r *http.Request, user User, v string) {
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid job %q", v), http.StatusBadRequest)
+		return
+	}
+	err = app.db.CancelJob(id, time.Now())
+	switch {
+	case errors.Is(err, sqlite.ErrJobNotFound):
+		http.Error(w, "Job does not exist", http.StatusNotFound)
+		return
+	case errors.Is(err, sqlite.ErrJobFinished):
+		http.Error(w, "Job has already finished", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.audit(user.Email, "cancel_job", v)
+	app.updateJobMetrics()
+	http.Redirect(w, r, "/job", http.StatusSeeOther)
+}
+
 // Handler for PUT /results/{id}
 func (app *App) recvJobResults(w http.ResponseWriter, r *http.Request) {
 	job := chi.URLParam(r, "id")
@@ -146,45 +385,158 @@ func (app *App) recvJobResults(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Job does not exist", http.StatusBadRequest)
 		return
 	}
-	if !jobs[0].Received.IsZero() {
+	if jobs[0].Chunks > 0 {
+		http.Error(w, "Job is split into chunks; submit the results of each chunk", http.StatusBadRequest)
+		return
+	}
+	switch jobs[0].State {
+	case scan.JobQueued, scan.JobRunning:
+	case scan.JobDone:
 		http.Error(w, "Job already submitted", http.StatusBadRequest)
 		return
+	default:
+		http.Error(w, fmt.Sprintf("Job is %s", jobs[0].State), http.StatusBadRequest)
+		return
 	}
 
 	now := time.Now().UTC()
+	if j := jobs[0]; j.State == scan.JobRunning && j.Node != jobNode(r) && j.LeaseExpires.After(now) {
+		http.Error(w, "Job is claimed by another node", http.StatusConflict)
+		return
+	}
+	id, _ := strconv.ParseInt(job, 10, 64)
 
-	// Insert the results as normal
-	count, err := app.saveResults(w, r, now)
-	if err != nil {
+	// Insert the results as normal, which also marks the job as done. The
+	// checks above are repeated when saving, in case the job changed since.
+	count, err := app.saveResults(w, r, &jobs[0], now)
+	switch {
+	case errors.Is(err, sqlite.ErrJobClaimed):
+		http.Error(w, "Job is claimed by another node", http.StatusConflict)
+		return
+	case errors.Is(err, sqlite.ErrJobFinished):
+		http.Error(w, "Job has already finished", http.StatusConflict)
+		return
+	case err != nil:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Update the job
-	err = app.db.UpdateJob(job, count)
+	// Finally, update metrics
+	gaugeJobSubmission.Set(float64(now.Unix()))
+	gaugeJobs.With(prometheus.Labels{
+		"id":        strconv.FormatInt(id, 10),
+		"submitted": strconv.FormatInt(time.Now().Unix(), 10),
+		"received":  strconv.FormatInt(time.Now().Unix(), 10),
+	}).Set(float64(count))
+	app.updateJobMetrics()
+}
+
+// Handler for GET /api/v1/jobs
+// The state parameter is a comma-separated list of states to filter by.
+func (app *App) apiJobs(w http.ResponseWriter, r *http.Request) {
+	app.expireJobs()
+
+	var filter sqlite.SQLFilter
+	if v := r.URL.Query().Get("state"); v != "" {
+		states := strings.Split(v, ",")
+		values := make([]interface{}, len(states))
+		for i, state := range states {
+			if !validJobState(state) {
+				renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid job state %q", state))
+				return
+			}
+			values[i] = state
+		}
+		filter = sqlite.SQLFilter{
+			Where:  []string{"state IN (?" + strings.Repeat(",?", len(states)-1) + ")"},
+			Values: values,
+		}
+	}
+
+	jobs, err := app.db.LoadJobs(filter)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	resp := make([]apiJob, len(jobs))
+	for i, j := range jobs {
+		resp[i] = apiJob{
+			Job:          j,
+			RequestedBy:  j.RequestedBy,
+			Submitted:    j.Submitted,
+			Started:      j.Started,
+			Finished:     j.Finished,
+			Node:         j.Node,
+			LeaseExpires: j.LeaseExpires,
+			Count:        j.Count,
+			Error:        j.Error,
+			Chunks:       j.Chunks,
+			ChunksDone:   j.ChunksDone,
+		}
+	}
+	render.JSON(w, r, resp)
+}
+
+// Handler for POST /api/v1/jobs
+// Queues a job to scan the cidr, ports and proto given in the body.
+func (app *App) apiNewJob(w http.ResponseWriter, r *http.Request) {
+	user, _, err := sessionUser(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	var req struct {
+		CIDR  string `json:"cidr"`
+		Ports string `json:"ports"`
+		Proto string `json:"proto"`
+		// How to split the job into chunks, if at all
+		SplitPrefix int `json:"split_prefix"`
+		SplitPorts  int `json:"split_ports"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var protos []string
+	if req.Proto != "" {
+		protos = []string{req.Proto}
+	}
+	if err := scan.ValidateJob(req.CIDR, req.Ports, protos); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	chunks, err := scan.SplitJob(req.CIDR, req.Ports, req.SplitPrefix, req.SplitPorts)
 	if err != nil {
-		ip = r.RemoteAddr
+		renderError(w, r, http.StatusBadRequest, err)
+		return
 	}
-	id, _ := strconv.ParseInt(job, 10, 64)
 
-	err = app.db.SaveSubmission(ip, &id, now)
+	id, err := app.db.SaveJob(strings.TrimSpace(req.CIDR), strings.TrimSpace(req.Ports), req.Proto, user.Email, chunks...)
 	if err != nil {
-		log.Println("recvJobResults: error saving submission:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	app.updateJobMetrics()
+	jobs, err := app.db.LoadJobs(sqlite.SQLFilter{
+		Where:  []string{"rowid = ?"},
+		Values: []interface{}{id},
+	})
+	if err != nil || len(jobs) == 0 {
+		renderError(w, r, http.StatusInternalServerError, fmt.Errorf("couldn't load job %d: %v", id, err))
+		return
+	}
+	j := jobs[0]
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, apiJob{Job: j, RequestedBy: j.RequestedBy, Submitted: j.Submitted, Chunks: j.Chunks})
+}
 
-	// Finally, update metrics
-	gaugeJobSubmission.Set(float64(now.Unix()))
-	gaugeJobs.With(prometheus.Labels{
-		"id":        strconv.FormatInt(id, 10),
-		"submitted": strconv.FormatInt(time.Now().Unix(), 10),
-		"received":  strconv.FormatInt(time.Now().Unix(), 10),
-	}).Set(float64(count))
+// validJobState reports whether state is a known job state.
+func validJobState(state string) bool {
+	for _, s := range scan.JobStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
 }
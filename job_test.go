@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestLoadJobsWithNoResults(t *testing.T) {
@@ -44,10 +48,36 @@ func TestUpdateJob(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = db.UpdateJob(strconv.FormatInt(id, 10), 999)
+	now := time.Now()
+	if err := db.ClaimJob(id, "scanner1", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Results from another node are refused, and not saved
+	sub := scan.Submission{Host: "192.0.2.2", Job: id, Time: scan.Time{Time: now}, CIDR: "192.0.2.0/24", Ports: "80,443", Proto: "tcp"}
+	results := []scan.Result{{IP: "192.0.2.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}}}
+	if _, _, _, err := db.SaveResults(sub, results, nil, "scanner2"); !errors.Is(err, sqlite.ErrJobClaimed) {
+		t.Errorf("expected ErrJobClaimed, got %v", err)
+	}
+	if data, err := db.LoadData(sqlite.SQLFilter{}); err != nil || len(data) != 0 {
+		t.Errorf("expected no results to be saved, got %d (%v)", len(data), err)
+	}
+
+	count, _, _, err := db.SaveResults(sub, results, nil, "scanner1")
 	if err != nil {
 		t.Errorf("error updating job: %v", err)
 	}
+	jobs, err := db.LoadJobs(sqlite.SQLFilter{Where: []string{"rowid=?"}, Values: []interface{}{id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := jobs[0]; j.State != scan.JobDone || j.Count != count || j.Node != "scanner1" {
+		t.Errorf("expected job done by scanner1 with %d ports, got %+v", count, j)
+	}
+
+	if _, _, _, err := db.SaveResults(sub, results, nil, "scanner1"); !errors.Is(err, sqlite.ErrJobFinished) {
+		t.Errorf("expected ErrJobFinished, got %v", err)
+	}
 }
 
 func TestJobHandler(t *testing.T) {
@@ -71,6 +101,7 @@ func TestJobHandler(t *testing.T) {
 	v.Set("proto", "tcp")
 
 	r = httptest.NewRequest("POST", "/job", strings.NewReader(v.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	w = httptest.NewRecorder()
 	app.newJob(w, r)
 
@@ -138,3 +169,491 @@ func TestJobResultsHandler(t *testing.T) {
 		t.Errorf("expected status 400, got %v", resp.StatusCode)
 	}
 }
+
+// TestJobResultsGone tests that job results only close ports within the scope
+// of the job.
+func TestJobResultsGone(t *testing.T) {
+	db := createDB("TestJobResultsGone")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	results := []scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+		{IP: "198.51.100.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+	}
+	if _, err := db.SaveData(results, time.Now().UTC().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	app.db.SaveJob("192.0.2.0/24", "80", "tcp", "testuser@example.com")
+
+	r := httptest.NewRequest("PUT", "/results/1", strings.NewReader(`[]`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v: %s", w.Code, w.Body)
+	}
+
+	data, err := db.LoadData(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range data {
+		want := d.IP == "192.0.2.1"
+		if d.Gone != want {
+			t.Errorf("%s: expected gone %v, got %v", d.IP, want, d.Gone)
+		}
+	}
+}
+
+func TestJobClaim(t *testing.T) {
+	db := createDB("TestJobClaim")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	jobLease = time.Hour
+	defer func() { jobLease = 0 }()
+
+	for _, cidr := range []string{"192.0.2.0/24", "198.51.100.0/24"} {
+		if _, err := db.SaveJob(cidr, "80", "tcp", "testuser@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	queued := func() []scan.Job {
+		t.Helper()
+		var jobs []scan.Job
+		w := do("GET", "/jobs", "")
+		if err := json.NewDecoder(w.Body).Decode(&jobs); err != nil {
+			t.Fatal(err)
+		}
+		return jobs
+	}
+
+	w := do("POST", "/jobs/1/claim?node=scanner1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var claim jobClaim
+	if err := json.NewDecoder(w.Body).Decode(&claim); err != nil {
+		t.Fatal(err)
+	}
+	if claim.ID != 1 || claim.Node != "scanner1" || claim.LeaseExpires.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("unexpected claim %+v", claim)
+	}
+	if jobs := queued(); len(jobs) != 1 || jobs[0].ID != 2 {
+		t.Errorf("expected only job 2 to be queued, got %+v", jobs)
+	}
+
+	if w := do("POST", "/jobs/1/claim?node=scanner2", ""); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 claiming another node's job, got %d", w.Code)
+	}
+	if w := do("POST", "/jobs/1/claim?node=scanner1", ""); w.Code != http.StatusOK {
+		t.Errorf("expected status 200 renewing a lease, got %d", w.Code)
+	}
+	if w := do("POST", "/jobs/9/claim?node=scanner1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 claiming a job which doesn't exist, got %d", w.Code)
+	}
+	if w := do("PUT", "/results/1?node=scanner2", "[]"); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 submitting another node's job, got %d", w.Code)
+	}
+	if w := do("PUT", "/results/1?node=scanner1", "[]"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200 submitting a claimed job, got %d: %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/jobs/1/claim?node=scanner1", ""); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 claiming a submitted job, got %d", w.Code)
+	}
+
+	t.Run("Expiry", func(t *testing.T) {
+		past := time.Now().Add(-2 * time.Hour)
+		if err := db.ClaimJob(2, "scanner2", past, past.Add(jobLease)); err != nil {
+			t.Fatal(err)
+		}
+		// Claiming a job whose lease has expired takes it over
+		if w := do("POST", "/jobs/2/claim?node=scanner3", ""); w.Code != http.StatusOK {
+			t.Errorf("expected status 200 claiming an expired job, got %d", w.Code)
+		}
+
+		if err := db.ClaimJob(2, "scanner3", past, past.Add(jobLease)); err != nil {
+			t.Fatal(err)
+		}
+		if jobs := queued(); len(jobs) != 1 || jobs[0].ID != 2 {
+			t.Errorf("expected job 2 to be requeued, got %+v", jobs)
+		}
+		jobs, err := db.LoadJobs(sqlite.SQLFilter{Where: []string{"rowid=2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jobs[0].Node != "" || !jobs[0].LeaseExpires.IsZero() {
+			t.Errorf("expected the expired lease to be cleared, got %+v", jobs[0])
+		}
+	})
+}
+
+func TestJobStates(t *testing.T) {
+	db := createDB("TestJobStates")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	jobLease = time.Hour
+	jobExpiry = 24 * time.Hour
+	defer func() { jobLease, jobExpiry = 0, 0 }()
+
+	for i := 0; i < 4; i++ {
+		if _, err := db.SaveJob("192.0.2.0/24", "80", "tcp", "testuser@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`UPDATE job SET submitted=? WHERE rowid=4`, time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("POST", "/jobs/1/claim?node=scanner1", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/jobs/1/fail?node=scanner2", `{"error":"masscan crashed"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 failing another node's job, got %d", w.Code)
+	}
+	if w := do("POST", "/jobs/1/fail?node=scanner1", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 failing a job without an error, got %d", w.Code)
+	}
+	if w := do("POST", "/jobs/1/fail?node=scanner1", `{"error":"masscan crashed"}`); w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d: %s", w.Code, w.Body)
+	}
+
+	form := url.Values{"cancel": {"2"}}
+	r := httptest.NewRequest("POST", "/job", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("expected status 303 cancelling a job, got %d: %s", w.Code, w.Body)
+	}
+	if w := do("PUT", "/results/2", "[]"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 submitting a cancelled job, got %d", w.Code)
+	}
+	if w := do("POST", "/jobs/2/claim", ""); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 claiming a cancelled job, got %d", w.Code)
+	}
+
+	if w := do("PUT", "/results/3", "[]"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	w = do("GET", "/api/v1/jobs", "")
+	var jobs []apiJob
+	if err := json.NewDecoder(w.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]string{1: scan.JobFailed, 2: scan.JobCancelled, 3: scan.JobDone, 4: scan.JobExpired}
+	for _, j := range jobs {
+		if j.State != want[j.ID] {
+			t.Errorf("job %d: expected state %s, got %s", j.ID, want[j.ID], j.State)
+		}
+		if j.State != scan.JobQueued && j.Finished.IsZero() {
+			t.Errorf("job %d: expected a finished time", j.ID)
+		}
+	}
+	if len(jobs) != 4 {
+		t.Fatalf("expected 4 jobs, got %d", len(jobs))
+	}
+	for _, j := range jobs {
+		if j.ID == 1 && (j.Error != "masscan crashed" || j.Node != "scanner1" || j.Started.IsZero()) {
+			t.Errorf("unexpected failed job %+v", j)
+		}
+	}
+
+	w = do("GET", "/api/v1/jobs?state=done,expired", "")
+	jobs = nil
+	json.NewDecoder(w.Body).Decode(&jobs)
+	if len(jobs) != 2 {
+		t.Errorf("expected 2 done or expired jobs, got %d", len(jobs))
+	}
+	if w := do("GET", "/api/v1/jobs?state=waiting", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid state, got %d", w.Code)
+	}
+
+	if got := testutil.ToFloat64(gaugeJobStates.WithLabelValues(scan.JobFailed)); got != 1 {
+		t.Errorf("expected 1 failed job in the metrics, got %v", got)
+	}
+}
+
+func TestJobValidation(t *testing.T) {
+	db := createDB("TestJobValidation")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		fields []string
+	}{
+		{"Missing", url.Values{}, []string{"cidr", "ports", "proto"}},
+		{"BadCIDR", url.Values{"cidr": {"192.0.2.0/33"}, "ports": {"80"}, "proto": {"TCP"}}, []string{"cidr"}},
+		{"TooBig", url.Values{"cidr": {"0.0.0.0/0"}, "ports": {"80"}, "proto": {"TCP"}}, []string{"cidr"}},
+		{"TooBigV6", url.Values{"cidr": {"2001:db8::/64"}, "ports": {"80"}, "proto": {"TCP"}}, []string{"cidr"}},
+		{"BadPorts", url.Values{"cidr": {"192.0.2.0/24"}, "ports": {"1-70000"}, "proto": {"TCP"}}, []string{"ports"}},
+		{"BadProto", url.Values{"cidr": {"192.0.2.0/24"}, "ports": {"80"}, "proto": {"TCP", "GRE"}}, []string{"proto"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := scan.ValidateJob(tt.form.Get("cidr"), tt.form.Get("ports"), tt.form["proto"])
+			fields, ok := err.(scan.FieldErrors)
+			if !ok || len(fields) != len(tt.fields) {
+				t.Fatalf("expected errors for %v, got %v", tt.fields, err)
+			}
+			for i, f := range fields {
+				if f.Field != tt.fields[i] {
+					t.Errorf("expected an error for %s, got %+v", tt.fields[i], f)
+				}
+			}
+
+			r := httptest.NewRequest("POST", "/job", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid job") {
+				t.Errorf("expected status 400 with the errors, got %d", w.Code)
+			}
+		})
+	}
+
+	valid := url.Values{"cidr": {"192.0.2.0/24, 198.51.100.1-198.51.100.9"}, "ports": {"1-1024,8080,U:53"}, "proto": {"TCP", "UDP"}}
+	if err := scan.ValidateJob(valid.Get("cidr"), valid.Get("ports"), valid["proto"]); err != nil {
+		t.Errorf("expected a valid job, got %v", err)
+	}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/jobs", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	w := post(`{"cidr":"192.0.2.0/24","ports":"22,443","proto":"tcp"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body)
+	}
+	var job apiJob
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != 1 || job.State != scan.JobQueued {
+		t.Errorf("unexpected job %+v", job)
+	}
+
+	w = post(`{"cidr":"10.0.0.0/7","ports":"http"}`)
+	var resp apiError
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || len(resp.Fields) != 3 {
+		t.Errorf("expected status 400 with 3 field errors, got %d: %+v", w.Code, resp)
+	}
+	jobs, err := db.LoadJobs(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("expected invalid jobs not to be saved, got %d jobs", len(jobs))
+	}
+}
+
+func TestSplitJob(t *testing.T) {
+	tests := []struct {
+		name          string
+		cidr, ports   string
+		prefix, split int
+		want          [][2]string
+	}{
+		{"Blocks", "192.0.2.0/23", "80", 24, 0, [][2]string{{"192.0.2.0/24", "80"}, {"192.0.3.0/24", "80"}}},
+		{"Range", "192.0.2.5-192.0.2.20", "80", 28, 0, [][2]string{
+			{"192.0.2.5", "80"}, {"192.0.2.6/31", "80"}, {"192.0.2.8/29", "80"}, {"192.0.2.16/30", "80"}, {"192.0.2.20", "80"},
+		}},
+		{"IPv6", "2001:db8::/123", "80", 28, 0, [][2]string{{"2001:db8::/124", "80"}, {"2001:db8::10/124", "80"}}},
+		{"Ports", "192.0.2.1", "1-1024,8080,U:53", 0, 500, [][2]string{
+			{"192.0.2.1", "1-500"}, {"192.0.2.1", "501-1000"}, {"192.0.2.1", "1001-1024,8080,U:53"},
+		}},
+		{"Both", "192.0.2.0/31", "1-2", 32, 1, [][2]string{
+			{"192.0.2.0", "1"}, {"192.0.2.0", "2"}, {"192.0.2.1", "1"}, {"192.0.2.1", "2"},
+		}},
+		{"OneChunk", "192.0.2.0/24", "1-1024", 24, 1024, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scan.SplitJob(tt.cidr, tt.ports, tt.prefix, tt.split)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i].CIDR != tt.want[i][0] || got[i].Ports != tt.want[i][1] {
+					t.Errorf("chunk %d: expected %v, got %v", i, tt.want[i], got[i])
+				}
+			}
+		})
+	}
+
+	for _, tt := range []struct{ prefix, split int }{{33, 0}, {0, -1}, {32, 0}} {
+		_, err := scan.SplitJob("10.0.0.0/16", "80", tt.prefix, tt.split)
+		if _, ok := err.(scan.FieldErrors); !ok {
+			t.Errorf("/%d, %d ports: expected field errors, got %v", tt.prefix, tt.split, err)
+		}
+	}
+}
+
+func TestJobChunks(t *testing.T) {
+	db := createDB("TestJobChunks")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	jobLease = time.Hour
+	defer func() { jobLease = 0 }()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	job := func(id int) scan.Job {
+		t.Helper()
+		jobs, err := db.LoadJobs(sqlite.SQLFilter{Where: []string{"rowid=?"}, Values: []interface{}{id}})
+		if err != nil || len(jobs) == 0 {
+			t.Fatalf("couldn't load job %d: %v", id, err)
+		}
+		return jobs[0]
+	}
+
+	form := url.Values{"cidr": {"192.0.2.0/23"}, "ports": {"80"}, "proto": {"TCP"}, "split_prefix": {"/24"}}
+	r := httptest.NewRequest("POST", "/job", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if j := job(1); j.Chunks != 2 || j.State != scan.JobQueued {
+		t.Fatalf("expected job 1 to be split into 2 chunks, got %+v", j)
+	}
+	// The split job is counted once, not as well as its chunks
+	states, err := db.CountJobStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if states[scan.JobQueued] != 1 {
+		t.Errorf("expected 1 queued job, got %d", states[scan.JobQueued])
+	}
+
+	w = do("GET", "/jobs", "")
+	var queued []scan.Job
+	if err := json.NewDecoder(w.Body).Decode(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 2 || queued[0].Parent != 1 || queued[0].CIDR != "192.0.2.0/24" || queued[1].CIDR != "192.0.3.0/24" {
+		t.Fatalf("expected only the chunks to be queued, got %+v", queued)
+	}
+
+	if w := do("POST", "/jobs/1/claim", ""); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 claiming a split job, got %d", w.Code)
+	}
+	if w := do("PUT", "/results/1", "[]"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 submitting a split job, got %d", w.Code)
+	}
+
+	if w := do("POST", "/jobs/2/claim?node=scanner1", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if j := job(1); j.State != scan.JobRunning || j.Started.IsZero() {
+		t.Errorf("expected job 1 to be running once a chunk is claimed, got %+v", j)
+	}
+
+	results := `[{"ip":"192.0.2.1","ports":[{"port":80,"proto":"tcp","status":"open"}]}]`
+	if w := do("PUT", "/results/2?node=scanner1", results); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if j := job(1); j.State != scan.JobRunning || j.ChunksDone != 1 || j.Count != 1 {
+		t.Errorf("expected job 1 to be running with 1 chunk done, got %+v", j)
+	}
+
+	results = `[{"ip":"192.0.3.1","ports":[{"port":80,"proto":"tcp","status":"open"}]},{"ip":"192.0.3.2","ports":[{"port":80,"proto":"tcp","status":"open"}]}]`
+	if w := do("PUT", "/results/3", results); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if j := job(1); j.State != scan.JobDone || j.ChunksDone != 2 || j.Count != 3 || j.Finished.IsZero() {
+		t.Errorf("expected job 1 to be done with 3 ports, got %+v", j)
+	}
+
+	filter, _, err := submissionFilter(url.Values{"job": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, err := db.LoadSubmissions(filter, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 2 {
+		t.Errorf("expected the submissions of both chunks for job 1, got %d", len(subs))
+	}
+
+	r = httptest.NewRequest("GET", "/job", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "2/2 chunks done") || strings.Contains(body, "<td>192.0.3.0/24</td>") {
+		t.Errorf("expected only job 1 with its progress on the job page")
+	}
+	r = httptest.NewRequest("GET", "/job?parent=1", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "Chunks of job 1") || !strings.Contains(body, "<td>192.0.3.0/24</td>") {
+		t.Errorf("expected the chunks of job 1")
+	}
+
+	// Cancelling a split job cancels the chunks which haven't finished
+	w = do("POST", "/api/v1/jobs", `{"cidr":"198.51.100.0/24","ports":"1-100","proto":"tcp","split_ports":50}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/jobs/5/claim", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := do("PUT", "/results/5", "[]"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	if err := db.CancelJob(4, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int]string{4: scan.JobCancelled, 5: scan.JobDone, 6: scan.JobCancelled} {
+		if j := job(id); j.State != want {
+			t.Errorf("job %d: expected %s, got %s", id, want, j.State)
+		}
+	}
+
+	if w := do("POST", "/api/v1/jobs", `{"cidr":"10.0.0.0/8","ports":"80","proto":"tcp","split_prefix":32}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 splitting a job into too many chunks, got %d", w.Code)
+	}
+}
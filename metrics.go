@@ -5,6 +5,7 @@ import (
 	"strconv"
 
 	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -31,6 +32,13 @@ var (
 		Help:      "New IPs found",
 	})
 
+	gaugeUnexpected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "scan",
+		Subsystem: "ips",
+		Name:      "unexpected",
+		Help:      "Open ports not covered by a policy",
+	})
+
 	gaugeSubmission = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "scan",
 		Name:      "last_submission_time",
@@ -45,6 +53,14 @@ var (
 		},
 		[]string{"id", "submitted", "received"})
 
+	gaugeJobStates = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "scan",
+			Name:      "jobs",
+			Help:      "Number of jobs in each state",
+		},
+		[]string{"state"})
+
 	gaugeJobSubmission = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "scan",
 		Subsystem: "job",
@@ -57,17 +73,20 @@ func init() {
 	prometheus.MustRegister(gaugeTotal)
 	prometheus.MustRegister(gaugeLatest)
 	prometheus.MustRegister(gaugeNew)
+	prometheus.MustRegister(gaugeUnexpected)
 	prometheus.MustRegister(gaugeSubmission)
 	prometheus.MustRegister(gaugeJobs)
+	prometheus.MustRegister(gaugeJobStates)
 	prometheus.MustRegister(gaugeJobSubmission)
 }
 
 func (app *App) metrics() http.Handler {
-	results, err := app.db.ResultData("", "", "")
+	results, err := app.db.ResultData(sqlite.SQLFilter{}, "", "")
 	if err == nil {
 		gaugeTotal.Set(float64(results.Total))
 		gaugeLatest.Set(float64(results.Latest))
 		gaugeNew.Set(float64(results.New))
+		gaugeUnexpected.Set(float64(results.Unexpected))
 	}
 
 	jobs, _ := app.db.LoadJobs(sqlite.SQLFilter{
@@ -81,8 +100,21 @@ func (app *App) metrics() http.Handler {
 		}).Set(float64(job.Count))
 	}
 
+	app.updateJobMetrics()
+
 	sub, _ := app.db.LoadSubmission(sqlite.SQLFilter{})
 	gaugeSubmission.Set(float64(sub.Time.Unix()))
 
 	return promhttp.Handler()
 }
+
+// updateJobMetrics counts the jobs in each state.
+func (app *App) updateJobMetrics() {
+	states, err := app.db.CountJobStates()
+	if err != nil {
+		return
+	}
+	for _, state := range scan.JobStates {
+		gaugeJobStates.WithLabelValues(state).Set(float64(states[state]))
+	}
+}
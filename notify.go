@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// background runs fn in a new goroutine, tracked by app.pending.
+func (app *App) background(fn func()) {
+	app.pending.Add(1)
+	go func() {
+		defer app.pending.Done()
+		fn()
+	}()
+}
+
+// notification builds the notification of the ports opened and closed by the
+// submission at now.
+func (app *App) notification(sub scan.Submission, now time.Time) (scan.Notification, error) {
+	n := scan.Notification{Submission: sub, Opened: []scan.IPInfo{}, Closed: []scan.IPInfo{}}
+	opened, err := app.db.LoadData(sqlite.SQLFilter{Where: []string{`opened=?`}, Values: []interface{}{now}})
+	if err != nil {
+		return n, err
+	}
+	closed, err := app.db.LoadData(sqlite.SQLFilter{Where: []string{`closed=?`}, Values: []interface{}{now}})
+	if err != nil {
+		return n, err
+	}
+	n.Opened = append(n.Opened, opened...)
+	n.Closed = append(n.Closed, closed...)
+	return n, nil
+}
+
+// notify sends the notification of a submission everywhere it's wanted.
+// Webhooks and email which rules send alerts to are only told about the
+// submission if a rule fires. Delivery happens in the background.
+func (app *App) notify(n scan.Notification) {
+	hooks, err := app.db.LoadWebhooks()
+	if err != nil {
+		log.Println("notify: couldn't load webhooks:", err)
+	}
+	rules, err := app.db.LoadRules()
+	if err != nil {
+		log.Println("notify: couldn't load rules:", err)
+	}
+
+	routed := make(map[int64]bool)
+	var routedEmail bool
+	for _, rule := range rules {
+		for _, id := range rule.Webhooks {
+			routed[id] = true
+		}
+		routedEmail = routedEmail || rule.Email
+	}
+
+	for _, h := range hooks {
+		if !routed[h.ID] {
+			app.sendWebhook(h, n)
+		}
+	}
+	if app.mailer != nil && app.mailer.Alerts && !routedEmail {
+		app.sendAlert(n)
+	}
+	app.alertRules(rules, hooks, n)
+}
+
+// sendAlert emails the notification in the background.
+func (app *App) sendAlert(n scan.Notification) {
+	app.background(func() {
+		if err := app.mailAlert(n); err != nil {
+			log.Println("notify: couldn't send email alert:", err)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ParseGrepable parses masscan grepable output (-oG).
+//
+// Each line is a tab-separated list of "Key: value" fields, e.g.
+//
+//	Timestamp: 1600000000	Host: 192.0.2.1 ()	Ports: 80/open/tcp////
+//	Timestamp: 1600000000	Host: 192.0.2.1 ()	Port: 80	Service: http	Banner: HTTP/1.0 200 OK
+func ParseGrepable(r io.Reader) ([]Result, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Result{}
+	err = eachLine(data, func(line string, off int) error {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			return nil
+		}
+
+		// Record each field's value and where it starts in the line
+		fields := make(map[string]string)
+		cols := make(map[string]int)
+		var col int
+		for _, f := range strings.Split(line, "\t") {
+			if i := strings.Index(f, ": "); i > 0 {
+				fields[f[:i]] = f[i+2:]
+				cols[f[:i]] = col + i + 2
+			}
+			col += len(f) + 1
+		}
+
+		host, ok := fields["Host"]
+		if !ok {
+			return newSyntaxError(data, off, errors.New("missing Host field"))
+		}
+		// The host is followed by the hostname in parentheses, which masscan
+		// always leaves empty
+		if i := strings.IndexByte(host, ' '); i > 0 {
+			host = host[:i]
+		}
+
+		var p Port
+		switch {
+		case fields["Ports"] != "":
+			// port/state/proto/owner/service/rpc/version
+			f := strings.Split(fields["Ports"], "/")
+			if len(f) < 3 {
+				return newSyntaxError(data, off+cols["Ports"], fmt.Errorf("invalid port specification %q", fields["Ports"]))
+			}
+			p.Port, err = strconv.Atoi(f[0])
+			if err != nil {
+				return newSyntaxError(data, off+cols["Ports"], fmt.Errorf("invalid port %q", f[0]))
+			}
+			p.Status = f[1]
+			p.Proto = f[2]
+			if len(f) > 4 {
+				p.Service.Name = f[4]
+			}
+		case fields["Port"] != "":
+			p.Port, err = strconv.Atoi(fields["Port"])
+			if err != nil {
+				return newSyntaxError(data, off+cols["Port"], fmt.Errorf("invalid port %q", fields["Port"]))
+			}
+			// Banners don't include the protocol. Masscan only grabs banners
+			// over TCP.
+			p.Proto = "tcp"
+			p.Service.Name = fields["Service"]
+			p.Service.Banner = fields["Banner"]
+		default:
+			return newSyntaxError(data, off, errors.New("missing Ports field"))
+		}
+
+		results = append(results, Result{IP: host, Ports: []Port{p}})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
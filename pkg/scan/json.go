@@ -0,0 +1,121 @@
+package scan
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+)
+
+// SyntaxError describes malformed scan output and where in the input it was
+// found.
+type SyntaxError struct {
+	Offset int64 // Byte offset from the start of the input
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// newSyntaxError works out the line and column of offset in data.
+func newSyntaxError(data []byte, offset int, err error) *SyntaxError {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	col := offset - bytes.LastIndexByte(data[:offset], '\n')
+	return &SyntaxError{Offset: int64(offset), Line: line, Column: col, Err: err}
+}
+
+// finishedMarker matches the (invalid JSON) object masscan writes as the last
+// line of its output.
+var finishedMarker = regexp.MustCompile(`^\{\s*"?finished"?\s*:\s*[0-9]+\s*\}`)
+
+// ParseJSON parses masscan JSON output (-oJ).
+//
+// Masscan doesn't generate valid JSON: the surrounding brackets may be
+// missing, the last result is followed by a comma and the output ends with
+// {finished: 1}. All of these are tolerated, as is a valid JSON array.
+func ParseJSON(r io.Reader) ([]Result, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var off int
+	skip := func() {
+		for off < len(data) {
+			switch data[off] {
+			case ' ', '\t', '\r', '\n', ',':
+				off++
+			default:
+				return
+			}
+		}
+	}
+
+	skip()
+	if off < len(data) && data[off] == '[' {
+		off++
+	}
+
+	results := []Result{}
+	for {
+		skip()
+		if off >= len(data) {
+			break
+		}
+
+		if data[off] == ']' {
+			// Only whitespace or the finished marker may follow the end of
+			// the array
+			off++
+			skip()
+			if loc := finishedMarker.FindIndex(data[off:]); loc != nil {
+				off += loc[1]
+				skip()
+			}
+			if off < len(data) {
+				return nil, newSyntaxError(data, off, errors.New("unexpected data after end of results"))
+			}
+			break
+		}
+
+		if loc := finishedMarker.FindIndex(data[off:]); loc != nil {
+			off += loc[1]
+			continue
+		}
+
+		var res Result
+		dec := json.NewDecoder(bytes.NewReader(data[off:]))
+		if err := dec.Decode(&res); err != nil {
+			pos := off
+			var se *json.SyntaxError
+			var te *json.UnmarshalTypeError
+			switch {
+			case errors.As(err, &se):
+				// Offset is after the invalid character
+				pos += int(se.Offset) - 1
+			case errors.As(err, &te):
+				pos += int(te.Offset)
+			case errors.Is(err, io.ErrUnexpectedEOF):
+				pos = len(data)
+			}
+			return nil, newSyntaxError(data, pos, err)
+		}
+		off += int(dec.InputOffset())
+		results = append(results, res)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,80 @@
+package scan
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// eachLine calls fn for each line of data along with the byte offset at
+// which the line starts. Trailing carriage returns are removed.
+func eachLine(data []byte, fn func(line string, off int) error) error {
+	var off int
+	for off < len(data) {
+		end := bytes.IndexByte(data[off:], '\n')
+		if end < 0 {
+			end = len(data) - off
+		}
+		line := strings.TrimSuffix(string(data[off:off+end]), "\r")
+		if err := fn(line, off); err != nil {
+			return err
+		}
+		off += end + 1
+	}
+	return nil
+}
+
+// ParseList parses masscan list output (-oL).
+//
+// Each line is of the form:
+//
+//	open tcp 80 192.0.2.1 1600000000
+//	banner tcp 80 192.0.2.1 1600000000 http HTTP/1.0 200 OK
+func ParseList(r io.Reader) ([]Result, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Result{}
+	err = eachLine(data, func(line string, off int) error {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			return nil
+		}
+
+		f := strings.SplitN(line, " ", 7)
+		if len(f) < 5 {
+			return newSyntaxError(data, off, fmt.Errorf("expected at least 5 fields, got %d", len(f)))
+		}
+		port, err := strconv.Atoi(f[2])
+		if err != nil {
+			col := len(f[0]) + len(f[1]) + 2
+			return newSyntaxError(data, off+col, fmt.Errorf("invalid port %q", f[2]))
+		}
+
+		p := Port{Port: port, Proto: f[1]}
+		if f[0] == "banner" {
+			if len(f) < 6 {
+				return newSyntaxError(data, off, errors.New("banner is missing service name"))
+			}
+			p.Service.Name = f[5]
+			if len(f) == 7 {
+				p.Service.Banner = f[6]
+			}
+		} else {
+			p.Status = f[0]
+		}
+
+		results = append(results, Result{IP: f[3], Ports: []Port{p}})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
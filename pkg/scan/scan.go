@@ -1,6 +1,8 @@
 package scan
 
 import (
+	"fmt"
+	"strconv"
 	"time"
 )
 
@@ -10,8 +12,10 @@ type Port struct {
 	Proto   string `json:"proto"`
 	Status  string `json:"status"`
 	Service struct {
-		Name   string `json:"name"`
-		Banner string `json:"banner"`
+		Name    string `json:"name"`
+		Banner  string `json:"banner"`
+		Product string `json:"product,omitempty"`
+		Version string `json:"version,omitempty"`
 	} `json:"service"`
 }
 
@@ -21,7 +25,7 @@ type Result struct {
 	Ports []Port `json:"ports"`
 }
 
-// Time wraps time.Time to implement a custom String method.
+// Time wraps time.Time to implement custom String and MarshalJSON methods.
 type Time struct {
 	time.Time
 }
@@ -35,34 +39,132 @@ func (t Time) String() string {
 	return t.Format(dateTime)
 }
 
+// MarshalJSON encodes the zero time as null.
+func (t Time) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return t.Time.MarshalJSON()
+}
+
+// ParseTime parses an RFC 3339 time, a date (optionally with hours and
+// minutes) or seconds since the Unix epoch.
+// Times are returned in UTC.
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	// As sent by HTML datetime-local inputs
+	if t, err := time.Parse("2006-01-02T15:04", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(i, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
 // IPInfo is data retrieved from the database for display.
 type IPInfo struct {
-	IP            string
-	Port          int
-	Proto         string
-	FirstSeen     Time
-	LastSeen      Time
-	New           bool
-	Gone          bool
-	HasTraceroute bool
+	ID            int64    `json:"id"`
+	IP            string   `json:"ip"`
+	Port          int      `json:"port"`
+	Proto         string   `json:"proto"`
+	Service       string   `json:"service,omitempty"`
+	Product       string   `json:"product,omitempty"`
+	Version       string   `json:"version,omitempty"`
+	FirstSeen     Time     `json:"firstseen"`
+	LastSeen      Time     `json:"lastseen"`
+	Closed        Time     `json:"closed"`
+	New           bool     `json:"new"`
+	Gone          bool     `json:"gone"`
+	HasTraceroute bool     `json:"traceroute"`
+	Banners       []Banner `json:"banners,omitempty"`
+	Triage        Triage   `json:"triage"`
+	Expected      bool     `json:"expected"`
+}
+
+// Banner is a service banner grabbed from a port. Each change to the banner
+// text is recorded as a new Banner.
+type Banner struct {
+	IP        string `json:"ip"`
+	Port      int    `json:"port"`
+	Proto     string `json:"proto"`
+	Service   string `json:"service"`
+	Banner    string `json:"banner"`
+	FirstSeen Time   `json:"firstseen"`
+	LastSeen  Time   `json:"lastseen"`
 }
 
 // Data is used for display in the UI. It contains a summary of the number of
 // items stored in the database as well as each result.
 type Data struct {
-	Total    int
-	Latest   int
-	New      int
-	LastSeen int64
-	Results  []IPInfo
+	Total      int
+	Latest     int
+	New        int
+	Unexpected int
+	LastSeen   int64
+	Results    []IPInfo
+}
+
+// Diff is the change in open ports between two points in time.
+type Diff struct {
+	From   Time     `json:"from"`
+	To     Time     `json:"to"`
+	Opened []IPInfo `json:"opened"`
+	Closed []IPInfo `json:"closed"`
 }
 
 // Submission is used for display in the UI to show when and which host last
 // submitted results.
 type Submission struct {
-	Host string
-	Job  int64
-	Time Time
+	ID   int64  `json:"id"`
+	Host string `json:"host"`
+	Job  int64  `json:"job,omitempty"`
+	Time Time   `json:"time"`
+	// The scope of the scan. Empty fields mean the scan wasn't restricted.
+	CIDR  string `json:"cidr,omitempty"`
+	Ports string `json:"ports,omitempty"`
+	Proto string `json:"proto,omitempty"`
+}
+
+// Scope parses the scope of the scan which produced the submission.
+func (s Submission) Scope() (Scope, error) {
+	return ParseScope(s.CIDR, s.Ports, s.Proto)
+}
+
+// SubmissionSummary is a submission with the number of ports seen in it, and
+// how many were added and removed since the previous submission with the same
+// scope.
+type SubmissionSummary struct {
+	Submission
+	Previous int64 `json:"previous,omitempty"`
+	Results  int   `json:"results"`
+	Added    int   `json:"added"`
+	Removed  int   `json:"removed"`
+}
+
+// SubmissionDiff is the change in ports seen between two submissions.
+type SubmissionDiff struct {
+	From      Submission    `json:"from"`
+	To        Submission    `json:"to"`
+	Added     []Observation `json:"added"`
+	Removed   []Observation `json:"removed"`
+	Unchanged []Observation `json:"unchanged"`
+}
+
+// Observation records a port being seen in a submission.
+type Observation struct {
+	Submission int64  `json:"submission"`
+	Host       string `json:"host"`
+	Job        int64  `json:"job,omitempty"`
+	Time       Time   `json:"time"`
+	IP         string `json:"ip"`
+	Port       int    `json:"port"`
+	Proto      string `json:"proto"`
 }
 
 // Job represents a job to be sent to and received from scanning nodes,
@@ -75,4 +177,200 @@ type Job struct {
 	Submitted   Time   `json:"-"`
 	Received    Time   `json:"-"`
 	Count       int64  `json:"-"`
+	State       string `json:"state"`
+	// The node which claimed the job, until its lease expires
+	Node         string `json:"-"`
+	LeaseExpires Time   `json:"-"`
+	Started      Time   `json:"-"`
+	Finished     Time   `json:"-"`
+	Error        string `json:"-"`
+	// A large job may be split into chunks, which are jobs of their own
+	// with the job as their parent. The parent isn't run itself, but
+	// follows the state of its chunks and counts the ports they found.
+	Parent     int `json:"parent,omitempty"`
+	Chunks     int `json:"-"`
+	ChunksDone int `json:"-"`
+}
+
+// Job states. Jobs are queued until a node claims them, when they're running
+// until the node submits results (done) or reports a failure. Users may cancel
+// jobs which haven't finished, and jobs which no node claims expire.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+	JobExpired   = "expired"
+)
+
+// JobStates lists the job states in lifecycle order.
+var JobStates = []string{JobQueued, JobRunning, JobDone, JobFailed, JobCancelled, JobExpired}
+
+// Active reports whether the job is queued or running.
+func (j Job) Active() bool {
+	return j.State == JobQueued || j.State == JobRunning
+}
+
+// Note is a comment left on a host.
+type Note struct {
+	ID      int64  `json:"id"`
+	IP      string `json:"ip"`
+	Author  string `json:"author"`
+	Note    string `json:"note"`
+	Created Time   `json:"created"`
+}
+
+// Triage states of a port.
+const (
+	TriageNew           = "new"
+	TriageAcknowledged  = "acknowledged"
+	TriageExpected      = "expected"
+	TriageRemediated    = "remediated"
+	TriageFalsePositive = "false-positive"
+)
+
+// TriageStates are the valid triage states, in the order they're usually
+// worked through.
+var TriageStates = []string{TriageNew, TriageAcknowledged, TriageExpected, TriageRemediated, TriageFalsePositive}
+
+// ValidTriageState reports whether state is a valid triage state.
+func ValidTriageState(state string) bool {
+	for _, s := range TriageStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Triage is the review of a port. A port which hasn't been reviewed has the
+// state TriageNew.
+type Triage struct {
+	IP        string `json:"ip,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Proto     string `json:"proto,omitempty"`
+	State     string `json:"state"`
+	Assignee  string `json:"assignee,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+	Updated   Time   `json:"updated"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+}
+
+// Policy describes exposure which is expected, such as known web servers.
+// Open ports covered by an active policy are expected, anything else is a
+// policy violation. An empty Ports or Proto covers any port or protocol.
+type Policy struct {
+	ID        int64  `json:"id"`
+	CIDR      string `json:"cidr"`
+	Ports     string `json:"ports,omitempty"`
+	Proto     string `json:"proto,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+	Expires   Time   `json:"expires"`
+	Created   Time   `json:"created"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// Scope parses what the policy covers.
+func (p Policy) Scope() (Scope, error) {
+	return ParseScope(p.CIDR, p.Ports, p.Proto)
+}
+
+// Expired reports whether the policy had expired at t.
+func (p Policy) Expired(t time.Time) bool {
+	return !p.Expires.IsZero() && !p.Expires.After(t)
+}
+
+// Notification describes the changes made by a submission. If it was sent
+// because a rule fired, Rule is the rule's name and Opened only has the ports
+// which matched it.
+type Notification struct {
+	Rule       string     `json:"rule,omitempty"`
+	Submission Submission `json:"submission"`
+	Opened     []IPInfo   `json:"opened"`
+	Closed     []IPInfo   `json:"closed"`
+}
+
+// Webhook formats.
+const (
+	WebhookJSON       = "json"
+	WebhookSlack      = "slack"
+	WebhookMattermost = "mattermost"
+	WebhookTeams      = "teams"
+)
+
+// WebhookFormats are the valid webhook formats.
+var WebhookFormats = []string{WebhookJSON, WebhookSlack, WebhookMattermost, WebhookTeams}
+
+// Webhook is a URL notified after each submission. If Secret is set the
+// request body is signed with it.
+//
+// The webhook is only told about ports within CIDR and Ports, and which aren't
+// covered by a policy if UnexpectedOnly is set. Empty fields match anything.
+type Webhook struct {
+	ID             int64  `json:"id"`
+	URL            string `json:"url"`
+	Secret         string `json:"-"`
+	Format         string `json:"format"`
+	CIDR           string `json:"cidr,omitempty"`
+	Ports          string `json:"ports,omitempty"`
+	UnexpectedOnly bool   `json:"unexpected_only"`
+	Created        Time   `json:"created"`
+	CreatedBy      string `json:"created_by,omitempty"`
+}
+
+// Scope parses the ports the webhook is told about.
+func (h Webhook) Scope() (Scope, error) {
+	return ParseScope(h.CIDR, h.Ports, "")
+}
+
+// Delivery is an attempt to deliver a notification to a webhook. Status is
+// the HTTP status code of the response, or 0 if no response was received.
+type Delivery struct {
+	Webhook    int64  `json:"webhook"`
+	URL        string `json:"url"`
+	Submission int64  `json:"submission"`
+	Time       Time   `json:"time"`
+	Attempt    int    `json:"attempt"`
+	Status     int    `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Rule decides which submissions are worth alerting on. A rule matches ports
+// opened by a submission within its CIDR, ports and protocol, and which aren't
+// covered by a policy if UnexpectedOnly is set. It fires when at least
+// MinPorts ports match, and the alert is sent to each of its targets.
+type Rule struct {
+	ID             int64   `json:"id"`
+	Name           string  `json:"name"`
+	CIDR           string  `json:"cidr,omitempty"`
+	Ports          string  `json:"ports,omitempty"`
+	Proto          string  `json:"proto,omitempty"`
+	UnexpectedOnly bool    `json:"unexpected_only"`
+	MinPorts       int     `json:"min_ports"`
+	Webhooks       []int64 `json:"webhooks"`
+	Email          bool    `json:"email"`
+	Created        Time    `json:"created"`
+	CreatedBy      string  `json:"created_by,omitempty"`
+}
+
+// Scope parses the ports the rule matches.
+func (r Rule) Scope() (Scope, error) {
+	return ParseScope(r.CIDR, r.Ports, r.Proto)
+}
+
+// Silence stops a rule from firing between Starts and Ends. A Rule of 0
+// silences every rule.
+type Silence struct {
+	ID        int64  `json:"id"`
+	Rule      int64  `json:"rule"`
+	Starts    Time   `json:"starts"`
+	Ends      Time   `json:"ends"`
+	Comment   string `json:"comment,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// Silences reports whether the silence stops rule from firing at t.
+func (s Silence) Silences(rule int64, t time.Time) bool {
+	return (s.Rule == 0 || s.Rule == rule) && !t.Before(s.Starts.Time) && t.Before(s.Ends.Time)
 }
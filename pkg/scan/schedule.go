@@ -0,0 +1,194 @@
+package scan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule enqueues a job for its scope each time its recurrence comes round.
+type Schedule struct {
+	ID    int64  `json:"id"`
+	CIDR  string `json:"cidr"`
+	Ports string `json:"ports"`
+	Proto string `json:"proto"`
+	// Spec is a cron expression or an interval, as for ParseRecurrence
+	Spec      string `json:"spec"`
+	Paused    bool   `json:"paused"`
+	LastRun   Time   `json:"last_run"`
+	LastJob   int64  `json:"last_job,omitempty"`
+	NextRun   Time   `json:"next_run"`
+	Created   Time   `json:"created"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// Recurrence works out when something which repeats happens next.
+type Recurrence interface {
+	// Next returns the first time after t. It's zero if there's none.
+	Next(t time.Time) time.Time
+}
+
+// minInterval is the shortest interval a recurrence may have.
+const minInterval = time.Minute
+
+// cronDescriptors are the shorthand cron expressions.
+var cronDescriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// ParseRecurrence parses an interval, such as "6h" or "@every 6h", or a cron
+// expression of minute, hour, day of month, month and day of week. Cron
+// expressions are evaluated in the time zone of the time passed to Next.
+func ParseRecurrence(spec string) (Recurrence, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := cronDescriptors[spec]; ok {
+		spec = d
+	}
+
+	if s := strings.TrimPrefix(spec, "@every "); s != spec || !strings.Contains(spec, " ") {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q", spec)
+		}
+		if d < minInterval {
+			return nil, fmt.Errorf("interval %s is shorter than %s", d, minInterval)
+		}
+		return interval(d), nil
+	}
+
+	return parseCron(spec)
+}
+
+// interval recurs a fixed time after the last time.
+type interval time.Duration
+
+func (i interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
+
+// cron is a parsed cron expression. Each field is a bitmap of the values it
+// matches.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	// Whether the day of month and day of week were "*". If both are
+	// restricted, a day matching either runs, as for cron(8).
+	domAny, dowAny bool
+}
+
+func parseCron(spec string) (cron, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cron{}, fmt.Errorf("invalid cron expression %q: expected 5 fields", spec)
+	}
+
+	var c cron
+	limits := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, l := range limits {
+		bits, err := parseCronField(fields[i], l.min, l.max)
+		if err != nil {
+			return cron{}, fmt.Errorf("invalid cron expression %q: %v", spec, err)
+		}
+		*l.bits = bits
+	}
+	// Sunday is 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	return c, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges ("1-5") and
+// "*", each optionally with a step ("*/15").
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			a, err1 := strconv.Atoi(rng[:i])
+			b, err2 := strconv.Atoi(rng[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rng)
+			}
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+func (c cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Expressions such as 30 February never match
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,233 @@
+package scan
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// IPRange is an inclusive range of IP addresses. Addresses are held in
+// their 16-byte form so IPv4 and IPv6 addresses can be compared.
+type IPRange struct {
+	First net.IP
+	Last  net.IP
+}
+
+// Contains reports whether ip is within the range.
+func (r IPRange) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	return bytes.Compare(ip, r.First) >= 0 && bytes.Compare(ip, r.Last) <= 0
+}
+
+// Size returns the number of addresses in the range.
+func (r IPRange) Size() *big.Int {
+	n := new(big.Int).Sub(new(big.Int).SetBytes(r.Last), new(big.Int).SetBytes(r.First))
+	return n.Add(n, big.NewInt(1))
+}
+
+func (r IPRange) String() string {
+	if r.First.Equal(r.Last) {
+		return r.First.String()
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// ParseIPRange parses a single IP address, a CIDR or a range of addresses
+// separated by a hyphen, e.g. 192.0.2.1-192.0.2.100.
+func ParseIPRange(s string) (IPRange, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return IPRange{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		first := n.IP.To16()
+		last := make(net.IP, len(first))
+		copy(last, first)
+		// The mask is 4 bytes for IPv4, so apply it to the end of the
+		// 16-byte address
+		off := len(last) - len(n.Mask)
+		for i := range n.Mask {
+			last[off+i] |= ^n.Mask[i]
+		}
+		return IPRange{First: first, Last: last}, nil
+	}
+
+	if i := strings.IndexByte(s, '-'); i > 0 {
+		first := net.ParseIP(s[:i])
+		last := net.ParseIP(s[i+1:])
+		if first == nil || last == nil {
+			return IPRange{}, fmt.Errorf("invalid IP range %q", s)
+		}
+		if (first.To4() == nil) != (last.To4() == nil) {
+			return IPRange{}, fmt.Errorf("IP range %q mixes IPv4 and IPv6", s)
+		}
+		r := IPRange{First: first.To16(), Last: last.To16()}
+		if bytes.Compare(r.First, r.Last) > 0 {
+			return IPRange{}, fmt.Errorf("IP range %q ends before it starts", s)
+		}
+		return r, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return IPRange{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	return IPRange{First: ip.To16(), Last: ip.To16()}, nil
+}
+
+// ParseTargets parses a comma or space separated list of IP addresses, CIDRs
+// or IP ranges.
+func ParseTargets(s string) ([]IPRange, error) {
+	var targets []IPRange
+	for _, f := range splitList(s) {
+		r, err := ParseIPRange(f)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, r)
+	}
+	return targets, nil
+}
+
+// PortRange is an inclusive range of ports. Proto is empty if the range
+// applies to any protocol.
+type PortRange struct {
+	First int
+	Last  int
+	Proto string
+}
+
+// Contains reports whether port is within the range.
+func (r PortRange) Contains(port int, proto string) bool {
+	if r.Proto != "" && r.Proto != proto {
+		return false
+	}
+	return port >= r.First && port <= r.Last
+}
+
+func (r PortRange) String() string {
+	var s string
+	switch r.Proto {
+	case "udp":
+		s = "U:"
+	case "sctp":
+		s = "S:"
+	}
+	if r.First == r.Last {
+		return s + strconv.Itoa(r.First)
+	}
+	return fmt.Sprintf("%s%d-%d", s, r.First, r.Last)
+}
+
+// portPrefixes are masscan's protocol prefixes for port specifications.
+var portPrefixes = map[string]string{
+	"T:": "tcp",
+	"U:": "udp",
+	"S:": "sctp",
+}
+
+// ParsePorts parses a masscan-style port specification, e.g.
+// 22,80,1000-2000,U:53. Ports prefixed with U: are UDP, S: are SCTP and T:
+// are TCP. Ports without a prefix apply to any protocol.
+func ParsePorts(s string) ([]PortRange, error) {
+	var ports []PortRange
+	for _, f := range splitList(s) {
+		var r PortRange
+		if len(f) > 2 {
+			if proto, ok := portPrefixes[strings.ToUpper(f[:2])]; ok {
+				r.Proto = proto
+				f = f[2:]
+			}
+		}
+
+		first, last := f, f
+		if i := strings.IndexByte(f, '-'); i >= 0 {
+			first, last = f[:i], f[i+1:]
+		}
+		var err error
+		r.First, err = strconv.Atoi(first)
+		if err != nil || r.First < 0 || r.First > 65535 {
+			return nil, fmt.Errorf("invalid port %q", first)
+		}
+		r.Last, err = strconv.Atoi(last)
+		if err != nil || r.Last < 0 || r.Last > 65535 {
+			return nil, fmt.Errorf("invalid port %q", last)
+		}
+		if r.Last < r.First {
+			return nil, fmt.Errorf("port range %q ends before it starts", f)
+		}
+		ports = append(ports, r)
+	}
+	return ports, nil
+}
+
+// splitList splits a comma or whitespace separated list.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
+// Scope describes what a scan covered. An empty field means the scan wasn't
+// restricted in that respect, so the zero Scope covers everything.
+type Scope struct {
+	Targets []IPRange
+	Ports   []PortRange
+	Proto   string
+}
+
+// ParseScope parses the targets, ports and protocol of a scan. Each argument
+// is optional.
+func ParseScope(targets, ports, proto string) (Scope, error) {
+	var s Scope
+	var err error
+	s.Targets, err = ParseTargets(targets)
+	if err != nil {
+		return Scope{}, err
+	}
+	s.Ports, err = ParsePorts(ports)
+	if err != nil {
+		return Scope{}, err
+	}
+	s.Proto = strings.ToLower(strings.TrimSpace(proto))
+	return s, nil
+}
+
+// Contains reports whether the IP, port and protocol were covered by the
+// scan.
+func (s Scope) Contains(ip string, port int, proto string) bool {
+	if s.Proto != "" && s.Proto != proto {
+		return false
+	}
+
+	if len(s.Targets) > 0 {
+		addr := net.ParseIP(ip)
+		var found bool
+		for _, t := range s.Targets {
+			if t.Contains(addr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(s.Ports) > 0 {
+		for _, p := range s.Ports {
+			if p.Contains(port, proto) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,91 @@
+package scan
+
+import (
+	"fmt"
+	"strings"
+)
+
+// protocols are the protocols results can be recorded with.
+var protocols = map[string]bool{
+	"tcp":  true,
+	"udp":  true,
+	"sctp": true,
+	"icmp": true,
+}
+
+// ValidProtocol reports whether proto is a protocol results can be recorded
+// with.
+func ValidProtocol(proto string) bool {
+	return protocols[proto]
+}
+
+// ParseSearch parses a search of the results into the Scope it matches.
+// Terms are separated by commas or spaces and may be:
+//
+//   - An IP address, CIDR or range of addresses, optionally prefixed with ip:
+//   - A port, port range or masscan-style port with a protocol prefix (e.g.
+//     U:53), optionally prefixed with port:
+//   - A protocol, optionally prefixed with proto:
+//
+// A result matches if it matches any of the addresses, any of the ports and
+// the protocol. An empty search matches everything.
+func ParseSearch(s string) (Scope, error) {
+	var scope Scope
+	for _, term := range splitList(s) {
+		key, value := "", term
+		if i := strings.IndexByte(term, ':'); i > 0 {
+			switch k := strings.ToLower(term[:i]); k {
+			case "ip", "port", "proto":
+				key, value = k, term[i+1:]
+			}
+		}
+		if value == "" {
+			return Scope{}, fmt.Errorf("missing value for %s", key)
+		}
+
+		if key == "" {
+			switch {
+			case protocols[strings.ToLower(value)]:
+				key = "proto"
+			case strings.ContainsAny(value, ".:/") && !isPortSpec(value):
+				key = "ip"
+			default:
+				key = "port"
+			}
+		}
+
+		switch key {
+		case "ip":
+			r, err := ParseIPRange(value)
+			if err != nil {
+				return Scope{}, err
+			}
+			scope.Targets = append(scope.Targets, r)
+		case "port":
+			ports, err := ParsePorts(value)
+			if err != nil {
+				return Scope{}, err
+			}
+			scope.Ports = append(scope.Ports, ports...)
+		case "proto":
+			proto := strings.ToLower(value)
+			if !protocols[proto] {
+				return Scope{}, fmt.Errorf("invalid protocol %q", value)
+			}
+			if scope.Proto != "" && scope.Proto != proto {
+				return Scope{}, fmt.Errorf("can't search for both %s and %s", scope.Proto, proto)
+			}
+			scope.Proto = proto
+		}
+	}
+	return scope, nil
+}
+
+// isPortSpec reports whether s starts with a masscan protocol prefix.
+func isPortSpec(s string) bool {
+	if len(s) < 3 {
+		return false
+	}
+	_, ok := portPrefixes[strings.ToUpper(s[:2])]
+	return ok
+}
@@ -0,0 +1,140 @@
+package scan
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// MaxJobChunks is the most chunks a job may be split into.
+const MaxJobChunks = 4096
+
+// JobChunk is the part of a job's targets and ports scanned by one chunk.
+type JobChunk struct {
+	CIDR  string
+	Ports string
+}
+
+// SplitJob splits a job into chunks, each covering at most a block of
+// addresses with the given prefix length and at most portsPerChunk ports.
+// The prefix length is for IPv4 addresses; IPv6 addresses are split into
+// blocks of the same size. A prefix or portsPerChunk of 0 doesn't split the
+// job in that respect. A job which fits in one chunk returns no chunks.
+// Problems with how the job is split are returned as FieldErrors.
+func SplitJob(cidr, ports string, prefix, portsPerChunk int) ([]JobChunk, error) {
+	var errs FieldErrors
+	if prefix < 0 || prefix > 32 {
+		errs.add("split_prefix", "invalid block size /%d", prefix)
+	}
+	if portsPerChunk < 0 {
+		errs.add("split_ports", "invalid number of ports per chunk %d", portsPerChunk)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	blocks := []string{cidr}
+	if prefix > 0 {
+		targets, err := ParseTargets(cidr)
+		if err != nil {
+			return nil, err
+		}
+		blocks = nil
+		for _, t := range targets {
+			blocks = append(blocks, splitRange(t, 32-prefix)...)
+			if len(blocks) > MaxJobChunks {
+				break
+			}
+		}
+	}
+
+	groups := []string{ports}
+	if portsPerChunk > 0 {
+		p, err := ParsePorts(ports)
+		if err != nil {
+			return nil, err
+		}
+		groups = splitPorts(p, portsPerChunk)
+	}
+
+	if n := len(blocks) * len(groups); n > MaxJobChunks {
+		errs.add("split_prefix", "job would be split into more than %d chunks", MaxJobChunks)
+		return nil, errs
+	} else if n <= 1 {
+		return nil, nil
+	}
+
+	chunks := make([]JobChunk, 0, len(blocks)*len(groups))
+	for _, b := range blocks {
+		for _, g := range groups {
+			chunks = append(chunks, JobChunk{CIDR: b, Ports: g})
+		}
+	}
+	return chunks, nil
+}
+
+// splitRange splits an IP range into the fewest CIDRs with at most hostBits
+// host bits.
+func splitRange(r IPRange, hostBits int) []string {
+	first, last, bits := r.First, r.Last, 128
+	if v4 := first.To4(); v4 != nil {
+		first, last, bits = v4, last.To4(), 32
+	}
+
+	start := new(big.Int).SetBytes(first)
+	end := new(big.Int).SetBytes(last)
+	one := big.NewInt(1)
+	var cidrs []string
+	for start.Cmp(end) <= 0 && len(cidrs) <= MaxJobChunks {
+		// The largest block starting at start which is aligned and
+		// doesn't go past the end of the range
+		size := hostBits
+		for size > 0 {
+			mask := new(big.Int).Sub(new(big.Int).Lsh(one, uint(size)), one)
+			blockEnd := new(big.Int).Or(start, mask)
+			if new(big.Int).And(start, mask).Sign() == 0 && blockEnd.Cmp(end) <= 0 {
+				break
+			}
+			size--
+		}
+
+		ip := make(net.IP, len(first))
+		b := start.Bytes()
+		copy(ip[len(ip)-len(b):], b)
+		if size == 0 {
+			cidrs = append(cidrs, ip.String())
+		} else {
+			cidrs = append(cidrs, fmt.Sprintf("%s/%d", ip, bits-size))
+		}
+		start.Add(start, new(big.Int).Lsh(one, uint(size)))
+	}
+	return cidrs
+}
+
+// splitPorts splits ports into groups of at most n ports, in masscan's
+// format.
+func splitPorts(ports []PortRange, n int) []string {
+	var groups []string
+	var group []string
+	var size int
+	for _, r := range ports {
+		for first := r.First; first <= r.Last; {
+			last := r.Last
+			if last-first+1 > n-size {
+				last = first + n - size - 1
+			}
+			group = append(group, PortRange{First: first, Last: last, Proto: r.Proto}.String())
+			size += last - first + 1
+			if size == n {
+				groups = append(groups, strings.Join(group, ","))
+				group, size = nil, 0
+			}
+			first = last + 1
+		}
+	}
+	if len(group) > 0 {
+		groups = append(groups, strings.Join(group, ","))
+	}
+	return groups
+}
@@ -0,0 +1,77 @@
+package scan
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// MaxJobAddresses is the most addresses a job may scan, so a mistake such as
+// 0.0.0.0/0 doesn't keep a node busy forever. The default is a /8.
+var MaxJobAddresses int64 = 1 << 24
+
+// FieldError is a problem with one field of a request. Field is the name of
+// the form or JSON field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+func (e FieldError) Error() string {
+	return e.Message
+}
+
+// FieldErrors are all the problems found with a request.
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *FieldErrors) add(field, format string, a ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, a...)})
+}
+
+// ValidateJob checks the targets, masscan-style ports and protocols of a
+// job. If any are invalid it returns FieldErrors describing each problem.
+func ValidateJob(cidr, ports string, protos []string) error {
+	var errs FieldErrors
+
+	if targets, err := ParseTargets(cidr); err != nil {
+		errs.add("cidr", "%v", err)
+	} else if len(targets) == 0 {
+		errs.add("cidr", "CIDR is required")
+	} else {
+		size := new(big.Int)
+		for _, t := range targets {
+			size.Add(size, t.Size())
+		}
+		if size.Cmp(big.NewInt(MaxJobAddresses)) > 0 {
+			errs.add("cidr", "CIDR %s covers %s addresses, more than the limit of %d", cidr, size, MaxJobAddresses)
+		}
+	}
+
+	if p, err := ParsePorts(ports); err != nil {
+		errs.add("ports", "%v", err)
+	} else if len(p) == 0 {
+		errs.add("ports", "Ports are required")
+	}
+
+	if len(protos) == 0 {
+		errs.add("proto", "Protocol is required")
+	}
+	for _, p := range protos {
+		if !ValidProtocol(strings.ToLower(p)) {
+			errs.add("proto", "unknown protocol %q", p)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package scan
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// xmlHost is a host element from nmap XML output. Masscan's XML output uses
+// the same format.
+type xmlHost struct {
+	Addresses []struct {
+		Addr     string `xml:"addr,attr"`
+		AddrType string `xml:"addrtype,attr"`
+	} `xml:"address"`
+	Ports []struct {
+		Protocol string `xml:"protocol,attr"`
+		PortID   int    `xml:"portid,attr"`
+		State    struct {
+			State string `xml:"state,attr"`
+		} `xml:"state"`
+		Service *struct {
+			Name    string `xml:"name,attr"`
+			Banner  string `xml:"banner,attr"`
+			Product string `xml:"product,attr"`
+			Version string `xml:"version,attr"`
+		} `xml:"service"`
+	} `xml:"ports>port"`
+}
+
+// addr returns the host's IP address, ignoring any MAC address.
+func (h xmlHost) addr() string {
+	for _, a := range h.Addresses {
+		if a.AddrType == "ipv4" || a.AddrType == "ipv6" {
+			return a.Addr
+		}
+	}
+	return ""
+}
+
+// ParseXML parses masscan XML output (-oX).
+func ParseXML(r io.Reader) ([]Result, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Result{}
+	err = decodeHosts(data, func(h xmlHost) {
+		res := Result{IP: h.addr()}
+		for _, hp := range h.Ports {
+			p := Port{Port: hp.PortID, Proto: hp.Protocol, Status: hp.State.State}
+			// Banners are reported with an "open" state but they aren't a
+			// port status in their own right
+			if hp.Service != nil {
+				p.Status = ""
+				p.Service.Name = hp.Service.Name
+				p.Service.Banner = hp.Service.Banner
+			}
+			res.Ports = append(res.Ports, p)
+		}
+		results = append(results, res)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// ParseNmapXML parses nmap XML output (-oX). Only open ports are returned.
+// Service detection results (-sV) are preserved.
+func ParseNmapXML(r io.Reader) ([]Result, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Result{}
+	err = decodeHosts(data, func(h xmlHost) {
+		res := Result{IP: h.addr()}
+		for _, hp := range h.Ports {
+			if hp.State.State != "open" {
+				continue
+			}
+			p := Port{Port: hp.PortID, Proto: hp.Protocol, Status: hp.State.State}
+			if hp.Service != nil {
+				p.Service.Name = hp.Service.Name
+				p.Service.Product = hp.Service.Product
+				p.Service.Version = hp.Service.Version
+			}
+			res.Ports = append(res.Ports, p)
+		}
+		// Hosts which are up but have no open ports aren't interesting
+		if len(res.Ports) > 0 {
+			results = append(results, res)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// decodeHosts calls fn for each host element in the XML document data.
+func decodeHosts(data []byte, fn func(xmlHost)) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newSyntaxError(data, int(dec.InputOffset()), err)
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "host" {
+			continue
+		}
+
+		var h xmlHost
+		if err := dec.DecodeElement(&h, &se); err != nil {
+			return newSyntaxError(data, int(dec.InputOffset()), err)
+		}
+		if h.addr() == "" {
+			return newSyntaxError(data, int(dec.InputOffset()), errors.New("host has no IP address"))
+		}
+		fn(h)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+type policyData struct {
+	indexData
+	Policies []scan.Policy
+	Now      time.Time
+}
+
+// validatePolicy checks and normalises a policy submitted by a user.
+func validatePolicy(p scan.Policy) (scan.Policy, error) {
+	p.CIDR = strings.TrimSpace(p.CIDR)
+	p.Ports = strings.TrimSpace(p.Ports)
+	p.Proto = strings.ToLower(strings.TrimSpace(p.Proto))
+	p.Owner = strings.TrimSpace(p.Owner)
+	if p.CIDR == "" {
+		return p, errors.New("CIDR is required")
+	}
+	if p.Proto != "" && !scan.ValidProtocol(p.Proto) {
+		return p, fmt.Errorf("invalid protocol %q", p.Proto)
+	}
+	if _, err := p.Scope(); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// savePolicy stores a new policy on behalf of user, and records it in the
+// audit log.
+func (app *App) savePolicy(user User, p scan.Policy) (scan.Policy, error) {
+	p.Created = scan.Time{Time: time.Now().UTC().Truncate(time.Second)}
+	p.CreatedBy = user.Email
+	id, err := app.db.SavePolicy(p)
+	if err != nil {
+		return p, err
+	}
+	p.ID = id
+
+	app.audit(user.Email, "add_policy", fmt.Sprintf("%d %s %s %s", p.ID, p.CIDR, p.Ports, p.Proto))
+	return p, nil
+}
+
+// deletePolicy deletes a policy on behalf of user, and records it in the
+// audit log.
+func (app *App) deletePolicy(user User, id int64) error {
+	if err := app.db.DeletePolicy(id); err != nil {
+		return err
+	}
+	app.audit(user.Email, "delete_policy", strconv.FormatInt(id, 10))
+	return nil
+}
+
+// Handler for GET /policy
+// Lists the policies describing expected exposure.
+func (app *App) policy(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tmpl.ExecuteTemplate(w, "policy", policyData{indexData: indexData{URI: r.RequestURI}})
+		return
+	}
+	app.renderPolicy(w, r, user, nil)
+}
+
+func (app *App) renderPolicy(w http.ResponseWriter, r *http.Request, user User, errs []string) {
+	policies, err := app.db.LoadPolicies(sqlite.SQLFilter{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch result numbers for display in the navbar
+	results, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
+
+	data := policyData{
+		indexData: indexData{
+			Errors:        errs,
+			Authenticated: true,
+			User:          user,
+			URI:           r.URL.Path,
+			Data:          results,
+		},
+		Policies: policies,
+		Now:      time.Now(),
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	tmpl.ExecuteTemplate(w, "policy", data)
+}
+
+// Handler for POST /policy
+// Adds a policy from a form, or deletes one.
+func (app *App) updatePolicy(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := r.PostForm
+
+	if v := f.Get("delete"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid policy %q", v), http.StatusBadRequest)
+			return
+		}
+		err = app.deletePolicy(user, id)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "Policy does not exist", http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/policy", http.StatusSeeOther)
+		return
+	}
+
+	p := scan.Policy{
+		CIDR:  f.Get("cidr"),
+		Ports: f.Get("ports"),
+		Proto: f.Get("proto"),
+		Owner: f.Get("owner"),
+	}
+	if v := f.Get("expires"); v != "" {
+		expires, err := scan.ParseTime(v)
+		if err != nil {
+			app.renderPolicy(w, r, user, []string{fmt.Sprintf("Invalid expiry %q", v)})
+			return
+		}
+		p.Expires = scan.Time{Time: expires}
+	}
+	p, err = validatePolicy(p)
+	if err != nil {
+		app.renderPolicy(w, r, user, []string{err.Error()})
+		return
+	}
+	if _, err := app.savePolicy(user, p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/policy", http.StatusSeeOther)
+}
+
+// Handler for GET /api/v1/policies
+func (app *App) apiPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := app.db.LoadPolicies(sqlite.SQLFilter{})
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if policies == nil {
+		policies = []scan.Policy{}
+	}
+	render.JSON(w, r, policies)
+}
+
+// Handler for POST /api/v1/policies
+func (app *App) apiNewPolicy(w http.ResponseWriter, r *http.Request) {
+	user, _, err := sessionUser(r)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	var req struct {
+		scan.Policy
+		Expires string `json:"expires"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	p := req.Policy
+	if req.Expires != "" {
+		expires, err := scan.ParseTime(req.Expires)
+		if err != nil {
+			renderError(w, r, http.StatusBadRequest, fmt.Errorf("invalid expiry %q", req.Expires))
+			return
+		}
+		p.Expires = scan.Time{Time: expires}
+	}
+
+	p, err = validatePolicy(p)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	p, err = app.savePolicy(user, p)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, p)
+}
+
+// Handler for DELETE /api/v1/policies/{id}
+func (app *App) apiDeletePolicy(w http.ResponseWriter, r *http.Request) {
+	user, _, err := sessionUser(r)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, errors.New("invalid policy"))
+		return
+	}
+	err = app.deletePolicy(user, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		renderError(w, r, http.StatusNotFound, errors.New("policy does not exist"))
+		return
+	case err != nil:
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
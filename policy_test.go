@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestPolicy(t *testing.T) {
+	db := createDB("TestPolicy")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}, {Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.2", Ports: []scan.Port{{Port: 443, Proto: "tcp", Status: "open"}}},
+		{IP: "198.51.100.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+		{IP: "2001:db8::1", Ports: []scan.Port{{Port: 53, Proto: "udp", Status: "open"}}},
+	}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"cidr": {"192.0.2.0/24"}, "ports": {"80,443"}, "proto": {"tcp"}, "owner": {"web team"}}
+	r := httptest.NewRequest("POST", "/policy", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303, got %d: %s", w.Code, w.Body)
+	}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/policies", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	w = post(`{"cidr":"2001:db8::/32","ports":"U:53"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body)
+	}
+	// An expired policy has no effect
+	w = post(`{"cidr":"198.51.100.0/24","expires":"` + now.Add(-time.Hour).Format(time.RFC3339) + `"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body)
+	}
+	for _, body := range []string{
+		`{"ports":"80"}`,
+		`{"cidr":"192.0.2.0/33"}`,
+		`{"cidr":"192.0.2.0/24","ports":"http"}`,
+		`{"cidr":"192.0.2.0/24","proto":"gre"}`,
+		`{"cidr":"192.0.2.0/24","expires":"soon"}`,
+	} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+
+	results, err := db.LoadData(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"192.0.2.1:80":    true,
+		"192.0.2.1:22":    false,
+		"192.0.2.2:443":   true,
+		"198.51.100.1:80": false,
+		"2001:db8::1:53":  true,
+	}
+	for _, r := range results {
+		key := fmt.Sprintf("%s:%d", r.IP, r.Port)
+		if r.Expected != want[key] {
+			t.Errorf("%s: expected %v, got %v", key, want[key], r.Expected)
+		}
+	}
+
+	data, err := db.ResultData(sqlite.SQLFilter{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Unexpected != 2 {
+		t.Errorf("expected 2 unexpected results, got %d", data.Unexpected)
+	}
+
+	for query, want := range map[string]int{"policy=expected": 3, "policy=unexpected": 2, "q=unexpected+port:80": 1} {
+		r := httptest.NewRequest("GET", "/api/v1/results?"+query, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		var resp resultsResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != http.StatusOK || len(resp.Results) != want {
+			t.Errorf("%s: expected %d results, got status %d with %d", query, want, w.Code, len(resp.Results))
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/policies", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var policies []scan.Policy
+	if err := json.NewDecoder(w.Body).Decode(&policies); err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 3 || policies[0].Owner != "web team" || policies[2].Expires.IsZero() {
+		t.Fatalf("unexpected policies %+v", policies)
+	}
+
+	r = httptest.NewRequest("DELETE", "/api/v1/policies/1", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d: %s", w.Code, w.Body)
+	}
+	r = httptest.NewRequest("DELETE", "/api/v1/policies/1", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 deleting a deleted policy, got %d", w.Code)
+	}
+	data, err = db.ResultData(sqlite.SQLFilter{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Unexpected != 4 {
+		t.Errorf("expected 4 unexpected results after deleting the policy, got %d", data.Unexpected)
+	}
+
+	r = httptest.NewRequest("GET", "/policy", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "2001:db8::/32") || strings.Contains(body, "web team") {
+		t.Errorf("unexpected policy page: status %d", w.Code)
+	}
+	if !strings.Contains(body, "Expired") {
+		t.Errorf("expected the expired policy to be marked")
+	}
+}
+
+func TestLoadPolicies(t *testing.T) {
+	db := createDB("TestLoadPolicies")
+	defer db.Close()
+
+	for _, p := range []scan.Policy{
+		{CIDR: "192.0.2.0/24", Ports: "80", Owner: "web team"},
+		{CIDR: "198.51.100.0/24", Ports: "22", Owner: "ops"},
+	} {
+		if _, err := db.SavePolicy(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policies, err := db.LoadPolicies(sqlite.SQLFilter{
+		Where:  []string{"owner = ?"},
+		Values: []interface{}{"ops"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].CIDR != "198.51.100.0/24" {
+		t.Errorf("expected the ops policy, got %+v", policies)
+	}
+}
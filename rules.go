@@ -0,0 +1,517 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// ruleTestSize is the number of recent submissions a rule is tested against.
+const ruleTestSize = 100
+
+type rulesData struct {
+	indexData
+	Rules     []scan.Rule
+	RuleNames map[int64]string
+	Silences  []scan.Silence
+	Webhooks  map[int64]scan.Webhook
+	Email     bool
+	Now       time.Time
+}
+
+type ruleTestData struct {
+	indexData
+	Rule    scan.Rule
+	Size    int
+	Results []ruleTestResult
+}
+
+// ruleTestResult is how a rule would have treated a past submission.
+type ruleTestResult struct {
+	Submission scan.SubmissionSummary
+	Matched    []scan.IPInfo
+	Fired      bool
+	Silenced   bool
+}
+
+// ruleFromForm reads a rule from form values. Errors are only returned for
+// values which can't be parsed; validateRule checks the rule makes sense.
+func ruleFromForm(f url.Values) (scan.Rule, error) {
+	r := scan.Rule{
+		Name:           f.Get("name"),
+		CIDR:           f.Get("cidr"),
+		Ports:          f.Get("ports"),
+		Proto:          f.Get("proto"),
+		UnexpectedOnly: f.Get("unexpected") != "",
+		MinPorts:       1,
+		Webhooks:       []int64{},
+		Email:          f.Get("email") != "",
+	}
+	if v := f.Get("min_ports"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return r, fmt.Errorf("invalid minimum ports %q", v)
+		}
+		r.MinPorts = n
+	}
+	for _, v := range f["webhook"] {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return r, fmt.Errorf("invalid webhook %q", v)
+		}
+		r.Webhooks = append(r.Webhooks, id)
+	}
+	return r, nil
+}
+
+// validateRule checks and normalises a rule submitted by a user. Every rule
+// must alert somewhere.
+func (app *App) validateRule(r scan.Rule) (scan.Rule, error) {
+	r.Name = strings.TrimSpace(r.Name)
+	r.CIDR = strings.TrimSpace(r.CIDR)
+	r.Ports = strings.TrimSpace(r.Ports)
+	r.Proto = strings.ToLower(strings.TrimSpace(r.Proto))
+	if r.Name == "" {
+		return r, errors.New("name is required")
+	}
+	if r.Proto != "" && !scan.ValidProtocol(r.Proto) {
+		return r, fmt.Errorf("invalid protocol %q", r.Proto)
+	}
+	if _, err := r.Scope(); err != nil {
+		return r, err
+	}
+	if r.MinPorts < 1 {
+		return r, errors.New("minimum ports must be at least 1")
+	}
+	if len(r.Webhooks) == 0 && !r.Email {
+		return r, errors.New("a rule must alert a webhook or email")
+	}
+	if r.Email && app.mailer == nil {
+		return r, errors.New("email isn't configured")
+	}
+
+	hooks, err := app.db.LoadWebhooks()
+	if err != nil {
+		return r, err
+	}
+	exists := make(map[int64]bool)
+	for _, h := range hooks {
+		exists[h.ID] = true
+	}
+	for _, id := range r.Webhooks {
+		if !exists[id] {
+			return r, fmt.Errorf("webhook %d does not exist", id)
+		}
+	}
+	return r, nil
+}
+
+// matchRule returns the opened ports which match the rule, and whether there
+// are enough of them for it to fire.
+func matchRule(rule scan.Rule, opened []scan.IPInfo) ([]scan.IPInfo, bool, error) {
+	scope, err := rule.Scope()
+	if err != nil {
+		return nil, false, err
+	}
+	matched := []scan.IPInfo{}
+	for _, r := range opened {
+		if rule.UnexpectedOnly && r.Expected {
+			continue
+		}
+		if scope.Contains(r.IP, r.Port, r.Proto) {
+			matched = append(matched, r)
+		}
+	}
+	return matched, len(matched) > 0 && len(matched) >= rule.MinPorts, nil
+}
+
+// silenced reports whether any of the silences stop the rule firing at t.
+func silenced(silences []scan.Silence, rule int64, t time.Time) bool {
+	for _, s := range silences {
+		if s.Silences(rule, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// alertRules fires each rule the notification matches, sending the ports
+// which matched to the rule's webhooks and email. Firings are recorded in the
+// audit log, including those which were silenced.
+func (app *App) alertRules(rules []scan.Rule, hooks []scan.Webhook, n scan.Notification) {
+	if len(rules) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	silences, err := app.db.LoadSilences(sqlite.SQLFilter{Where: []string{`ends > ?`}, Values: []interface{}{now}})
+	if err != nil {
+		log.Println("alertRules: couldn't load silences:", err)
+	}
+	byID := make(map[int64]scan.Webhook)
+	for _, h := range hooks {
+		byID[h.ID] = h
+	}
+
+	for _, rule := range rules {
+		matched, fire, err := matchRule(rule, n.Opened)
+		if err != nil {
+			log.Printf("alertRules: invalid rule %d: %v", rule.ID, err)
+			continue
+		}
+		if !fire {
+			continue
+		}
+		info := fmt.Sprintf("%d %s: %d ports in submission %d", rule.ID, rule.Name, len(matched), n.Submission.ID)
+		if silenced(silences, rule.ID, now) {
+			app.audit("", "rule", info+" (silenced)")
+			continue
+		}
+		app.audit("", "rule", info)
+
+		alert := scan.Notification{Rule: rule.Name, Submission: n.Submission, Opened: matched, Closed: []scan.IPInfo{}}
+		for _, id := range rule.Webhooks {
+			if h, ok := byID[id]; ok {
+				app.sendWebhook(h, alert)
+			}
+		}
+		if rule.Email && app.mailer != nil {
+			app.sendAlert(alert)
+		}
+	}
+}
+
+// ruleHistory runs the rule against up to limit recent submissions, returning
+// those with ports which matched it. A port is opened by a submission if it
+// wasn't seen in the previous submission with the same scope. Whether ports
+// are expected is judged by the policies in force now.
+func (app *App) ruleHistory(rule scan.Rule, limit int) ([]ruleTestResult, error) {
+	subs, err := app.db.LoadSubmissions(sqlite.SQLFilter{}, limit)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := app.db.LoadPolicies(sqlite.SQLFilter{})
+	if err != nil {
+		return nil, err
+	}
+	silences, err := app.db.LoadSilences(sqlite.SQLFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var covered []scan.Scope
+	for _, p := range policies {
+		if p.Expired(now) {
+			continue
+		}
+		if scope, err := p.Scope(); err == nil {
+			covered = append(covered, scope)
+		}
+	}
+	expected := func(o scan.Observation) bool {
+		for _, s := range covered {
+			if s.Contains(o.IP, o.Port, o.Proto) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var results []ruleTestResult
+	for _, sub := range subs {
+		diff, err := app.db.DiffSubmissions(sub.Previous, sub.ID)
+		if err != nil {
+			return nil, err
+		}
+		opened := make([]scan.IPInfo, len(diff.Added))
+		for i, o := range diff.Added {
+			opened[i] = scan.IPInfo{IP: o.IP, Port: o.Port, Proto: o.Proto, Expected: expected(o)}
+		}
+		matched, fired, err := matchRule(rule, opened)
+		if err != nil {
+			return nil, err
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		results = append(results, ruleTestResult{
+			Submission: sub,
+			Matched:    matched,
+			Fired:      fired,
+			Silenced:   fired && silenced(silences, rule.ID, sub.Time.Time),
+		})
+	}
+	return results, nil
+}
+
+// saveRule stores a new rule on behalf of user, and records it in the audit
+// log.
+func (app *App) saveRule(user User, r scan.Rule) (scan.Rule, error) {
+	r.Created = scan.Time{Time: time.Now().UTC().Truncate(time.Second)}
+	r.CreatedBy = user.Email
+	id, err := app.db.SaveRule(r)
+	if err != nil {
+		return r, err
+	}
+	r.ID = id
+
+	app.audit(user.Email, "add_rule", fmt.Sprintf("%d %s", r.ID, r.Name))
+	return r, nil
+}
+
+// saveSilence stores a new silence on behalf of user, and records it in the
+// audit log.
+func (app *App) saveSilence(user User, s scan.Silence) (scan.Silence, error) {
+	s.CreatedBy = user.Email
+	id, err := app.db.SaveSilence(s)
+	if err != nil {
+		return s, err
+	}
+	s.ID = id
+
+	app.audit(user.Email, "add_silence", fmt.Sprintf("%d rule %d until %s", s.ID, s.Rule, s.Ends))
+	return s, nil
+}
+
+// Handler for GET /rules
+// Lists the alert rules and silences.
+func (app *App) rules(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tmpl.ExecuteTemplate(w, "rules", rulesData{indexData: indexData{URI: r.RequestURI}})
+		return
+	}
+	app.renderRules(w, r, user, nil)
+}
+
+func (app *App) renderRules(w http.ResponseWriter, r *http.Request, user User, errs []string) {
+	rules, err := app.db.LoadRules()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	silences, err := app.db.LoadSilences(sqlite.SQLFilter{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hooks, err := app.db.LoadWebhooks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	byID := make(map[int64]scan.Webhook)
+	for _, h := range hooks {
+		byID[h.ID] = h
+	}
+	names := make(map[int64]string)
+	for _, rule := range rules {
+		names[rule.ID] = rule.Name
+	}
+
+	// Fetch result numbers for display in the navbar
+	results, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
+
+	data := rulesData{
+		indexData: indexData{
+			Errors:        errs,
+			Authenticated: true,
+			User:          user,
+			URI:           r.URL.Path,
+			Data:          results,
+		},
+		Rules:     rules,
+		RuleNames: names,
+		Silences:  silences,
+		Webhooks:  byID,
+		Email:     app.mailer != nil,
+		Now:       time.Now(),
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	tmpl.ExecuteTemplate(w, "rules", data)
+}
+
+// Handler for POST /rules
+// Adds or deletes a rule or silence.
+func (app *App) updateRules(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := r.PostForm
+
+	switch {
+	case f.Get("delete") != "":
+		id, err := strconv.ParseInt(f.Get("delete"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid rule %q", f.Get("delete")), http.StatusBadRequest)
+			return
+		}
+		err = app.db.DeleteRule(id)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "Rule does not exist", http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		app.audit(user.Email, "delete_rule", strconv.FormatInt(id, 10))
+
+	case f.Get("delete_silence") != "":
+		id, err := strconv.ParseInt(f.Get("delete_silence"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid silence %q", f.Get("delete_silence")), http.StatusBadRequest)
+			return
+		}
+		err = app.db.DeleteSilence(id)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "Silence does not exist", http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		app.audit(user.Email, "delete_silence", strconv.FormatInt(id, 10))
+
+	case f.Get("silence_ends") != "":
+		s := scan.Silence{Comment: strings.TrimSpace(f.Get("silence_comment"))}
+		s.Rule, err = strconv.ParseInt(f.Get("silence_rule"), 10, 64)
+		if err != nil {
+			app.renderRules(w, r, user, []string{fmt.Sprintf("Invalid rule %q", f.Get("silence_rule"))})
+			return
+		}
+		starts := time.Now().UTC().Truncate(time.Second)
+		if v := f.Get("silence_starts"); v != "" {
+			if starts, err = scan.ParseTime(v); err != nil {
+				app.renderRules(w, r, user, []string{fmt.Sprintf("Invalid start %q", v)})
+				return
+			}
+		}
+		ends, err := scan.ParseTime(f.Get("silence_ends"))
+		if err != nil {
+			app.renderRules(w, r, user, []string{fmt.Sprintf("Invalid end %q", f.Get("silence_ends"))})
+			return
+		}
+		if !ends.After(starts) {
+			app.renderRules(w, r, user, []string{"A silence must end after it starts"})
+			return
+		}
+		s.Starts, s.Ends = scan.Time{Time: starts}, scan.Time{Time: ends}
+		if _, err := app.saveSilence(user, s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		rule, err := ruleFromForm(f)
+		if err == nil {
+			rule, err = app.validateRule(rule)
+		}
+		if err != nil {
+			app.renderRules(w, r, user, []string{err.Error()})
+			return
+		}
+		if _, err := app.saveRule(user, rule); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/rules", http.StatusSeeOther)
+}
+
+// Handler for GET /rules/test
+// Shows which recent submissions a rule would have fired for. The rule is
+// either a saved rule given by id, or given by the same fields as the form
+// to add one.
+func (app *App) testRule(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tmpl.ExecuteTemplate(w, "rule_test", ruleTestData{indexData: indexData{URI: r.RequestURI}})
+		return
+	}
+
+	q := r.URL.Query()
+	var rule scan.Rule
+	if v := q.Get("id"); v != "" {
+		rules, err := app.db.LoadRules()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, rl := range rules {
+			if strconv.FormatInt(rl.ID, 10) == v {
+				rule = rl
+			}
+		}
+		if rule.ID == 0 {
+			http.Error(w, "Rule does not exist", http.StatusNotFound)
+			return
+		}
+	} else {
+		rule, err = ruleFromForm(q)
+		if err == nil && rule.MinPorts < 1 {
+			err = errors.New("minimum ports must be at least 1")
+		}
+		if err == nil {
+			_, err = rule.Scope()
+		}
+		if err != nil {
+			app.renderRules(w, r, user, []string{err.Error()})
+			return
+		}
+	}
+
+	results, err := app.ruleHistory(rule, ruleTestSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Fetch result numbers for display in the navbar
+	navbar, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
+
+	data := ruleTestData{
+		indexData: indexData{
+			Authenticated: true,
+			User:          user,
+			URI:           r.URL.Path,
+			Data:          navbar,
+		},
+		Rule:    rule,
+		Size:    ruleTestSize,
+		Results: results,
+	}
+	tmpl.ExecuteTemplate(w, "rule_test", data)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestRules(t *testing.T) {
+	db := createDB("TestRules")
+	defer db.Close()
+	app := &App{db: db}
+	mux := app.setupRouter()
+
+	var mu sync.Mutex
+	received := make(map[string][]scan.Notification)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var n scan.Notification
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &n)
+		received[r.URL.Path] = append(received[r.URL.Path], n)
+	}))
+	defer receiver.Close()
+
+	for _, path := range []string{"/security", "/everything"} {
+		if _, err := db.SaveWebhook(scan.Webhook{URL: receiver.URL + path, Format: scan.WebhookJSON}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	postForm := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/rules", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	for _, form := range []url.Values{
+		{"name": {"RDP"}, "cidr": {"10.0.0.0/8"}, "ports": {"3389"}, "webhook": {"1"}},
+		{"name": {"Bulk"}, "min_ports": {"4"}, "webhook": {"1"}},
+	} {
+		if w := postForm(form); w.Code != http.StatusSeeOther {
+			t.Fatalf("%v: expected status 303, got %d: %s", form, w.Code, w.Body)
+		}
+	}
+	for _, form := range []url.Values{
+		{"cidr": {"10.0.0.0/8"}, "webhook": {"1"}},
+		{"name": {"Nowhere"}},
+		{"name": {"Missing"}, "webhook": {"9"}},
+		{"name": {"Email"}, "email": {"1"}},
+		{"name": {"Zero"}, "min_ports": {"0"}, "webhook": {"1"}},
+		{"name": {"Bad"}, "cidr": {"10.0.0.0/33"}, "webhook": {"1"}},
+	} {
+		if w := postForm(form); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected status 400, got %d", form, w.Code)
+		}
+	}
+
+	submit := func(data string) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/results", strings.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+		app.pending.Wait()
+	}
+	submit(`[{"ip":"10.0.0.1","ports":[{"port":3389,"proto":"tcp","status":"open"}]},{"ip":"198.51.100.1","ports":[{"port":80,"proto":"tcp","status":"open"}]}]`)
+
+	if got := received["/security"]; len(got) != 1 || got[0].Rule != "RDP" || len(got[0].Opened) != 1 || got[0].Opened[0].IP != "10.0.0.1" {
+		t.Errorf("expected one RDP alert for 10.0.0.1, got %+v", got)
+	}
+	if got := received["/everything"]; len(got) != 1 || got[0].Rule != "" || len(got[0].Opened) != 2 {
+		t.Errorf("expected the unrouted webhook to get the whole submission, got %+v", got)
+	}
+
+	until := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	if w := postForm(url.Values{"silence_rule": {"1"}, "silence_ends": {until}, "silence_comment": {"Migration"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303, got %d: %s", w.Code, w.Body)
+	}
+	if w := postForm(url.Values{"silence_rule": {"1"}, "silence_starts": {until}, "silence_ends": {until}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a silence ending when it starts, got %d", w.Code)
+	}
+
+	submit(`[{"ip":"10.0.0.2","ports":[{"port":3389,"proto":"tcp","status":"open"}]}]`)
+	if got := received["/security"]; len(got) != 1 {
+		t.Errorf("expected the silenced rule not to alert, got %d alerts", len(got))
+	}
+	var firings int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM audit WHERE action = 'rule' AND info LIKE '%(silenced)'`).Scan(&firings); err != nil {
+		t.Fatal(err)
+	}
+	if firings != 1 {
+		t.Errorf("expected 1 silenced firing in the audit log, got %d", firings)
+	}
+
+	t.Run("Test", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/rules/test?id=1", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(body, "10.0.0.1") || !strings.Contains(body, "10.0.0.2") || strings.Contains(body, "198.51.100.1") {
+			t.Errorf("expected both RDP ports in the test, got status %d", w.Code)
+		}
+
+		r = httptest.NewRequest("GET", "/rules/test?name=Web&cidr=198.51.100.0/24&min_ports=2", nil)
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		body = w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(body, "198.51.100.1") || !strings.Contains(body, "Too few ports") {
+			t.Errorf("expected an unsaved rule to be tested, got status %d", w.Code)
+		}
+
+		r = httptest.NewRequest("GET", "/rules/test?id=9", nil)
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 testing a rule which doesn't exist, got %d", w.Code)
+		}
+	})
+
+	if w := postForm(url.Values{"delete": {"1"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303, got %d: %s", w.Code, w.Body)
+	}
+	silences, err := db.LoadSilences(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(silences) != 0 {
+		t.Errorf("expected the rule's silences to be deleted with it, got %+v", silences)
+	}
+}
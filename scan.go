@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"crypto/tls"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -16,16 +15,19 @@ import (
 	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
 
 	"github.com/jamesog/scan/internal/sqlite"
 	"github.com/jamesog/scan/pkg/scan"
@@ -38,6 +40,9 @@ var (
 	dataDir      string
 	httpsAddr    string
 	verbose      bool
+	baseURL      string
+	jobLease     time.Duration
+	jobExpiry    time.Duration
 
 	// HTML templates
 	tmpl *template.Template
@@ -45,17 +50,55 @@ var (
 
 type storage interface {
 	LoadData(filter sqlite.SQLFilter) ([]scan.IPInfo, error)
-	ResultData(ip, fs, ls string) (scan.Data, error)
-	SaveData(results []scan.Result, now time.Time) (int64, error)
+	EachData(filter sqlite.SQLFilter, fn func(scan.IPInfo) error) error
+	DiffData(filter sqlite.SQLFilter, from, to time.Time) (scan.Diff, error)
+	LoadDataPage(filter sqlite.SQLFilter, page sqlite.Page) ([]scan.IPInfo, string, error)
+	ResultData(filter sqlite.SQLFilter, fs, ls string) (scan.Data, error)
 	LoadSubmission(filter sqlite.SQLFilter) (scan.Submission, error)
-	SaveSubmission(host string, job *int64, now time.Time) error
+	LoadSubmissions(filter sqlite.SQLFilter, limit int) ([]scan.SubmissionSummary, error)
+	PreviousSubmission(id int64) (int64, error)
+	DiffSubmissions(from, to int64) (scan.SubmissionDiff, error)
+	LoadObservations(filter sqlite.SQLFilter) ([]scan.Observation, error)
+	SaveResults(sub scan.Submission, results []scan.Result, closeScope *scan.Scope, node string) (count, id int64, reset []scan.Triage, err error)
 	LoadTracerouteIPs() (map[string]struct{}, error)
 	LoadTraceroute(dest string) (string, error)
 	SaveTraceroute(dest, trace string) error
+	LoadBanners(filter sqlite.SQLFilter) ([]scan.Banner, error)
+	LoadTriage(ip string, port int, proto string) (scan.Triage, error)
+	SaveTriage(t scan.Triage) error
+	LoadPolicies(filter sqlite.SQLFilter) ([]scan.Policy, error)
+	SavePolicy(p scan.Policy) (int64, error)
+	DeletePolicy(id int64) error
+	LoadWebhooks() ([]scan.Webhook, error)
+	SaveWebhook(h scan.Webhook) (int64, error)
+	DeleteWebhook(id int64) error
+	LoadDeliveries(limit int) ([]scan.Delivery, error)
+	SaveDelivery(d scan.Delivery) error
+	LoadRules() ([]scan.Rule, error)
+	SaveRule(r scan.Rule) (int64, error)
+	DeleteRule(id int64) error
+	LoadSilences(filter sqlite.SQLFilter) ([]scan.Silence, error)
+	SaveSilence(s scan.Silence) (int64, error)
+	DeleteSilence(id int64) error
+	LoadNotes(ip string) ([]scan.Note, error)
+	SaveNote(note scan.Note) error
+	LoadTags(ip string) ([]string, error)
+	SaveTag(ip, tag string) error
+	DeleteTag(ip, tag string) error
 	LoadJobs(filter sqlite.SQLFilter) ([]scan.Job, error)
+	CountJobStates() (map[string]int, error)
 	LoadJobSubmission() (scan.Submission, error)
-	SaveJob(cidr, ports, proto, user string) (int64, error)
-	UpdateJob(id string, count int64) error
+	SaveJob(cidr, ports, proto, user string, chunks ...scan.JobChunk) (int64, error)
+	ClaimJob(id int64, node string, now, expires time.Time) error
+	FailJob(id int64, node, msg string, now time.Time) error
+	CancelJob(id int64, now time.Time) error
+	ExpireLeases(now time.Time) ([]int64, error)
+	ExpireJobs(before, now time.Time) ([]int64, error)
+	LoadSchedules(filter sqlite.SQLFilter) ([]scan.Schedule, error)
+	SaveSchedule(s scan.Schedule) (int64, error)
+	PauseSchedule(id int64, paused bool, next time.Time) error
+	SaveScheduleRun(id int64, ran time.Time, job int64, next time.Time) error
+	DeleteSchedule(id int64) error
 	LoadUsers() ([]string, error)
 	LoadGroups() ([]string, error)
 	UserExists(email string) (bool, error)
@@ -70,13 +113,45 @@ type indexData struct {
 	Authenticated bool
 	User          User
 	URI           string
+	RawQuery      string
+	Search        string
+	AsOf          scan.Time
 	AllResults    bool
 	Submission    scan.Submission
 	scan.Data
 }
 
 type App struct {
-	db storage
+	db     storage
+	mailer *mailer
+
+	// Notifications being delivered in the background
+	pending sync.WaitGroup
+}
+
+// indexQuery returns the query of the results shown on the index page.
+func indexQuery(q url.Values) string {
+	// ip is the search parameter used before queries could contain more
+	// than addresses
+	return strings.TrimSpace(q.Get("q") + " " + q.Get("ip"))
+}
+
+// indexFilter returns the filter for the results shown on the index page,
+// and the time of the snapshot if the asof parameter is set.
+func indexFilter(q url.Values) (sqlite.SQLFilter, time.Time, error) {
+	filter, err := sqlite.ParseQuery(indexQuery(q))
+	if err != nil {
+		return filter, time.Time{}, err
+	}
+	var asof time.Time
+	if v := q.Get("asof"); v != "" {
+		asof, err = scan.ParseTime(v)
+		if err != nil {
+			return filter, asof, fmt.Errorf("asof: %w", err)
+		}
+		filter = filter.And(sqlite.AsOfFilter(asof))
+	}
+	return filter, asof, nil
 }
 
 // Handler for GET /
@@ -108,17 +183,9 @@ func (app *App) index(w http.ResponseWriter, r *http.Request) {
 	}
 
 	q := r.URL.Query()
-	ip := q.Get("ip")
-	firstSeen := q.Get("firstseen")
-	lastSeen := q.Get("lastseen")
+	search := indexQuery(q)
 	_, allResults := q["all"]
 
-	results, err := app.db.ResultData(ip, firstSeen, lastSeen)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	sub, err := app.db.LoadSubmission(sqlite.SQLFilter{})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -129,30 +196,115 @@ func (app *App) index(w http.ResponseWriter, r *http.Request) {
 		Authenticated: true,
 		User:          user,
 		URI:           r.URL.Path,
+		RawQuery:      r.URL.RawQuery,
+		Search:        search,
 		AllResults:    allResults,
 		Submission:    sub,
-		Data:          results,
 	}
+
+	filter, asof, err := indexFilter(q)
+	if err != nil {
+		data.Errors = append(data.Errors, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		tmpl.ExecuteTemplate(w, "index", data)
+		return
+	}
+	if !asof.IsZero() {
+		// In snapshot mode show everything which was open at the time,
+		// even if it has closed since
+		data.AsOf = scan.Time{Time: asof}
+		data.AllResults = true
+	}
+
+	data.Data, err = app.db.ResultData(filter, q.Get("firstseen"), q.Get("lastseen"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	tmpl.ExecuteTemplate(w, "index", data)
 }
 
-func (app *App) saveResults(w http.ResponseWriter, r *http.Request, now time.Time) (int64, error) {
-	if r.Header.Get("Content-Type") != "application/json" {
+// resultParsers maps each supported Content-Type to the parser for that
+// results format.
+var resultParsers = map[string]func(io.Reader) ([]scan.Result, error){
+	"application/json":        scan.ParseJSON,
+	"text/x-masscan-list":     scan.ParseList,
+	"text/x-masscan-grepable": scan.ParseGrepable,
+	"application/xml":         scan.ParseXML,
+	"text/xml":                scan.ParseXML,
+	"application/x-nmap+xml":  scan.ParseNmapXML,
+}
+
+// saveResults stores the results in the request body and records the
+// submission. job is nil for results which weren't requested by a job, and is
+// otherwise marked as done. Previously seen ports within the scope of the scan
+// which weren't in the results are marked as closed.
+//
+// The scope of a job is the job's CIDR, ports and protocol. Other submissions
+// may declare their scope with the cidr, ports and proto query parameters.
+// Submissions without a scope are assumed to cover everything.
+func (app *App) saveResults(w http.ResponseWriter, r *http.Request, job *scan.Job, now time.Time) (int64, error) {
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	parse, ok := resultParsers[ct]
+	if err != nil || !ok {
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		return 0, errors.New("invalid Content-Type")
 	}
 
-	res := new([]scan.Result)
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	sub := scan.Submission{Host: ip, Time: scan.Time{Time: now}}
+	var node string
+	if job != nil {
+		node = jobNode(r)
+		sub.Job = int64(job.ID)
+		sub.CIDR, sub.Ports, sub.Proto = job.CIDR, job.Ports, job.Proto
+	} else {
+		q := r.URL.Query()
+		sub.CIDR, sub.Ports, sub.Proto = q.Get("cidr"), q.Get("ports"), strings.ToLower(q.Get("proto"))
+	}
+
+	var closeScope *scan.Scope
+	scope, err := sub.Scope()
+	switch {
+	case err != nil && job == nil:
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, fmt.Errorf("invalid scope: %w", err)
+	case err != nil:
+		// Jobs created before their scope was validated could contain
+		// anything
+		log.Printf("saveResults: not closing ports, couldn't parse scope of job %d: %v", job.ID, err)
+	default:
+		closeScope = &scope
+	}
 
-	err := json.NewDecoder(r.Body).Decode(&res)
+	res, err := parse(r.Body)
 	if err != nil {
+		var se *scan.SyntaxError
+		if errors.As(err, &se) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
 		return 0, err
 	}
 
-	count, err := app.db.SaveData(*res, now)
+	count, id, reset, err := app.db.SaveResults(sub, res, closeScope, node)
 	if err != nil {
 		return 0, err
 	}
+	for _, t := range reset {
+		app.audit("", "triage", fmt.Sprintf("%s %d/%s %s: %s", t.IP, t.Port, t.Proto, t.State, t.Comment))
+	}
+
+	sub.ID = id
+	n, err := app.notification(sub, now)
+	if err != nil {
+		log.Println("saveResults: couldn't build notification:", err)
+	} else {
+		app.notify(n)
+	}
 
 	return count, nil
 }
@@ -160,25 +312,15 @@ func (app *App) saveResults(w http.ResponseWriter, r *http.Request, now time.Tim
 // Handler for POST /results
 func (app *App) recvResults(w http.ResponseWriter, r *http.Request) {
 	now := time.Now().UTC().Truncate(time.Second)
-	_, err := app.saveResults(w, r, now)
+	_, err := app.saveResults(w, r, nil, now)
 	if err != nil {
 		log.Println("recvResults: error saving results:", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		ip = r.RemoteAddr
-	}
-	err = app.db.SaveSubmission(ip, nil, now)
-	if err != nil {
-		log.Println("recvResults: error saving submission:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 
 	// Update metrics with latest data
-	results, err := app.db.ResultData("", "", "")
+	results, err := app.db.ResultData(sqlite.SQLFilter{}, "", "")
 	if err != nil {
 		log.Printf("saveResults: error fetching results for metrics update: %v\n", err)
 	} else {
@@ -186,6 +328,7 @@ func (app *App) recvResults(w http.ResponseWriter, r *http.Request) {
 		gaugeTotal.Set(float64(results.Total))
 		gaugeLatest.Set(float64(results.Latest))
 		gaugeNew.Set(float64(results.New))
+		gaugeUnexpected.Set(float64(results.Unexpected))
 	}
 }
 
@@ -230,6 +373,49 @@ func (app *App) traceroute(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, path)
 }
 
+// Handler for GET /banner/{ip}
+// The history can be narrowed to a single port with the port and proto query
+// parameters.
+func (app *App) banner(w http.ResponseWriter, r *http.Request) {
+	_, ok, err := sessionUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		render.JSON(w, r, err.Error())
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		render.JSON(w, r, "login required")
+		return
+	}
+
+	filter := sqlite.SQLFilter{
+		Where:  []string{"ip=?"},
+		Values: []interface{}{chi.URLParam(r, "ip")},
+	}
+	q := r.URL.Query()
+	if port := q.Get("port"); port != "" {
+		filter.Where = append(filter.Where, "port=?")
+		filter.Values = append(filter.Values, port)
+	}
+	if proto := q.Get("proto"); proto != "" {
+		filter.Where = append(filter.Where, "proto=?")
+		filter.Values = append(filter.Values, proto)
+	}
+
+	banners, err := app.db.LoadBanners(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		render.JSON(w, r, err.Error())
+		return
+	}
+	if len(banners) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	render.JSON(w, r, banners)
+}
+
 // redirectHTTPS is a middleware for redirecting non-HTTPS requests to HTTPS
 func redirectHTTPS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -306,23 +492,50 @@ func (app *App) setupRouter(middlewares ...func(http.Handler) http.Handler) *chi
 	assets = loadAssetsFromDir("static")
 
 	r.Get("/", app.index)
+	r.Mount("/api/v1", app.apiRouter())
 	r.Route("/admin", func(r chi.Router) {
 		r.Get("/", app.adminHandler)
 		r.Post("/", app.adminHandler)
 	})
 	r.Get("/auth", app.authHandler)
+	r.Get("/banner/{ip}", app.banner)
+	r.Get("/diff", app.diff)
+	r.Get("/export.{format}", app.export)
+	r.Get("/history/{ip}", app.history)
+	r.Get("/ip/{ip}", app.host)
+	r.Post("/ip/{ip}", app.updateHost)
 	r.Route("/job", func(r chi.Router) {
 		r.Get("/", app.newJob)
 		r.Post("/", app.newJob)
 	})
-	r.Get("/jobs", app.jobs)
+	r.Route("/jobs", func(r chi.Router) {
+		r.Get("/", app.jobs)
+		r.Post("/{id}/claim", app.claimJob)
+		r.Post("/{id}/fail", app.failJob)
+	})
 	r.Get("/login", app.loginHandler)
 	r.Get("/logout", app.logoutHandler)
+	r.Get("/policy", app.policy)
+	r.Post("/policy", app.updatePolicy)
 	r.Post("/results", app.recvResults)
+	r.Route("/rules", func(r chi.Router) {
+		r.Get("/", app.rules)
+		r.Post("/", app.updateRules)
+		r.Get("/test", app.testRule)
+	})
 	r.Put("/results/{id}", app.recvJobResults)
+	r.Route("/schedules", func(r chi.Router) {
+		r.Get("/", app.schedules)
+		r.Post("/", app.updateSchedules)
+	})
 	r.Get("/static/*", staticHandler)
+	r.Route("/submissions", func(r chi.Router) {
+		r.Get("/", app.submissions)
+		r.Get("/{id}", app.submissionDiff)
+	})
 	r.Post("/traceroute", app.recvTraceroute)
 	r.Get("/traceroute/{ip}", app.traceroute)
+	r.Post("/triage", app.triage)
 
 	return r
 }
@@ -332,6 +545,14 @@ func setupTemplates() {
 		"join": func(sep string, s []string) string {
 			return strings.Join(s, sep)
 		},
+		// emailPorts is the data for the emailPorts template, which needs
+		// the base URL for links as well as the results
+		"emailPorts": func(baseURL string, results []scan.IPInfo) interface{} {
+			return struct {
+				BaseURL string
+				Results []scan.IPInfo
+			}{baseURL, results}
+		},
 	}
 
 	tmpl = template.New("").Funcs(funcMap)
@@ -366,6 +587,21 @@ func main() {
 	enableTLS := flag.Bool("tls", false, "Enable AutoTLS")
 	tlsHostname := flag.String("tls.hostname", "", "(Optional) Restrict AutoTLS to `hostname`")
 	flag.BoolVar(&verbose, "v", false, "Enable verbose logging")
+	flag.StringVar(&baseURL, "url", "", "External `URL` of the server, used for links in notifications")
+	flag.DurationVar(&jobLease, "job.lease", time.Hour, "`Duration` a node may run a job it claimed for before the job is requeued")
+	flag.DurationVar(&jobExpiry, "job.expiry", 7*24*time.Hour, "`Duration` a job may be queued for before it expires, or 0 to queue jobs forever")
+	flag.Int64Var(&scan.MaxJobAddresses, "job.max-addresses", scan.MaxJobAddresses, "Largest `number` of addresses a job may scan")
+	smtpAddr := flag.String("smtp.addr", "", "SMTP server `address`:port to send email through\n"+
+		"Email is disabled if this isn't set")
+	smtpFrom := flag.String("smtp.from", "", "Sender email `address`")
+	smtpTo := flag.String("smtp.to", "", "Comma-separated email `addresses` to send to")
+	smtpUser := flag.String("smtp.user", "", "SMTP `username`\n"+
+		"The password is read from the SCAN_SMTP_PASSWORD environment variable")
+	smtpTLS := flag.String("smtp.tls", "starttls", "SMTP TLS `mode`: starttls, tls or none")
+	smtpAlerts := flag.Bool("smtp.alerts", true, "Email after each submission which opens unexpected ports or closes ports")
+	smtpDigest := flag.String("smtp.digest", "", "Email a digest every `period`: daily or weekly")
+	smtpDigestHour := flag.Int("smtp.digest.hour", 8, "`Hour` of the day to send the digest\n"+
+		"Weekly digests are sent on Mondays")
 	flag.Parse()
 
 	// Disable TLS on metrics if TLS wasn't generally enabled as autocert
@@ -389,6 +625,31 @@ func main() {
 	}
 	app := &App{db: db}
 
+	if *smtpAddr != "" {
+		switch *smtpTLS {
+		case "starttls", "tls", "none":
+		default:
+			log.Fatalf("invalid -smtp.tls %q", *smtpTLS)
+		}
+		if _, ok := digestPeriods[*smtpDigest]; *smtpDigest != "" && !ok {
+			log.Fatalf("invalid -smtp.digest %q", *smtpDigest)
+		}
+		app.mailer = &mailer{
+			Addr:     *smtpAddr,
+			From:     *smtpFrom,
+			To:       strings.Split(*smtpTo, ","),
+			Username: *smtpUser,
+			Password: os.Getenv("SCAN_SMTP_PASSWORD"),
+			TLS:      *smtpTLS,
+			Alerts:   *smtpAlerts,
+		}
+		if *smtpDigest != "" {
+			go app.runDigests(*smtpDigest, *smtpDigestHour)
+		}
+	}
+	go app.runJobExpiry()
+	go app.runSchedules()
+
 	setupTemplates()
 
 	var middlewares []func(http.Handler) http.Handler
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -9,9 +11,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/sessions"
 	"github.com/jamesog/scan/internal/sqlite"
 	"github.com/jamesog/scan/pkg/scan"
 )
@@ -73,11 +77,385 @@ func TestSaveData(t *testing.T) {
 
 }
 
+func TestSaveBanners(t *testing.T) {
+	db := createDB("TestSaveBanners")
+	defer db.Close()
+	app := App{db: db}
+
+	banner := func(text string) scan.Port {
+		p := scan.Port{Port: 22, Proto: "tcp"}
+		p.Service.Name = "ssh"
+		p.Service.Banner = text
+		return p
+	}
+
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	submissions := []struct {
+		now    time.Time
+		banner string
+	}{
+		{first, "SSH-2.0-OpenSSH_7.4"},
+		{first.Add(time.Hour), "SSH-2.0-OpenSSH_7.4"},
+		{first.Add(2 * time.Hour), "SSH-2.0-OpenSSH_8.9"},
+	}
+	for _, s := range submissions {
+		results := []scan.Result{
+			{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+			{IP: "192.0.2.1", Ports: []scan.Port{banner(s.banner)}},
+		}
+		count, err := db.SaveData(results, s.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("expected count 1, got %d", count)
+		}
+	}
+
+	banners, err := db.LoadBanners(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(banners) != 2 {
+		t.Fatalf("expected 2 banners, got %d", len(banners))
+	}
+	if !banners[0].LastSeen.Equal(first.Add(time.Hour)) {
+		t.Errorf("expected first banner last seen at %v, got %v", first.Add(time.Hour), banners[0].LastSeen)
+	}
+	if banners[1].Banner != "SSH-2.0-OpenSSH_8.9" {
+		t.Errorf("expected latest banner %q, got %q", "SSH-2.0-OpenSSH_8.9", banners[1].Banner)
+	}
+
+	results, err := db.LoadData(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || len(results[0].Banners) != 1 || results[0].Banners[0].Banner != "SSH-2.0-OpenSSH_8.9" {
+		t.Errorf("expected result with latest banner, got %+v", results)
+	}
+
+	r := httptest.NewRequest("GET", "/banner/192.0.2.1?port=22&proto=tcp", nil)
+	w := httptest.NewRecorder()
+	app.setupRouter().ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %v: %s", resp.StatusCode, body)
+	}
+	var history []scan.Banner
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Errorf("expected 2 banners, got %d", len(history))
+	}
+
+	// Banners aren't shown to anyone who isn't logged in
+	authDisabled = false
+	defer func(s *sessions.CookieStore) { authDisabled, store = true, s }(store)
+	store = sessions.NewCookieStore([]byte("test"))
+	w = httptest.NewRecorder()
+	app.setupRouter().ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 when not logged in, got %d", w.Code)
+	}
+}
+
+func TestCloseMissing(t *testing.T) {
+	db := createDB("TestCloseMissing")
+	defer db.Close()
+
+	results := []scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.2", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+	}
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := db.SaveData(results, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second port isn't seen in the next scan
+	second := first.Add(time.Hour)
+	if _, err := db.SaveData(results[:1], second); err != nil {
+		t.Fatal(err)
+	}
+	closed, err := db.CloseMissing(scan.Scope{}, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closed) != 1 || closed[0].IP != "192.0.2.2" {
+		t.Fatalf("expected 192.0.2.2 to be closed, got %+v", closed)
+	}
+
+	data, err := db.LoadData(sqlite.SQLFilter{Where: []string{"ip=?"}, Values: []interface{}{"192.0.2.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !data[0].Gone || !data[0].Closed.Equal(second) {
+		t.Errorf("expected closed at %v, got %+v", second, data[0])
+	}
+
+	// It reopens
+	third := second.Add(time.Hour)
+	if _, err := db.SaveData(results, third); err != nil {
+		t.Fatal(err)
+	}
+	data, err = db.LoadData(sqlite.SQLFilter{Where: []string{"ip=?"}, Values: []interface{}{"192.0.2.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0].Gone || !data[0].Closed.IsZero() {
+		t.Errorf("expected port to have reopened, got %+v", data[0])
+	}
+}
+
+func TestSaveResults(t *testing.T) {
+	db := createDB("TestSaveResults")
+	defer db.Close()
+
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.2", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+		{IP: "198.51.100.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+	}, first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := first.Add(time.Hour)
+	sub := scan.Submission{Host: "192.0.2.250", Time: scan.Time{Time: second}, CIDR: "192.0.2.0/24"}
+	scope, err := sub.Scope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []scan.Result{{IP: "192.0.2.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}}}
+	gone := func() int {
+		t.Helper()
+		data, err := db.LoadData(sqlite.SQLFilter{Where: []string{"closed IS NOT NULL"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(data)
+	}
+
+	// Nothing is closed if the submission can't be saved
+	if _, err := db.Exec(`ALTER TABLE observation RENAME TO observation_old`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := db.SaveResults(sub, results, &scope, ""); err == nil {
+		t.Fatal("expected an error saving observations")
+	}
+	if n := gone(); n != 0 {
+		t.Errorf("expected no ports to be closed after a failed submission, got %d", n)
+	}
+	if _, err := db.Exec(`ALTER TABLE observation_old RENAME TO observation`); err != nil {
+		t.Fatal(err)
+	}
+
+	count, id, _, err := db.SaveResults(sub, results, &scope, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || id != 1 {
+		t.Errorf("expected 1 port in submission 1, got %d in %d", count, id)
+	}
+	// Only 192.0.2.2 is in scope
+	data, err := db.LoadData(sqlite.SQLFilter{Where: []string{"closed IS NOT NULL"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data[0].IP != "192.0.2.2" {
+		t.Errorf("expected only 192.0.2.2 to be closed, got %+v", data)
+	}
+}
+
+func TestScopeContains(t *testing.T) {
+	scope, err := scan.ParseScope("192.0.2.0/24, 2001:db8::/64 198.51.100.10-198.51.100.20", "22,80-90,U:53", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip    string
+		port  int
+		proto string
+		want  bool
+	}{
+		{"192.0.2.1", 22, "tcp", true},
+		{"192.0.2.255", 85, "tcp", true},
+		{"192.0.3.1", 22, "tcp", false},
+		{"2001:db8::1", 80, "tcp", true},
+		{"2001:db8:0:1::1", 80, "tcp", false},
+		{"198.51.100.15", 53, "udp", true},
+		{"198.51.100.15", 53, "tcp", false},
+		{"198.51.100.21", 53, "udp", false},
+		{"192.0.2.1", 443, "tcp", false},
+	}
+	for _, tt := range tests {
+		if got := scope.Contains(tt.ip, tt.port, tt.proto); got != tt.want {
+			t.Errorf("Contains(%s, %d, %s) = %v, want %v", tt.ip, tt.port, tt.proto, got, tt.want)
+		}
+	}
+
+	if !(scan.Scope{}).Contains("203.0.113.1", 1, "tcp") {
+		t.Errorf("expected empty scope to contain everything")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db := createDB("TestSearch")
+	defer db.Close()
+
+	results := []scan.Result{
+		{IP: "10.1.1.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "110.1.1.10", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "10.1.2.3", Ports: []scan.Port{{Port: 53, Proto: "udp", Status: "open"}}},
+		{IP: "10.1.2.3", Ports: []scan.Port{{Port: 8080, Proto: "tcp", Status: "open"}}},
+		{IP: "2001:db8::10", Ports: []scan.Port{{Port: 443, Proto: "tcp", Status: "open"}}},
+	}
+	if _, err := db.SaveData(results, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		search string
+		want   int
+	}{
+		{"", 5},
+		{"10.1.1.1", 1},
+		{"ip:10.1.1.1", 1},
+		{"10.0.0.0/8", 3},
+		{"10.1.1.0-10.1.2.255", 3},
+		{"10.1.1.1 110.1.1.10", 2},
+		{"2001:db8::/32", 1},
+		{"2001:db8::10", 1},
+		{"22", 2},
+		{"port:22", 2},
+		{"1-1024", 4},
+		{"U:53", 1},
+		{"udp", 1},
+		{"10.0.0.0/8 tcp", 2},
+		{"proto:tcp 8000-9000", 1},
+		{"10.0.0.0/8,22", 1},
+	}
+	for _, tt := range tests {
+		scope, err := scan.ParseSearch(tt.search)
+		if err != nil {
+			t.Errorf("ParseSearch(%q): %v", tt.search, err)
+			continue
+		}
+		data, err := db.LoadData(sqlite.ScopeFilter(scope))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != tt.want {
+			t.Errorf("%q: expected %d results, got %d", tt.search, tt.want, len(data))
+		}
+	}
+
+	for _, s := range []string{"10.0.0.0/33", "port:http", "proto:gre", "tcp udp", "ip:"} {
+		if _, err := scan.ParseSearch(s); err == nil {
+			t.Errorf("ParseSearch(%q): expected error", s)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	db := createDB("TestParseQuery")
+	defer db.Close()
+
+	first := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "10.0.0.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "10.0.0.2", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 53, Proto: "udp", Status: "open"}}},
+	}, first); err != nil {
+		t.Fatal(err)
+	}
+	second := first.AddDate(0, 0, 1)
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "10.0.0.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "10.0.0.3", Ports: []scan.Port{{Port: 8080, Proto: "tcp", Status: "open"}}},
+	}, second); err != nil {
+		t.Fatal(err)
+	}
+	scope, _ := scan.ParseScope("10.0.0.0/8", "", "")
+	if _, err := db.CloseMissing(scope, second); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 4},
+		{"port:22", 2},
+		{"port:22 and cidr:10.0.0.0/8 and not gone", 1},
+		{"port:22 cidr:10.0.0.0/8 not gone", 1},
+		{"PORT:22 AND NOT GONE", 1},
+		{"gone", 1},
+		{"new", 2},
+		{"open", 3},
+		{"port>1024", 1},
+		{"port<=53", 3},
+		{"port:22 or proto:udp", 3},
+		{"(port:22 or port:8080) and not ip:10.0.0.1", 2},
+		{"not (port:22 or port:8080)", 1},
+		{"firstseen>2020-01-01", 1},
+		{"firstseen:2020-01-01", 3},
+		{"firstseen>=2020-01-02", 1},
+		{"firstseen<2020-01-02", 3},
+		{"lastseen>2020-01-01T12:00:00Z", 2},
+		{"closed:2020-01-02", 1},
+		{"10.0.0.0/8 22 8080", 3},
+		{"10.0.0.0/8 22 or udp", 3},
+		{"U:53", 1},
+		{"ip:10.0.0.1,10.0.0.2", 2},
+	}
+	for _, tt := range tests {
+		filter, err := sqlite.ParseQuery(tt.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.query, err)
+			continue
+		}
+		data, err := db.LoadData(filter)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if len(data) != tt.want {
+			t.Errorf("%q: expected %d results, got %d", tt.query, tt.want, len(data))
+		}
+	}
+
+	errors := []struct {
+		query string
+		want  string
+	}{
+		{"prot:tcp", `unknown field "prot" (at character 1)`},
+		{"port:22 and", "unexpected end of query (at character 12)"},
+		{"(port:22", "missing closing parenthesis (at character 1)"},
+		{"port:22)", `unexpected ")" (at character 8)`},
+		{"or port:22", `unexpected "or" (at character 1)`},
+		{"port:ssh", `invalid port "ssh" (at character 1)`},
+		{"firstseen>yesterday", `invalid time "yesterday" (at character 1)`},
+		{"cidr>10.0.0.0/8", "cidr can't be compared with > (at character 1)"},
+		{"port:", "missing value for port (at character 1)"},
+	}
+	for _, tt := range errors {
+		_, err := sqlite.ParseQuery(tt.query)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("ParseQuery(%q): expected error %q, got %v", tt.query, tt.want, err)
+		}
+	}
+}
+
 func TestResultData(t *testing.T) {
 	db := createDB("TestResultData")
 	defer db.Close()
 	want := scan.Data{Total: 0, Latest: 0, New: 0, LastSeen: time.Unix(0, 0).Unix(), Results: nil}
-	data, err := db.ResultData("", "", "")
+	data, err := db.ResultData(sqlite.SQLFilter{}, "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,6 +482,41 @@ func TestIndexHandlerWithoutAuth(t *testing.T) {
 	}
 }
 
+func TestIndexHandlerSearch(t *testing.T) {
+	db := createDB("TestIndexHandlerSearch")
+	defer db.Close()
+	app := App{db: db}
+
+	results := []scan.Result{
+		{IP: "10.1.1.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "110.1.1.10", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+	}
+	if _, err := db.SaveData(results, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/?q=10.1.1.1", nil)
+	w := httptest.NewRecorder()
+	app.index(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v: %s", w.Code, body)
+	}
+	if !strings.Contains(body, ">10.1.1.1<") || strings.Contains(body, "110.1.1.10") {
+		t.Errorf("expected only 10.1.1.1 in results")
+	}
+
+	r = httptest.NewRequest("GET", "/?q=10.1.1.1/33", nil)
+	w = httptest.NewRecorder()
+	app.index(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %v", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "invalid CIDR") {
+		t.Errorf("expected error to be shown")
+	}
+}
+
 func TestResultsHandler(t *testing.T) {
 	db := createDB("TestResultsHandler")
 	defer db.Close()
@@ -160,6 +573,238 @@ func TestResultsHandler(t *testing.T) {
 	// }
 }
 
+func TestParseJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  int
+	}{
+		{"Empty", ``, 0},
+		{"EmptyArray", `[]`, 0},
+		{"Array", `[{"ip":"192.0.2.1","ports":[{"port":80,"proto":"tcp","status":"open"}]}]`, 1},
+		{"Masscan", `{ "ip": "192.0.2.1", "timestamp": "1600000000", "ports": [ {"port": 80, "proto": "tcp", "status": "open", "reason": "syn-ack", "ttl": 57} ] },
+{ "ip": "192.0.2.1", "timestamp": "1600000000", "ports": [ {"port": 443, "proto": "tcp", "status": "open", "reason": "syn-ack", "ttl": 57} ] },
+{finished: 1}
+`, 2},
+		{"MasscanBrackets", `[
+{ "ip": "192.0.2.1", "ports": [ {"port": 80, "proto": "tcp", "status": "open"} ] },
+{ "ip": "192.0.2.2", "ports": [ {"port": 80, "proto": "tcp", "status": "open"} ] },
+]
+`, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := scan.ParseJSON(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(res) != tt.want {
+				t.Errorf("expected %d results, got %d", tt.want, len(res))
+			}
+		})
+	}
+}
+
+func TestParseJSONSyntaxError(t *testing.T) {
+	input := `{ "ip": "192.0.2.1", "ports": [ {"port": 80, "proto": "tcp", "status": "open"} ] },
+{ "ip": "192.0.2.2", "ports": [ {"port": 80 "proto": "tcp", "status": "open"} ] },
+`
+	_, err := scan.ParseJSON(strings.NewReader(input))
+	var se *scan.SyntaxError
+	if !errors.As(err, &se) {
+		t.Fatalf("expected SyntaxError, got %v", err)
+	}
+	if se.Line != 2 {
+		t.Errorf("expected error on line 2, got %d", se.Line)
+	}
+	if se.Column != 45 {
+		t.Errorf("expected error at column 45, got %d", se.Column)
+	}
+}
+
+func TestResultsHandlerMasscanOutput(t *testing.T) {
+	db := createDB("TestResultsHandlerMasscanOutput")
+	defer db.Close()
+	app := App{db: db}
+
+	data := bytes.NewBufferString(`{ "ip": "192.0.2.1", "timestamp": "1600000000", "ports": [ {"port": 80, "proto": "tcp", "status": "open", "reason": "syn-ack", "ttl": 57} ] },
+{ "ip": "192.0.2.2", "timestamp": "1600000000", "ports": [ {"port": 22, "proto": "tcp", "status": "open", "reason": "syn-ack", "ttl": 57} ] },
+{finished: 1}
+`)
+
+	r := httptest.NewRequest("POST", "/results", data)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	app.recvResults(w, r)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %v: %s", resp.StatusCode, body)
+	}
+
+	results, err := db.LoadData(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatalf("couldn't retrieve results from database: %v", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected 2 results, got %d", len(results))
+	}
+
+	r = httptest.NewRequest("POST", "/results", strings.NewReader(`{"ip": "192.0.2.1",`))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	app.recvResults(w, r)
+
+	resp = w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %v", resp.StatusCode)
+	}
+}
+
+func TestResultsHandlerFormats(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		input       string
+	}{
+		{"List", "text/x-masscan-list", `#masscan
+open tcp 80 192.0.2.1 1600000000
+open tcp 22 192.0.2.2 1600000000
+banner tcp 22 192.0.2.2 1600000000 ssh SSH-2.0-OpenSSH_8.9
+# end
+`},
+		{"Grepable", "text/x-masscan-grepable", `# Masscan 1.3.2 scan initiated Sun Sep 13 12:26:40 2020
+# Ports scanned: TCP(2;22-22,80-80) UDP(0;) SCTP(0;) PROTOCOLS(0;)
+Timestamp: 1600000000	Host: 192.0.2.1 ()	Ports: 80/open/tcp//http//
+Timestamp: 1600000000	Host: 192.0.2.2 ()	Ports: 22/open/tcp//ssh//
+Timestamp: 1600000000	Host: 192.0.2.2 ()	Port: 22	Service: ssh	Banner: SSH-2.0-OpenSSH_8.9
+# Masscan done at Sun Sep 13 12:26:52 2020
+`},
+		{"XML", "application/xml", `<?xml version="1.0"?>
+<nmaprun scanner="masscan" start="1600000000" version="1.0-BETA" xmloutputversion="1.03">
+<scaninfo type="syn" protocol="tcp" />
+<host endtime="1600000000"><address addr="192.0.2.1" addrtype="ipv4"/><ports><port protocol="tcp" portid="80"><state state="open" reason="syn-ack" reason_ttl="57"/></port></ports></host>
+<host endtime="1600000000"><address addr="192.0.2.2" addrtype="ipv4"/><ports><port protocol="tcp" portid="22"><state state="open" reason="syn-ack" reason_ttl="57"/></port></ports></host>
+<host endtime="1600000000"><address addr="192.0.2.2" addrtype="ipv4"/><ports><port protocol="tcp" portid="22"><state state="open" reason="response" reason_ttl="57" /><service name="ssh" banner="SSH-2.0-OpenSSH_8.9"></service></port></ports></host>
+<runstats>
+<finished time="1600000010" timestr="2020-09-13 12:26:50" elapsed="10" />
+<hosts up="2" down="0" total="2" />
+</runstats>
+</nmaprun>
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := createDB("TestResultsHandlerFormats" + tt.name)
+			defer db.Close()
+			app := App{db: db}
+
+			r := httptest.NewRequest("POST", "/results", strings.NewReader(tt.input))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			app.recvResults(w, r)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %v: %s", resp.StatusCode, body)
+			}
+
+			results, err := db.LoadData(sqlite.SQLFilter{})
+			if err != nil {
+				t.Fatalf("couldn't retrieve results from database: %v", err)
+			}
+			if len(results) != 2 {
+				t.Errorf("expected 2 results, got %d", len(results))
+			}
+		})
+	}
+}
+
+func TestResultsHandlerUnsupportedFormat(t *testing.T) {
+	db := createDB("TestResultsHandlerUnsupportedFormat")
+	defer db.Close()
+	app := App{db: db}
+
+	r := httptest.NewRequest("POST", "/results", strings.NewReader("192.0.2.1:80"))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	app.recvResults(w, r)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415, got %v", resp.StatusCode)
+	}
+}
+
+func TestResultsHandlerNmap(t *testing.T) {
+	db := createDB("TestResultsHandlerNmap")
+	defer db.Close()
+	app := App{db: db}
+
+	input := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE nmaprun>
+<nmaprun scanner="nmap" args="nmap -sV -oX - 192.0.2.1" start="1600000000" version="7.80" xmloutputversion="1.04">
+<host starttime="1600000000" endtime="1600000010"><status state="up" reason="syn-ack" reason_ttl="0"/>
+<address addr="192.0.2.1" addrtype="ipv4"/>
+<ports><extraports state="closed" count="997"><extrareasons reason="conn-refused" count="997"/></extraports>
+<port protocol="tcp" portid="22"><state state="open" reason="syn-ack" reason_ttl="0"/><service name="ssh" product="OpenSSH" version="8.9p1 Ubuntu 3" extrainfo="Ubuntu Linux; protocol 2.0" ostype="Linux" method="probed" conf="10"/></port>
+<port protocol="tcp" portid="25"><state state="filtered" reason="no-response" reason_ttl="0"/><service name="smtp" method="table" conf="3"/></port>
+<port protocol="tcp" portid="80"><state state="open" reason="syn-ack" reason_ttl="0"/><service name="http" product="nginx" version="1.18.0" method="probed" conf="10"/></port>
+</ports>
+</host>
+<runstats><finished time="1600000010" elapsed="10"/><hosts up="1" down="0" total="1"/></runstats>
+</nmaprun>
+`
+
+	r := httptest.NewRequest("POST", "/results", strings.NewReader(input))
+	r.Header.Set("Content-Type", "application/x-nmap+xml")
+	r.RemoteAddr = "198.51.100.1:1234"
+	w := httptest.NewRecorder()
+	app.recvResults(w, r)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %v: %s", resp.StatusCode, body)
+	}
+
+	results, err := db.LoadData(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatalf("couldn't retrieve results from database: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	ssh := results[0]
+	if ssh.Port != 22 || ssh.Service != "ssh" || ssh.Product != "OpenSSH" || ssh.Version != "8.9p1 Ubuntu 3" {
+		t.Errorf("unexpected service details: %+v", ssh)
+	}
+
+	sub, err := db.LoadSubmission(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Host != "198.51.100.1" {
+		t.Errorf("expected submission from %s, got %q", "198.51.100.1", sub.Host)
+	}
+}
+
+func TestParseListSyntaxError(t *testing.T) {
+	input := "#masscan\nopen tcp 80 192.0.2.1 1600000000\nopen tcp http 192.0.2.2 1600000000\n"
+	_, err := scan.ParseList(strings.NewReader(input))
+	var se *scan.SyntaxError
+	if !errors.As(err, &se) {
+		t.Fatalf("expected SyntaxError, got %v", err)
+	}
+	if se.Line != 3 || se.Column != 10 {
+		t.Errorf("expected error at line 3, column 10, got line %d, column %d", se.Line, se.Column)
+	}
+}
+
 // TestTracerouteHandler tests fetching a route, ensuring it fails, uploading
 // that route then fetching it.
 func TestTracerouteHandler(t *testing.T) {
@@ -227,3 +872,64 @@ traceroute to 192.0.2.1 (192.0.2.1), 64 hops max, 52 byte packets
 		t.Errorf("expect %q, got %q", route, string(body))
 	}
 }
+
+// TestResultsHandlerScope tests that submissions from nodes scanning different
+// ranges don't affect each other.
+func TestResultsHandlerScope(t *testing.T) {
+	db := createDB("TestResultsHandlerScope")
+	defer db.Close()
+	app := App{db: db}
+
+	submit := func(query, data string) *http.Response {
+		r := httptest.NewRequest("POST", "/results?"+query, strings.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		app.recvResults(w, r)
+		return w.Result()
+	}
+
+	// The first node's results were submitted earlier
+	results := []scan.Result{{IP: "192.0.2.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}}}
+	if _, err := db.SaveData(results, time.Now().UTC().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := submit("cidr=198.51.100.0/24&ports=80&proto=tcp", `[]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", resp.StatusCode)
+	}
+
+	data, err := db.ResultData(sqlite.SQLFilter{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Total != 1 || data.New != 1 || data.Results[0].Gone {
+		t.Errorf("expected 1 new result, got %+v", data)
+	}
+
+	sub, err := db.LoadSubmission(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.CIDR != "198.51.100.0/24" || sub.Ports != "80" || sub.Proto != "tcp" {
+		t.Errorf("submission scope not stored, got %+v", sub)
+	}
+
+	// The first node scans again and the port has closed
+	resp = submit("cidr=192.0.2.0/24&ports=80&proto=tcp", `[]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", resp.StatusCode)
+	}
+	data, err = db.ResultData(sqlite.SQLFilter{}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.New != 0 || !data.Results[0].Gone {
+		t.Errorf("expected result to be gone, got %+v", data)
+	}
+
+	resp = submit("cidr=192.0.2.0/33", `[]`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid scope, got %v", resp.StatusCode)
+	}
+}
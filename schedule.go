@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+type schedulesData struct {
+	indexData
+	Schedules []scan.Schedule
+	// JobStates are the states of the jobs the schedules last enqueued
+	JobStates map[int64]string
+}
+
+// nextRun returns the first time rec comes round after now, counting from
+// last. Runs missed while the server was down are skipped rather than made
+// up. Cron expressions are evaluated in local time.
+func nextRun(rec scan.Recurrence, last, now time.Time) time.Time {
+	next := rec.Next(last.Local())
+	for !next.IsZero() && !next.After(now) {
+		next = rec.Next(next)
+	}
+	return next.UTC().Truncate(time.Second)
+}
+
+// scheduleFromForm reads and validates a new schedule from form values.
+func scheduleFromForm(f url.Values, now time.Time) (scan.Schedule, []string) {
+	s := scan.Schedule{
+		CIDR:  strings.TrimSpace(f.Get("cidr")),
+		Ports: strings.TrimSpace(f.Get("ports")),
+		Proto: f.Get("proto"),
+		Spec:  strings.TrimSpace(f.Get("spec")),
+	}
+
+	var errs []string
+	var protos []string
+	if s.Proto != "" {
+		protos = []string{s.Proto}
+	}
+	if err := scan.ValidateJob(s.CIDR, s.Ports, protos); err != nil {
+		errs = errorMessages(err)
+	}
+	if s.Spec == "" {
+		return s, append(errs, "Schedule is required")
+	}
+	rec, err := scan.ParseRecurrence(s.Spec)
+	if err != nil {
+		return s, append(errs, err.Error())
+	}
+	s.NextRun = scan.Time{Time: nextRun(rec, now, now)}
+	if s.NextRun.IsZero() {
+		errs = append(errs, fmt.Sprintf("Schedule %q never runs", s.Spec))
+	}
+	return s, errs
+}
+
+// loadSchedule loads a single schedule by ID. It returns sql.ErrNoRows if
+// the schedule doesn't exist.
+func (app *App) loadSchedule(id int64) (scan.Schedule, error) {
+	schedules, err := app.db.LoadSchedules(sqlite.SQLFilter{
+		Where:  []string{"id = ?"},
+		Values: []interface{}{id},
+	})
+	if err != nil {
+		return scan.Schedule{}, err
+	}
+	if len(schedules) == 0 {
+		return scan.Schedule{}, sql.ErrNoRows
+	}
+	return schedules[0], nil
+}
+
+// lastJobActive reports whether the job a schedule last enqueued is still
+// queued or running, and the state it's in.
+func (app *App) lastJobActive(s scan.Schedule) (bool, string, error) {
+	if s.LastJob == 0 {
+		return false, "", nil
+	}
+	jobs, err := app.db.LoadJobs(sqlite.SQLFilter{
+		Where:  []string{"rowid = ?"},
+		Values: []interface{}{s.LastJob},
+	})
+	if err != nil || len(jobs) == 0 {
+		return false, "", err
+	}
+	return jobs[0].Active(), jobs[0].State, nil
+}
+
+// runDueSchedules enqueues a job for each schedule which is due to run at
+// now. If the job a schedule enqueued last time is still pending, the run is
+// skipped so jobs don't pile up behind a slow or absent node.
+func (app *App) runDueSchedules(now time.Time) {
+	schedules, err := app.db.LoadSchedules(sqlite.SQLFilter{Where: []string{"paused = 0"}})
+	if err != nil {
+		log.Println("runDueSchedules: couldn't load schedules:", err)
+		return
+	}
+
+	var enqueued bool
+	for _, s := range schedules {
+		if s.NextRun.After(now) {
+			continue
+		}
+		rec, err := scan.ParseRecurrence(s.Spec)
+		if err != nil {
+			log.Printf("runDueSchedules: schedule %d: %v", s.ID, err)
+			continue
+		}
+		next := nextRun(rec, s.NextRun.Time, now)
+		if next.IsZero() {
+			if err := app.db.PauseSchedule(s.ID, true, s.NextRun.Time); err != nil {
+				log.Printf("runDueSchedules: couldn't pause schedule %d: %v", s.ID, err)
+			}
+			app.audit("", "pause_schedule", fmt.Sprintf("%d never runs again", s.ID))
+			continue
+		}
+
+		active, state, err := app.lastJobActive(s)
+		if err != nil {
+			log.Printf("runDueSchedules: couldn't load job %d: %v", s.LastJob, err)
+			continue
+		}
+		if active {
+			if err := app.db.SaveScheduleRun(s.ID, now, 0, next); err != nil {
+				log.Printf("runDueSchedules: couldn't save schedule %d: %v", s.ID, err)
+			}
+			app.audit("", "skip_schedule", fmt.Sprintf("%d job %d is %s", s.ID, s.LastJob, state))
+			continue
+		}
+
+		id, err := app.db.SaveJob(s.CIDR, s.Ports, s.Proto, s.CreatedBy)
+		if err != nil {
+			log.Printf("runDueSchedules: couldn't save job for schedule %d: %v", s.ID, err)
+			continue
+		}
+		enqueued = true
+		if err := app.db.SaveScheduleRun(s.ID, now, id, next); err != nil {
+			log.Printf("runDueSchedules: couldn't save schedule %d: %v", s.ID, err)
+		}
+		app.audit("", "run_schedule", fmt.Sprintf("%d job %d", s.ID, id))
+	}
+	if enqueued {
+		app.updateJobMetrics()
+	}
+}
+
+// runSchedules checks for due schedules every minute, forever.
+func (app *App) runSchedules() {
+	for now := range time.Tick(time.Minute) {
+		app.runDueSchedules(now)
+	}
+}
+
+// Handler for GET /schedules
+// Lists the recurring job schedules.
+func (app *App) schedules(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tmpl.ExecuteTemplate(w, "schedules", schedulesData{indexData: indexData{URI: r.RequestURI}})
+		return
+	}
+	app.renderSchedules(w, r, user, nil)
+}
+
+func (app *App) renderSchedules(w http.ResponseWriter, r *http.Request, user User, errs []string) {
+	schedules, err := app.db.LoadSchedules(sqlite.SQLFilter{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	states := make(map[int64]string)
+	for _, s := range schedules {
+		_, state, err := app.lastJobActive(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		states[s.LastJob] = state
+	}
+
+	// Fetch result numbers for display in the navbar
+	results, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
+
+	data := schedulesData{
+		indexData: indexData{
+			Errors:        errs,
+			Authenticated: true,
+			User:          user,
+			URI:           r.URL.Path,
+			Data:          results,
+		},
+		Schedules: schedules,
+		JobStates: states,
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	tmpl.ExecuteTemplate(w, "schedules", data)
+}
+
+// Handler for POST /schedules
+// Adds, pauses, resumes or deletes a schedule.
+func (app *App) updateSchedules(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := r.PostForm
+	now := time.Now()
+
+	// Every action other than adding a schedule names the schedule it acts on
+	var action, v string
+	for _, a := range []string{"delete", "pause", "resume"} {
+		if v = f.Get(a); v != "" {
+			action = a
+			break
+		}
+	}
+	if action == "" {
+		s, errs := scheduleFromForm(f, now)
+		if len(errs) > 0 {
+			app.renderSchedules(w, r, user, errs)
+			return
+		}
+		s.Created = scan.Time{Time: now.UTC().Truncate(time.Second)}
+		s.CreatedBy = user.Email
+		id, err := app.db.SaveSchedule(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		app.audit(user.Email, "add_schedule", fmt.Sprintf("%d %s %s %s every %s", id, s.CIDR, s.Ports, s.Proto, s.Spec))
+		http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid schedule %q", v), http.StatusBadRequest)
+		return
+	}
+	s, err := app.loadSchedule(id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Schedule does not exist", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch action {
+	case "delete":
+		err = app.db.DeleteSchedule(id)
+	case "pause":
+		err = app.db.PauseSchedule(id, true, s.NextRun.Time)
+	case "resume":
+		// Resuming doesn't make up the runs missed while paused
+		rec, perr := scan.ParseRecurrence(s.Spec)
+		if perr != nil {
+			app.renderSchedules(w, r, user, []string{perr.Error()})
+			return
+		}
+		err = app.db.PauseSchedule(id, false, nextRun(rec, now, now))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.audit(user.Email, action+"_schedule", strconv.FormatInt(id, 10))
+
+	http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+}
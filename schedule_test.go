@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	// 2020-01-01 was a Wednesday
+	wed := time.Date(2020, 1, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"6h", wed.Add(6 * time.Hour)},
+		{"@every 90m", wed.Add(90 * time.Minute)},
+		{"@hourly", time.Date(2020, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 1, 12, 45, 0, 0, time.UTC)},
+		{"30 12 * * *", time.Date(2020, 1, 2, 12, 30, 0, 0, time.UTC)},
+		{"0 2 * * 1-5", time.Date(2020, 1, 2, 2, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Restricting both days of month and week runs on either
+		{"0 0 15 * 4", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			rec, err := scan.ParseRecurrence(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rec.Next(wed); !got.Equal(tt.want) {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	for _, spec := range []string{"", "soon", "30s", "* * * *", "60 * * * *", "* * * 13 *", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := scan.ParseRecurrence(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+
+	// 30 February never comes round
+	rec, err := scan.ParseRecurrence("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Next(wed); !got.IsZero() {
+		t.Errorf("expected no next time, got %s", got)
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	db := createDB("TestSchedules")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	post := func(f url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/schedules", strings.NewReader(f.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post(url.Values{"cidr": {"192.0.2.0/24"}, "ports": {"22,80"}, "proto": {"TCP"}, "spec": {"1h"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303, got %d: %s", w.Code, w.Body)
+	}
+	for _, f := range []url.Values{
+		{"cidr": {"192.0.2.0/24"}, "ports": {"22"}, "proto": {"TCP"}},
+		{"cidr": {"192.0.2.0/33"}, "ports": {"22"}, "proto": {"TCP"}, "spec": {"1h"}},
+		{"cidr": {"192.0.2.0/24"}, "ports": {"22"}, "proto": {"GRE"}, "spec": {"1h"}},
+		{"cidr": {"192.0.2.0/24"}, "ports": {"22"}, "proto": {"TCP"}, "spec": {"10s"}},
+		{"cidr": {"192.0.2.0/24"}, "ports": {"22"}, "proto": {"TCP"}, "spec": {"0 0 30 2 *"}},
+	} {
+		if w := post(f); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected status 400, got %d", f, w.Code)
+		}
+	}
+
+	schedules, err := db.LoadSchedules(sqlite.SQLFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedules) != 1 {
+		t.Fatalf("expected 1 schedule, got %+v", schedules)
+	}
+	s := schedules[0]
+	now := time.Now()
+	if next := s.NextRun.Sub(now); next < 59*time.Minute || next > time.Hour {
+		t.Errorf("expected the schedule to run in an hour, got %s", s.NextRun)
+	}
+
+	jobs := func() []scan.Job {
+		t.Helper()
+		jobs, err := db.LoadJobs(sqlite.SQLFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jobs
+	}
+
+	// Nothing is due yet
+	app.runDueSchedules(now)
+	if n := len(jobs()); n != 0 {
+		t.Fatalf("expected no jobs, got %d", n)
+	}
+
+	later := s.NextRun.Add(time.Minute)
+	app.runDueSchedules(later)
+	got := jobs()
+	if len(got) != 1 || got[0].CIDR != "192.0.2.0/24" || got[0].Ports != "22,80" || got[0].State != scan.JobQueued {
+		t.Fatalf("expected a queued job, got %+v", got)
+	}
+	s, err = app.loadSchedule(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LastJob != int64(got[0].ID) || !s.NextRun.After(later) {
+		t.Errorf("unexpected schedule after running %+v", s)
+	}
+
+	// The job is still queued so the next run is skipped
+	later = s.NextRun.Add(time.Minute)
+	app.runDueSchedules(later)
+	if n := len(jobs()); n != 1 {
+		t.Fatalf("expected the run to be skipped while the job is queued, got %d jobs", n)
+	}
+
+	if err := db.CancelJob(s.LastJob, later); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = app.loadSchedule(s.ID)
+	later = s.NextRun.Add(time.Minute)
+	app.runDueSchedules(later)
+	if n := len(jobs()); n != 2 {
+		t.Fatalf("expected a second job once the first was cancelled, got %d jobs", n)
+	}
+
+	if w := post(url.Values{"pause": {"1"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303 pausing, got %d: %s", w.Code, w.Body)
+	}
+	app.runDueSchedules(later.Add(24 * time.Hour))
+	if n := len(jobs()); n != 2 {
+		t.Errorf("expected a paused schedule not to run, got %d jobs", n)
+	}
+
+	r := httptest.NewRequest("GET", "/schedules", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "Paused") || !strings.Contains(body, "192.0.2.0/24") {
+		t.Errorf("unexpected schedules page: status %d", w.Code)
+	}
+
+	if w := post(url.Values{"resume": {"1"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303 resuming, got %d: %s", w.Code, w.Body)
+	}
+	s, _ = app.loadSchedule(s.ID)
+	if s.Paused || !s.NextRun.After(time.Now()) {
+		t.Errorf("expected the schedule to resume from now, got %+v", s)
+	}
+
+	if w := post(url.Values{"delete": {"1"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303 deleting, got %d: %s", w.Code, w.Body)
+	}
+	if w := post(url.Values{"delete": {"1"}}); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 deleting a deleted schedule, got %d", w.Code)
+	}
+	if n := len(jobs()); n != 2 {
+		t.Errorf("expected deleting a schedule to keep its jobs, got %d", n)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// submissionPageSize is the number of submissions listed per page.
+const submissionPageSize = 100
+
+type submissionsData struct {
+	indexData
+	Job         int64
+	Submissions []scan.SubmissionSummary
+	Older       int64 // ID to list older submissions before, if there are any
+}
+
+type submissionDiffData struct {
+	indexData
+	scan.SubmissionDiff
+}
+
+// submissionFilter builds a filter from the job and before query parameters.
+func submissionFilter(q url.Values) (filter sqlite.SQLFilter, job int64, err error) {
+	if v := q.Get("job"); v != "" {
+		job, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, 0, fmt.Errorf("invalid job %q", v)
+		}
+		// A split job's submissions are those of its chunks
+		filter.Where = append(filter.Where, `(job_id=? OR job_id IN (SELECT rowid FROM job WHERE parent=?))`)
+		filter.Values = append(filter.Values, job, job)
+	}
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, 0, fmt.Errorf("invalid submission %q", v)
+		}
+		filter.Where = append(filter.Where, `rowid < ?`)
+		filter.Values = append(filter.Values, before)
+	}
+	return filter, job, nil
+}
+
+// Handler for GET /submissions
+// Lists submissions, newest first, optionally only those for a job.
+func (app *App) submissions(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tmpl.ExecuteTemplate(w, "submissions", submissionsData{indexData: indexData{URI: r.RequestURI}})
+		return
+	}
+
+	filter, job, err := submissionFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Fetch one more than needed to find out if there are older submissions
+	subs, err := app.db.LoadSubmissions(filter, submissionPageSize+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var older int64
+	if len(subs) > submissionPageSize {
+		subs = subs[:submissionPageSize]
+		older = subs[len(subs)-1].ID
+	}
+
+	// Fetch result numbers for display in the navbar
+	results, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
+
+	data := submissionsData{
+		indexData: indexData{
+			Authenticated: true,
+			User:          user,
+			URI:           r.URL.Path,
+			Data:          results,
+		},
+		Job:         job,
+		Submissions: subs,
+		Older:       older,
+	}
+	tmpl.ExecuteTemplate(w, "submissions", data)
+}
+
+// diffSubmissions compares the submission in the URL with the one in the from
+// query parameter, or the previous submission with the same scope if it isn't
+// set.
+func (app *App) diffSubmissions(r *http.Request) (scan.SubmissionDiff, int, error) {
+	to, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		return scan.SubmissionDiff{}, http.StatusNotFound, errors.New("invalid submission")
+	}
+
+	var from int64
+	if v := r.URL.Query().Get("from"); v != "" {
+		from, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return scan.SubmissionDiff{}, http.StatusBadRequest, fmt.Errorf("invalid submission %q", v)
+		}
+	} else {
+		from, err = app.db.PreviousSubmission(to)
+		if err != nil {
+			return scan.SubmissionDiff{}, http.StatusInternalServerError, err
+		}
+	}
+
+	diff, err := app.db.DiffSubmissions(from, to)
+	switch {
+	case errors.Is(err, sqlite.ErrSubmissionNotFound):
+		return diff, http.StatusNotFound, err
+	case err != nil:
+		return diff, http.StatusInternalServerError, err
+	}
+	return diff, http.StatusOK, nil
+}
+
+// Handler for GET /submissions/{id}
+func (app *App) submissionDiff(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tmpl.ExecuteTemplate(w, "submissionDiff", submissionDiffData{indexData: indexData{URI: r.RequestURI}})
+		return
+	}
+
+	diff, status, err := app.diffSubmissions(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Fetch result numbers for display in the navbar
+	results, _ := app.db.ResultData(sqlite.SQLFilter{}, "", "")
+
+	data := submissionDiffData{
+		indexData: indexData{
+			Authenticated: true,
+			User:          user,
+			URI:           r.URL.Path,
+			Data:          results,
+		},
+		SubmissionDiff: diff,
+	}
+	tmpl.ExecuteTemplate(w, "submissionDiff", data)
+}
+
+// Handler for GET /api/v1/submissions
+func (app *App) apiSubmissions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, _, err := submissionFilter(q)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	limit := submissionPageSize
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			renderError(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+	}
+
+	subs, err := app.db.LoadSubmissions(filter, limit)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if subs == nil {
+		subs = []scan.SubmissionSummary{}
+	}
+	render.JSON(w, r, subs)
+}
+
+// Handler for GET /api/v1/submissions/{id}/diff
+func (app *App) apiSubmissionDiff(w http.ResponseWriter, r *http.Request) {
+	diff, status, err := app.diffSubmissions(r)
+	if err != nil {
+		renderError(w, r, status, err)
+		return
+	}
+	render.JSON(w, r, diff)
+}
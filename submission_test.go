@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/internal/sqlite"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestSubmissionDiff(t *testing.T) {
+	db := createDB("TestSubmissionDiff")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	submissions := []string{
+		`[{"ip":"192.0.2.1","ports":[{"port":22,"proto":"tcp","status":"open"}]},
+		  {"ip":"192.0.2.2","ports":[{"port":80,"proto":"tcp","status":"open"}]}]`,
+		`[{"ip":"192.0.2.1","ports":[{"port":22,"proto":"tcp","status":"open"}]},
+		  {"ip":"192.0.2.3","ports":[{"port":443,"proto":"tcp","status":"open"}]},
+		  {"ip":"192.0.2.3","ports":[{"port":8443,"proto":"tcp","status":"open"}]}]`,
+	}
+	for _, data := range submissions {
+		r := httptest.NewRequest("POST", "/results", strings.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", uri, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/api/v1/submissions")
+	var subs []struct {
+		ID       int64 `json:"id"`
+		Previous int64 `json:"previous"`
+		Results  int   `json:"results"`
+		Added    int   `json:"added"`
+		Removed  int   `json:"removed"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&subs); err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 2 {
+		t.Fatalf("expected 2 submissions, got %d", len(subs))
+	}
+	if s := subs[0]; s.ID != 2 || s.Previous != 1 || s.Results != 3 || s.Added != 2 || s.Removed != 1 {
+		t.Errorf("unexpected counts for the latest submission: %+v", s)
+	}
+	if s := subs[1]; s.ID != 1 || s.Previous != 0 || s.Results != 2 || s.Added != 2 || s.Removed != 0 {
+		t.Errorf("unexpected counts for the first submission: %+v", s)
+	}
+
+	w = get("/api/v1/submissions/2/diff")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var diff struct {
+		From      struct{ ID int64 }
+		To        struct{ ID int64 }
+		Added     []struct{ IP string }
+		Removed   []struct{ IP string }
+		Unchanged []struct{ IP string }
+	}
+	if err := json.NewDecoder(w.Body).Decode(&diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff.From.ID != 1 || diff.To.ID != 2 {
+		t.Errorf("expected diff from 1 to 2, got %d to %d", diff.From.ID, diff.To.ID)
+	}
+	if len(diff.Added) != 2 || len(diff.Removed) != 1 || len(diff.Unchanged) != 1 {
+		t.Errorf("expected 2 added, 1 removed and 1 unchanged, got %+v", diff)
+	}
+	if len(diff.Removed) == 1 && diff.Removed[0].IP != "192.0.2.2" {
+		t.Errorf("expected 192.0.2.2 to be removed, got %s", diff.Removed[0].IP)
+	}
+
+	// Reversing the diff swaps added and removed
+	w = get("/api/v1/submissions/1/diff?from=2")
+	diff.Added, diff.Removed = nil, nil
+	json.NewDecoder(w.Body).Decode(&diff)
+	if len(diff.Added) != 1 || len(diff.Removed) != 2 {
+		t.Errorf("expected 1 added and 2 removed, got %d and %d", len(diff.Added), len(diff.Removed))
+	}
+
+	if w := get("/api/v1/submissions/3/diff"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+
+	w = get("/submissions")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), ">+2<") {
+		t.Errorf("expected submission list with counts, got %d: %s", w.Code, w.Body)
+	}
+	w = get("/submissions/2")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), ">192.0.2.2<") {
+		t.Errorf("expected submission diff, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPreviousSubmission(t *testing.T) {
+	db := createDB("TestPreviousSubmission")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	// Scans of two networks interleaved, each only compared with the last
+	// scan of the same network
+	ssh := scan.Result{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}}
+	web := scan.Result{IP: "192.0.2.2", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}}
+	other := scan.Result{IP: "198.51.100.1", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}}
+	scans := []struct {
+		cidr    string
+		results []scan.Result
+	}{
+		{"192.0.2.0/24", []scan.Result{ssh}},
+		{"198.51.100.0/24", []scan.Result{other}},
+		{"192.0.2.0/24", []scan.Result{ssh, web}},
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, s := range scans {
+		sub := scan.Submission{Host: "test", Time: scan.Time{Time: now.Add(time.Duration(i) * time.Hour)}, CIDR: s.cidr}
+		if _, _, _, err := db.SaveResults(sub, s.results, nil, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subs, err := db.LoadSubmissions(sqlite.SQLFilter{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 3 {
+		t.Fatalf("expected 3 submissions, got %d", len(subs))
+	}
+	if s := subs[0]; s.ID != 3 || s.Previous != 1 || s.Results != 2 || s.Added != 1 || s.Removed != 0 {
+		t.Errorf("unexpected counts for the latest submission: %+v", s)
+	}
+	if s := subs[1]; s.ID != 2 || s.Previous != 0 || s.Results != 1 || s.Added != 1 || s.Removed != 0 {
+		t.Errorf("unexpected counts for the other network: %+v", s)
+	}
+
+	// Only the page asked for is returned
+	subs, err = db.LoadSubmissions(sqlite.SQLFilter{Where: []string{`rowid < ?`}, Values: []interface{}{3}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0].ID != 2 {
+		t.Errorf("expected only submission 2, got %+v", subs)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/submissions/3/diff", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var diff struct {
+		From  struct{ ID int64 }
+		Added []struct{ IP string }
+	}
+	if err := json.NewDecoder(w.Body).Decode(&diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff.From.ID != 1 || len(diff.Added) != 1 || diff.Added[0].IP != "192.0.2.2" {
+		t.Errorf("expected 192.0.2.2 added since submission 1, got %+v", diff)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// validateTriage checks and normalises a triage submitted by a user.
+func validateTriage(t scan.Triage) (scan.Triage, error) {
+	addr := net.ParseIP(t.IP)
+	if addr == nil {
+		return t, fmt.Errorf("invalid IP address %q", t.IP)
+	}
+	t.IP = addr.String()
+	if t.Port < 0 || t.Port > 65535 {
+		return t, fmt.Errorf("invalid port %d", t.Port)
+	}
+	t.Proto = strings.ToLower(t.Proto)
+	if t.Proto == "" {
+		return t, errors.New("proto is required")
+	}
+	if !scan.ValidTriageState(t.State) {
+		return t, fmt.Errorf("invalid triage state %q, must be one of %s", t.State, strings.Join(scan.TriageStates, ", "))
+	}
+	t.Assignee = strings.TrimSpace(t.Assignee)
+	t.Comment = strings.TrimSpace(t.Comment)
+	return t, nil
+}
+
+// saveTriage stores the triage of a port on behalf of user, and records it in
+// the audit log.
+func (app *App) saveTriage(user User, t scan.Triage) (scan.Triage, error) {
+	t.Updated = scan.Time{Time: time.Now().UTC().Truncate(time.Second)}
+	t.UpdatedBy = user.Email
+	if err := app.db.SaveTriage(t); err != nil {
+		return t, err
+	}
+
+	info := fmt.Sprintf("%s %d/%s %s", t.IP, t.Port, t.Proto, t.State)
+	if t.Assignee != "" {
+		info += " assigned to " + t.Assignee
+	}
+	app.audit(user.Email, "triage", info)
+	return t, nil
+}
+
+// Handler for POST /triage
+// Sets the triage of a port from a form, then returns to the host page.
+func (app *App) triage(w http.ResponseWriter, r *http.Request) {
+	user, ok, err := sessionUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := r.PostForm
+	port, err := strconv.Atoi(f.Get("port"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid port %q", f.Get("port")), http.StatusBadRequest)
+		return
+	}
+
+	t, err := validateTriage(scan.Triage{
+		IP:       f.Get("ip"),
+		Port:     port,
+		Proto:    f.Get("proto"),
+		State:    f.Get("state"),
+		Assignee: f.Get("assignee"),
+		Comment:  f.Get("comment"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err = app.saveTriage(user, t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/ip/"+t.IP, http.StatusSeeOther)
+}
+
+// Handler for PUT /api/v1/triage
+func (app *App) apiTriage(w http.ResponseWriter, r *http.Request) {
+	user, _, err := sessionUser(r)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	var t scan.Triage
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	t, err = validateTriage(t)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, err = app.saveTriage(user, t)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	render.JSON(w, r, t)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestTriage(t *testing.T) {
+	db := createDB("TestTriage")
+	defer db.Close()
+	app := App{db: db}
+	mux := app.setupRouter()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.2", Ports: []scan.Port{{Port: 80, Proto: "tcp", Status: "open"}}},
+		{IP: "192.0.2.3", Ports: []scan.Port{{Port: 443, Proto: "tcp", Status: "open"}}},
+	}, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"ip": {"192.0.2.1"}, "port": {"22"}, "proto": {"tcp"},
+		"state": {"acknowledged"}, "assignee": {"ops@example.com"}, "comment": {"Bastion"},
+	}
+	r := httptest.NewRequest("POST", "/triage", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303, got %d: %s", w.Code, w.Body)
+	}
+
+	put := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/api/v1/triage", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	w = put(`{"ip":"192.0.2.2","port":80,"proto":"tcp","state":"false-positive"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	var saved scan.Triage
+	if err := json.NewDecoder(w.Body).Decode(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.State != scan.TriageFalsePositive || saved.Updated.IsZero() {
+		t.Errorf("unexpected triage %+v", saved)
+	}
+	for _, body := range []string{
+		`{"ip":"192.0.2.2","port":80,"proto":"tcp","state":"ignored"}`,
+		`{"ip":"192.0.2.300","port":80,"proto":"tcp","state":"expected"}`,
+		`{"ip":"192.0.2.2","port":80,"state":"expected"}`,
+	} {
+		if w := put(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+
+	tr, err := db.LoadTriage("192.0.2.1", 22, "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.State != scan.TriageAcknowledged || tr.Assignee != "ops@example.com" || tr.Comment != "Bastion" {
+		t.Errorf("unexpected triage %+v", tr)
+	}
+	var audits int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM audit WHERE action = 'triage'`).Scan(&audits); err != nil {
+		t.Fatal(err)
+	}
+	if audits != 2 {
+		t.Errorf("expected 2 triage audit entries, got %d", audits)
+	}
+
+	t.Run("Filter", func(t *testing.T) {
+		tests := []struct {
+			query url.Values
+			want  int
+		}{
+			{url.Values{"triage": {"new"}}, 1},
+			{url.Values{"triage": {"acknowledged,false-positive"}}, 2},
+			{url.Values{"q": {"triage:acknowledged"}}, 1},
+			{url.Values{"q": {"not triage:new"}}, 2},
+		}
+		for _, tt := range tests {
+			r := httptest.NewRequest("GET", "/api/v1/results?"+tt.query.Encode(), nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			var resp resultsResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if w.Code != http.StatusOK || len(resp.Results) != tt.want {
+				t.Errorf("%v: expected %d results, got status %d with %d", tt.query, tt.want, w.Code, len(resp.Results))
+			}
+		}
+
+		r := httptest.NewRequest("GET", "/api/v1/results?triage=ignored", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for an invalid state, got %d", w.Code)
+		}
+	})
+
+	t.Run("ResetRemediated", func(t *testing.T) {
+		err := db.SaveTriage(scan.Triage{
+			IP: "192.0.2.3", Port: 443, Proto: "tcp", State: scan.TriageRemediated,
+			Updated: scan.Time{Time: now.Add(-time.Minute)}, UpdatedBy: "ops@example.com",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := `[{"ip":"192.0.2.3","ports":[{"port":443,"proto":"tcp","status":"open"}]}]`
+		r := httptest.NewRequest("POST", "/results", strings.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		tr, err := db.LoadTriage("192.0.2.3", 443, "tcp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.State != scan.TriageNew || tr.UpdatedBy != "" {
+			t.Errorf("expected remediated port to be reset to new, got %+v", tr)
+		}
+	})
+
+	t.Run("ResetRemediatedJob", func(t *testing.T) {
+		id, err := db.SaveJob("192.0.2.4", "443", "tcp", "ops@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		put := func() int {
+			data := `[{"ip":"192.0.2.4","ports":[{"port":443,"proto":"tcp","status":"open"}]}]`
+			r := httptest.NewRequest("PUT", fmt.Sprintf("/results/%d", id), strings.NewReader(data))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		// A job isn't done if the triage couldn't be reset, so it can be
+		// submitted again
+		if _, err := db.Exec(`ALTER TABLE triage RENAME TO triage_old`); err != nil {
+			t.Fatal(err)
+		}
+		if code := put(); code != http.StatusInternalServerError {
+			t.Errorf("expected status 500 without the triage table, got %d", code)
+		}
+		if _, err := db.Exec(`ALTER TABLE triage_old RENAME TO triage`); err != nil {
+			t.Fatal(err)
+		}
+		if code := put(); code != http.StatusOK {
+			t.Errorf("expected status 200 submitting again, got %d", code)
+		}
+	})
+
+	r = httptest.NewRequest("GET", "/ip/192.0.2.1", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "<option selected>acknowledged</option>") {
+		t.Errorf("expected acknowledged to be selected on the host page")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+// webhookAttempts is the number of times delivery of a webhook is attempted.
+const webhookAttempts = 3
+
+var (
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+	// webhookBackoff is how long to wait before retrying a failed delivery.
+	// It doubles after each attempt. It's a variable so tests can avoid
+	// waiting.
+	webhookBackoff = 5 * time.Second
+)
+
+// signatureHeader carries the HMAC-SHA256 of the request body, keyed with the
+// webhook's secret, in the form sha256=<hex>.
+const signatureHeader = "X-Scan-Signature"
+
+// signature returns the value of signatureHeader for body.
+func signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validWebhookURL reports whether s is an absolute HTTP or HTTPS URL.
+func validWebhookURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validWebhookFormat reports whether format is a known webhook format.
+func validWebhookFormat(format string) bool {
+	for _, f := range scan.WebhookFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// sendWebhook delivers the notification to the webhook in the background,
+// unless it has nothing to send.
+func (app *App) sendWebhook(h scan.Webhook, n scan.Notification) {
+	body, ok, err := webhookBody(h, n)
+	if err != nil {
+		log.Printf("notify: couldn't encode notification for %s: %v", h.URL, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	app.background(func() { app.deliverWebhook(h, n.Submission.ID, body) })
+}
+
+// deliverWebhook posts body to the webhook, retrying if it fails. Each
+// attempt is recorded in the delivery log.
+func (app *App) deliverWebhook(h scan.Webhook, submission int64, body []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := postWebhook(h, body)
+		d := scan.Delivery{
+			Webhook:    h.ID,
+			Submission: submission,
+			Time:       scan.Time{Time: time.Now().UTC()},
+			Attempt:    attempt,
+			Status:     status,
+		}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		if err := app.db.SaveDelivery(d); err != nil {
+			log.Printf("deliverWebhook: couldn't log delivery to %s: %v", h.URL, err)
+		}
+
+		// Client errors other than rate limiting won't go away by retrying
+		permanent := status >= 400 && status < 500 && status != http.StatusTooManyRequests
+		if err == nil || permanent || attempt == webhookAttempts {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postWebhook sends body to the webhook and returns the response status.
+func postWebhook(h scan.Webhook, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Secret != "" {
+		req.Header.Set(signatureHeader, signature(h.Secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
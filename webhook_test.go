@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamesog/scan/pkg/scan"
+)
+
+func TestWebhook(t *testing.T) {
+	db := createDB("TestWebhook")
+	defer db.Close()
+	app := &App{db: db}
+	mux := app.setupRouter()
+
+	webhookBackoff = 0
+	defer func() { webhookBackoff = 5 * time.Second }()
+
+	var mu sync.Mutex
+	var bodies [][]byte
+	var signatures []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		signatures = append(signatures, r.Header.Get(signatureHeader))
+		// Fail the first delivery to check it's retried
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	defer gone.Close()
+
+	admin := User{Email: "admin@example.com"}
+	for _, f := range []url.Values{
+		{"add_webhook": {receiver.URL}, "webhook_secret": {"s3cret"}},
+		{"add_webhook": {gone.URL + "/hook"}},
+	} {
+		if err := app.adminFormProcess(f, admin, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.adminFormProcess(url.Values{"add_webhook": {"ftp://example.com/"}}, admin, nil); err != errInvalidWebhook {
+		t.Errorf("expected errInvalidWebhook, got %v", err)
+	}
+
+	if _, err := db.SaveData([]scan.Result{
+		{IP: "192.0.2.1", Ports: []scan.Port{{Port: 22, Proto: "tcp", Status: "open"}, {Port: 80, Proto: "tcp", Status: "open"}}},
+	}, time.Now().UTC().Add(-time.Hour).Truncate(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	data := `[{"ip":"192.0.2.1","ports":[{"port":22,"proto":"tcp","status":"open"},{"port":443,"proto":"tcp","status":"open"}]}]`
+	r := httptest.NewRequest("POST", "/results", strings.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	app.pending.Wait()
+
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 deliveries to the receiver, got %d", len(bodies))
+	}
+	for i, body := range bodies {
+		if want := signature("s3cret", body); signatures[i] != want {
+			t.Errorf("delivery %d: expected signature %s, got %s", i, want, signatures[i])
+		}
+	}
+	var n scan.Notification
+	if err := json.Unmarshal(bodies[1], &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Submission.ID != 1 {
+		t.Errorf("expected submission 1, got %d", n.Submission.ID)
+	}
+	if len(n.Opened) != 1 || n.Opened[0].Port != 443 {
+		t.Errorf("expected port 443 to be opened, got %+v", n.Opened)
+	}
+	if len(n.Closed) != 1 || n.Closed[0].Port != 80 {
+		t.Errorf("expected port 80 to be closed, got %+v", n.Closed)
+	}
+
+	deliveries, err := db.LoadDeliveries(deliveryLogSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two attempts to the receiver, and one to the webhook which doesn't
+	// exist as client errors aren't retried
+	var failed, succeeded int
+	for _, d := range deliveries {
+		if d.Error != "" {
+			failed++
+		} else {
+			succeeded++
+		}
+	}
+	if len(deliveries) != 3 || failed != 2 || succeeded != 1 {
+		t.Errorf("expected 1 successful and 2 failed deliveries, got %+v", deliveries)
+	}
+
+	if err := app.adminFormProcess(url.Values{"delete_webhook": {"2"}}, admin, nil); err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := db.LoadWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 1 || hooks[0].URL != receiver.URL {
+		t.Errorf("unexpected webhooks after deletion: %+v", hooks)
+	}
+}